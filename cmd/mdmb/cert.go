@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"text/tabwriter"
+)
+
+// parseCertificate parses a PEM or DER encoded certificate
+func parseCertificate(b []byte) (*x509.Certificate, error) {
+	if block, _ := pem.Decode(b); block != nil {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("unexpected PEM block type: %s", block.Type)
+		}
+		b = block.Bytes
+	}
+	return x509.ParseCertificate(b)
+}
+
+var keyUsageNames = []struct {
+	ku   x509.KeyUsage
+	name string
+}{
+	{x509.KeyUsageDigitalSignature, "DigitalSignature"},
+	{x509.KeyUsageContentCommitment, "ContentCommitment"},
+	{x509.KeyUsageKeyEncipherment, "KeyEncipherment"},
+	{x509.KeyUsageDataEncipherment, "DataEncipherment"},
+	{x509.KeyUsageKeyAgreement, "KeyAgreement"},
+	{x509.KeyUsageCertSign, "CertSign"},
+	{x509.KeyUsageCRLSign, "CRLSign"},
+	{x509.KeyUsageEncipherOnly, "EncipherOnly"},
+	{x509.KeyUsageDecipherOnly, "DecipherOnly"},
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "Any",
+	x509.ExtKeyUsageServerAuth:      "ServerAuth",
+	x509.ExtKeyUsageClientAuth:      "ClientAuth",
+	x509.ExtKeyUsageCodeSigning:     "CodeSigning",
+	x509.ExtKeyUsageEmailProtection: "EmailProtection",
+	x509.ExtKeyUsageTimeStamping:    "TimeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+func hexFingerprint(sum []byte) string {
+	h := strings.ToUpper(hex.EncodeToString(sum))
+	var parts []string
+	for i := 0; i < len(h); i += 2 {
+		parts = append(parts, h[i:i+2])
+	}
+	return strings.Join(parts, ":")
+}
+
+// loadCertPool returns the system CAs (if available) plus the PEM
+// encoded CA certificates in file
+func loadCertPool(file string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	return appendCertPoolFile(pool, file)
+}
+
+// loadTrustAnchors returns only the PEM encoded CA certificates in file
+func loadTrustAnchors(file string) (*x509.CertPool, error) {
+	return appendCertPoolFile(x509.NewCertPool(), file)
+}
+
+func appendCertPoolFile(pool *x509.CertPool, file string) (*x509.CertPool, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no PEM certificates found in %s", file)
+	}
+	return pool, nil
+}
+
+// subjectAltNames formats SANs in the style of OpenSSL (e.g. "DNS:host")
+func subjectAltNames(dnsNames, emails []string, ips []net.IP, uris []*url.URL) []string {
+	var sans []string
+	for _, v := range dnsNames {
+		sans = append(sans, "DNS:"+v)
+	}
+	for _, v := range emails {
+		sans = append(sans, "email:"+v)
+	}
+	for _, v := range ips {
+		sans = append(sans, "IP:"+v.String())
+	}
+	for _, v := range uris {
+		sans = append(sans, "URI:"+v.String())
+	}
+	return sans
+}
+
+func printCertificate(out io.Writer, cert *x509.Certificate) {
+	var kus []string
+	for _, v := range keyUsageNames {
+		if cert.KeyUsage&v.ku != 0 {
+			kus = append(kus, v.name)
+		}
+	}
+	var ekus []string
+	for _, v := range cert.ExtKeyUsage {
+		if name, ok := extKeyUsageNames[v]; ok {
+			ekus = append(ekus, name)
+		} else {
+			ekus = append(ekus, fmt.Sprintf("%d", v))
+		}
+	}
+	sans := subjectAltNames(cert.DNSNames, cert.EmailAddresses, cert.IPAddresses, cert.URIs)
+	md5Sum := md5.Sum(cert.Raw)
+	sha1Sum := sha1.Sum(cert.Raw)
+	sha256Sum := sha256.Sum256(cert.Raw)
+
+	w := tabwriter.NewWriter(out, 4, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "Subject\t%s\n", cert.Subject)
+	fmt.Fprintf(w, "Issuer\t%s\n", cert.Issuer)
+	fmt.Fprintf(w, "Serial\t%s\n", cert.SerialNumber)
+	fmt.Fprintf(w, "Not before\t%s\n", cert.NotBefore)
+	fmt.Fprintf(w, "Not after\t%s\n", cert.NotAfter)
+	fmt.Fprintf(w, "Key usage\t%s\n", strings.Join(kus, ", "))
+	fmt.Fprintf(w, "Extended key usage\t%s\n", strings.Join(ekus, ", "))
+	fmt.Fprintf(w, "Subject alt names\t%s\n", strings.Join(sans, ", "))
+	fmt.Fprintf(w, "MD5 fingerprint\t%s\n", hexFingerprint(md5Sum[:]))
+	fmt.Fprintf(w, "SHA1 fingerprint\t%s\n", hexFingerprint(sha1Sum[:]))
+	fmt.Fprintf(w, "SHA256 fingerprint\t%s\n", hexFingerprint(sha256Sum[:]))
+	w.Flush()
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/jessepeterson/mdmb/internal/device"
+)
+
+// dryRunProfileInstall dry-runs installing profile pb onto the -uuids
+// devices, or number new (unsaved) devices from gen, and prints what each
+// payload would do. It returns the number of devices with errors.
+func dryRunProfileInstall(out io.Writer, pb []byte, opts *device.InstallOptions, rctx RunContext, gen *device.DeviceGenerator, number int) int {
+	w := tabwriter.NewWriter(out, 4, 4, 4, ' ', 0)
+	var devs []*device.Device
+	var errCt int
+	if number > 0 {
+		for i := 0; i < number; i++ {
+			dev, err := gen.NewRandomDevice(rctx.DB)
+			if err != nil {
+				fmt.Fprintf(w, "error: %s\n", err)
+				errCt++
+				continue
+			}
+			devs = append(devs, dev)
+		}
+	}
+	for _, u := range rctx.UUIDs {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			fmt.Fprintf(w, "%s\n\terror: %s\n", u, err)
+			errCt++
+			continue
+		}
+		devs = append(devs, dev)
+	}
+
+	for _, dev := range devs {
+		fmt.Fprintf(w, "%s\n", dev.UDID)
+		plds, err := dev.DryRunProfileInstall(pb, opts)
+		for _, pld := range plds {
+			fmt.Fprintf(w, "\t%s\t%s", pld.PayloadType, pld.PayloadUUID)
+			switch {
+			case pld.Skipped:
+				fmt.Fprint(w, "\tskipped")
+			case pld.CSR != nil:
+				fmt.Fprintf(w, "\tsubject: %s", pld.CSR.Subject)
+				if sans := subjectAltNames(pld.CSR.DNSNames, pld.CSR.EmailAddresses, pld.CSR.IPAddresses, pld.CSR.URIs); len(sans) > 0 {
+					fmt.Fprintf(w, "\tSANs: %s", strings.Join(sans, ", "))
+				}
+			case pld.Identity != nil:
+				fmt.Fprintf(w, "\tsubject: %s", pld.Identity.Subject)
+			}
+			fmt.Fprintln(w)
+		}
+		if err != nil {
+			errCt++
+			fmt.Fprintf(w, "\terror: %s\n", err)
+		} else {
+			fmt.Fprint(w, "\tok\n")
+		}
+	}
+	w.Flush()
+	return errCt
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/jessepeterson/mdmb/internal/device"
+)
+
+// headerFlag collects repeated -header key=value flags
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var kvs []string
+	for k, vs := range h {
+		for _, v := range vs {
+			kvs = append(kvs, k+"="+v)
+		}
+	}
+	return strings.Join(kvs, ",")
+}
+
+func (h headerFlag) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i < 1 {
+		return fmt.Errorf("invalid header %q: must be key=value", s)
+	}
+	http.Header(h).Add(s[:i], s[i+1:])
+	return nil
+}
+
+func newFetchClient(insecure bool) *http.Client {
+	return device.NewHTTPClient(&tls.Config{InsecureSkipVerify: insecure})
+}
+
+func fetchProfileResponse(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching profile: HTTP status %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// fetchProfile downloads an enrollment profile, following redirects. The
+// profile may be a plain plist or CMS signed (application/pkcs7-mime)
+// which profile installation unwraps.
+func fetchProfile(url string, insecure bool) ([]byte, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetchProfileResponse(newFetchClient(insecure), req)
+}
+
+// fetchADEProfile POSTs the signed device MachineInfo to an ADE (DEP)
+// enrollment URL and returns the enrollment profile
+func fetchADEProfile(url string, machineInfo []byte, insecure bool) ([]byte, error) {
+	req, err := http.NewRequest("POST", url, bytes.NewReader(machineInfo))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/pkcs7-signature")
+	return fetchProfileResponse(newFetchClient(insecure), req)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jessepeterson/mdmb/internal/device"
+)
+
+const (
+	FleetEventConnect = "connect"
+	FleetEventCommand = "command"
+	FleetEventError   = "error"
+	FleetEventDropped = "dropped"
+	FleetEventRenewed = "renewed"
+)
+
+// FleetEvent is a single event from one device's Connect loop
+type FleetEvent struct {
+	Time        time.Time
+	UDID        string
+	Type        string
+	RequestType string `json:",omitempty"`
+	CommandUUID string `json:",omitempty"`
+	Status      string `json:",omitempty"`
+	Error       string `json:",omitempty"`
+}
+
+// FleetRunner runs and supervises a continuous Connect loop per device
+// and aggregates the events from all loops onto a single channel
+type FleetRunner struct {
+	// Interval is the time between Connects for a device
+	Interval time.Duration
+	// RestartDelay is the initial delay after a failed Connect. It
+	// doubles for each consecutive failure up to MaxRestartDelay.
+	RestartDelay    time.Duration
+	MaxRestartDelay time.Duration
+	// RenewWithin, if set, renews a device's MDM identity before a
+	// Connect once its certificate expires within this duration
+	RenewWithin time.Duration
+	// Workers, if set, limits how many devices Connect at once
+	Workers int
+	// Connects, if set, stops a device's loop after this many Connects
+	// (successful or not)
+	Connects int
+
+	events chan FleetEvent
+	cwds   []*ConnectWorkerData
+	// sem holds a token per Connect in progress when Workers is set
+	sem chan struct{}
+}
+
+func NewFleetRunner(cwds []*ConnectWorkerData, interval time.Duration) *FleetRunner {
+	return &FleetRunner{
+		Interval:        interval,
+		RestartDelay:    time.Second,
+		MaxRestartDelay: time.Minute,
+		events:          make(chan FleetEvent, len(cwds)),
+		cwds:            cwds,
+	}
+}
+
+// Events returns the unified event feed. It is closed once every device
+// loop has stopped.
+func (fr *FleetRunner) Events() <-chan FleetEvent {
+	return fr.events
+}
+
+func (fr *FleetRunner) emit(ctx context.Context, ev FleetEvent) {
+	ev.Time = time.Now()
+	select {
+	case fr.events <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// Run starts the device loops and returns immediately. Loops stop when
+// ctx is cancelled or when their device is unenrolled.
+func (fr *FleetRunner) Run(ctx context.Context) {
+	if fr.Workers > 0 {
+		fr.sem = make(chan struct{}, fr.Workers)
+	}
+	var wg sync.WaitGroup
+	for _, cwd := range fr.cwds {
+		wg.Add(1)
+		go func(cwd *ConnectWorkerData) {
+			defer wg.Done()
+			fr.loop(ctx, cwd)
+		}(cwd)
+	}
+	go func() {
+		wg.Wait()
+		close(fr.events)
+	}()
+}
+
+func (fr *FleetRunner) loop(ctx context.Context, cwd *ConnectWorkerData) {
+	udid := cwd.Device.UDID
+	cwd.MDMClient.CommandResultFunc = func(reqType, commandUUID, status string) {
+		fr.emit(ctx, FleetEvent{
+			UDID:        udid,
+			Type:        FleetEventCommand,
+			RequestType: reqType,
+			CommandUUID: commandUUID,
+			Status:      status,
+		})
+	}
+	delay := fr.RestartDelay
+	for n := 1; ; n++ {
+		wait := fr.Interval
+		err := fr.connect(ctx, cwd)
+		if err == context.Canceled || err == context.DeadlineExceeded {
+			return
+		}
+		if err != nil {
+			// a 401 means the MDM server no longer knows this enrollment
+			var httpErr *device.MDMHTTPError
+			if cwd.Device.MDMProfileIdentifier == "" ||
+				errors.As(err, &httpErr) && httpErr.StatusCode == http.StatusUnauthorized {
+				fr.emit(ctx, FleetEvent{UDID: udid, Type: FleetEventDropped, Error: err.Error()})
+				return
+			}
+			fr.emit(ctx, FleetEvent{UDID: udid, Type: FleetEventError, Error: err.Error()})
+			var busyErr *device.ServerBusyError
+			if errors.As(err, &busyErr) && busyErr.RetryAfter > 0 {
+				wait = busyErr.RetryAfter
+			} else {
+				wait = delay
+				delay *= 2
+				if delay > fr.MaxRestartDelay {
+					delay = fr.MaxRestartDelay
+				}
+			}
+		} else {
+			fr.emit(ctx, FleetEvent{UDID: udid, Type: FleetEventConnect})
+			delay = fr.RestartDelay
+		}
+		if fr.Connects > 0 && n >= fr.Connects {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// connect renews the MDM identity (if due) and Connects once, waiting
+// for a worker if their number is limited. It returns ctx's error if
+// cancelled while waiting.
+func (fr *FleetRunner) connect(ctx context.Context, cwd *ConnectWorkerData) error {
+	if fr.sem != nil {
+		select {
+		case fr.sem <- struct{}{}:
+			defer func() { <-fr.sem }()
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if fr.RenewWithin > 0 {
+		// a failed renewal still leaves the current identity to use
+		renewed, err := renewWork(cwd, fr.RenewWithin)
+		if err != nil {
+			fr.emit(ctx, FleetEvent{UDID: cwd.Device.UDID, Type: FleetEventError, Error: err.Error()})
+		} else if renewed {
+			fr.emit(ctx, FleetEvent{UDID: cwd.Device.UDID, Type: FleetEventRenewed})
+		}
+	}
+	return connectWork(cwd)
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// fleetDeviceStats is the Connect activity of a single device
+type fleetDeviceStats struct {
+	UDID      string
+	Connects  int
+	Errors    int
+	Commands  int
+	Dropped   bool
+	LastError string
+}
+
+// fleetConnect runs a FleetRunner over the devices and writes a line for
+// each command processed and each failed Connect. It collects per-device
+// and aggregate stats from the events; request latencies are left to the
+// metrics collector. Devices unenrolled during the run are dropped.
+type fleetConnect struct {
+	fr  *FleetRunner
+	out io.Writer
+
+	stats []*fleetDeviceStats
+	// byUDID indexes stats
+	byUDID map[string]*fleetDeviceStats
+	// commands are counted by request type and status
+	commands map[string]map[string]int
+	elapsed  time.Duration
+}
+
+// newFleetConnect connects every device connects times (0 until
+// cancelled) with interval between its Connects, using at most workers
+// Connects at once
+func newFleetConnect(cwds []*ConnectWorkerData, workers, connects int, interval time.Duration, out io.Writer) *fleetConnect {
+	fr := NewFleetRunner(cwds, interval)
+	fr.Workers = workers
+	fr.Connects = connects
+	fc := &fleetConnect{
+		fr:       fr,
+		out:      out,
+		byUDID:   make(map[string]*fleetDeviceStats),
+		commands: make(map[string]map[string]int),
+	}
+	for _, cwd := range cwds {
+		s := &fleetDeviceStats{UDID: cwd.Device.UDID}
+		fc.stats = append(fc.stats, s)
+		fc.byUDID[s.UDID] = s
+	}
+	return fc
+}
+
+// run runs the devices' Connect loops until they are done or ctx is
+// cancelled
+func (fc *fleetConnect) run(ctx context.Context) {
+	started := time.Now()
+	fc.fr.Run(ctx)
+	for ev := range fc.fr.Events() {
+		fc.record(ev)
+	}
+	fc.elapsed = time.Since(started)
+}
+
+// record adds ev to the stats
+func (fc *fleetConnect) record(ev FleetEvent) {
+	s := fc.byUDID[ev.UDID]
+	switch ev.Type {
+	case FleetEventConnect:
+		s.Connects++
+	case FleetEventCommand:
+		s.Commands++
+		if fc.commands[ev.RequestType] == nil {
+			fc.commands[ev.RequestType] = make(map[string]int)
+		}
+		fc.commands[ev.RequestType][ev.Status]++
+		fmt.Fprintf(fc.out, "%s: %s %s\n", ev.UDID, ev.RequestType, ev.Status)
+	case FleetEventError, FleetEventDropped:
+		s.Connects++
+		s.Errors++
+		s.LastError = ev.Error
+		s.Dropped = ev.Type == FleetEventDropped
+		fmt.Fprintf(fc.out, "%s: %s: %s\n", ev.UDID, ev.Type, ev.Error)
+	case FleetEventRenewed:
+		fmt.Fprintf(fc.out, "%s: MDM identity renewed\n", ev.UDID)
+	}
+}
+
+// printSummary writes the per-device stats and the aggregate stats
+func (fc *fleetConnect) printSummary(out io.Writer) {
+	w := tabwriter.NewWriter(out, 4, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "\nUDID\tConnects\tErrors\tCommands\tDropped\tLast error\n")
+	var connectCt, errCt, commandCt, droppedCt int
+	for _, s := range fc.stats {
+		connectCt += s.Connects
+		errCt += s.Errors
+		commandCt += s.Commands
+		dropped := "no"
+		if s.Dropped {
+			dropped = "yes"
+			droppedCt++
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%s\t%s\n", s.UDID, s.Connects, s.Errors, s.Commands, dropped, s.LastError)
+	}
+
+	var reqTypes []string
+	for reqType := range fc.commands {
+		reqTypes = append(reqTypes, reqType)
+	}
+	sort.Strings(reqTypes)
+	if len(reqTypes) > 0 {
+		fmt.Fprintf(w, "\nRequest type\tStatus\tCommands\n")
+	}
+	for _, reqType := range reqTypes {
+		var statuses []string
+		for status := range fc.commands[reqType] {
+			statuses = append(statuses, status)
+		}
+		sort.Strings(statuses)
+		for _, status := range statuses {
+			fmt.Fprintf(w, "%s\t%s\t%d\n", reqType, status, fc.commands[reqType][status])
+		}
+	}
+
+	fmt.Fprintf(w, "\nDevices\t%d\n", len(fc.stats))
+	fmt.Fprintf(w, "Dropped devices\t%d\n", droppedCt)
+	fmt.Fprintf(w, "Connects\t%d\n", connectCt)
+	fmt.Fprintf(w, "Connect errors\t%d\n", errCt)
+	fmt.Fprintf(w, "Commands\t%d\n", commandCt)
+	fmt.Fprintf(w, "Total elapsed time\t%s\n", fc.elapsed.Round(time.Millisecond))
+	if fc.elapsed > 0 {
+		fmt.Fprintf(w, "Throughput\t%.1f commands/s\n", float64(commandCt)/fc.elapsed.Seconds())
+	}
+	w.Flush()
+}
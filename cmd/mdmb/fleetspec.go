@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jessepeterson/mdmb/internal/device"
+	"gopkg.in/yaml.v3"
+)
+
+// serialLength is the length of generated fleet serial numbers
+const serialLength = 12
+
+// FleetSpec declares a fleet of devices for fleet-apply. Devices are
+// identified by serial number so applying a spec again finds the devices
+// it created.
+type FleetSpec struct {
+	// Profile is the enrollment profile file of groups without their
+	// own, relative to the spec file
+	Profile string       `yaml:"profile,omitempty"`
+	Groups  []FleetGroup `yaml:"groups"`
+}
+
+// FleetGroup is a set of devices of a fleet. Its serial numbers are
+// either listed in Serials or are Count serials of SerialPrefix followed
+// by a zero-padded number, counting from SerialStart.
+type FleetGroup struct {
+	Name         string   `yaml:"name,omitempty"`
+	Platform     string   `yaml:"platform,omitempty"`
+	Count        int      `yaml:"count,omitempty"`
+	SerialPrefix string   `yaml:"serialPrefix,omitempty"`
+	SerialStart  int      `yaml:"serialStart,omitempty"`
+	Serials      []string `yaml:"serials,omitempty"`
+	Profile      string   `yaml:"profile,omitempty"`
+}
+
+// serialNumbers returns the serial numbers of the group's devices
+func (g *FleetGroup) serialNumbers() ([]string, error) {
+	if len(g.Serials) > 0 {
+		if g.Count != 0 || g.SerialPrefix != "" {
+			return nil, errors.New("serials can't be combined with count or serialPrefix")
+		}
+		return g.Serials, nil
+	}
+	if g.SerialPrefix == "" || g.Count < 1 {
+		return nil, errors.New("needs serials or a serialPrefix and count")
+	}
+	digits := serialLength - len(g.SerialPrefix)
+	if digits < 1 {
+		return nil, fmt.Errorf("serialPrefix %q must be shorter than %d characters", g.SerialPrefix, serialLength)
+	}
+	last := fmt.Sprintf("%d", g.SerialStart+g.Count-1)
+	if g.SerialStart < 0 || len(last) > digits {
+		return nil, fmt.Errorf("serialPrefix %q leaves room for %d digits, not serial number %s", g.SerialPrefix, digits, last)
+	}
+	serials := make([]string, g.Count)
+	for i := range serials {
+		serials[i] = fmt.Sprintf("%s%0*d", g.SerialPrefix, digits, g.SerialStart+i)
+	}
+	return serials, nil
+}
+
+// fleetDevice is a device declared by a fleet spec
+type fleetDevice struct {
+	Serial   string
+	Platform string
+	// Profile is the path of the enrollment profile, if any
+	Profile string
+}
+
+// loadFleetSpec reads a fleet spec from a YAML file and returns its
+// devices, checking that no serial number is declared twice
+func loadFleetSpec(file string) ([]fleetDevice, error) {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	spec := &FleetSpec{}
+	if err := yaml.Unmarshal(b, spec); err != nil {
+		return nil, fmt.Errorf("parsing fleet spec %s: %w", file, err)
+	}
+	// profiles are relative to the spec
+	relPath := func(p string) string {
+		if p == "" || filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(filepath.Dir(file), p)
+	}
+	var devices []fleetDevice
+	seen := make(map[string]string)
+	for i, g := range spec.Groups {
+		name := g.Name
+		if name == "" {
+			name = fmt.Sprintf("group %d", i+1)
+		}
+		if g.Platform != "" && !device.ValidPlatform(g.Platform) {
+			return nil, fmt.Errorf("fleet spec %s: unknown platform %q: must be one of %s", name, g.Platform, strings.Join(device.Platforms, ", "))
+		}
+		serials, err := g.serialNumbers()
+		if err != nil {
+			return nil, fmt.Errorf("fleet spec %s: %w", name, err)
+		}
+		profile := g.Profile
+		if profile == "" {
+			profile = spec.Profile
+		}
+		for _, serial := range serials {
+			if other, ok := seen[serial]; ok {
+				return nil, fmt.Errorf("fleet spec %s: serial number %s already in %s", name, serial, other)
+			}
+			seen[serial] = name
+			devices = append(devices, fleetDevice{Serial: serial, Platform: g.Platform, Profile: relPath(profile)})
+		}
+	}
+	return devices, nil
+}
+
+// writeFleetSpec writes spec as YAML
+func writeFleetSpec(w io.Writer, spec *FleetSpec) error {
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(spec); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// fleetSpecFromDevices creates a fleet spec listing the serial numbers of
+// the devices by platform
+func fleetSpecFromDevices(devices []*device.Device, profile string) *FleetSpec {
+	spec := &FleetSpec{Profile: profile}
+	groups := make(map[string]int)
+	for _, d := range devices {
+		i, ok := groups[d.Platform]
+		if !ok {
+			i = len(spec.Groups)
+			groups[d.Platform] = i
+			spec.Groups = append(spec.Groups, FleetGroup{Name: d.Platform, Platform: d.Platform})
+		}
+		spec.Groups[i].Serials = append(spec.Groups[i].Serials, d.Serial)
+	}
+	for _, g := range spec.Groups {
+		sort.Strings(g.Serials)
+	}
+	return spec
+}
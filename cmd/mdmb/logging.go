@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/jessepeterson/mdmb/internal/device"
+)
+
+// newLogger creates the logfmt logger (on stderr) that devices log to,
+// filtered to levelName and above
+func newLogger(levelName string) (kitlog.Logger, error) {
+	var opt level.Option
+	switch levelName {
+	case "debug":
+		opt = level.AllowDebug()
+	case "info":
+		opt = level.AllowInfo()
+	case "warn":
+		opt = level.AllowWarn()
+	case "error":
+		opt = level.AllowError()
+	default:
+		return nil, fmt.Errorf("invalid log level: %s", levelName)
+	}
+	logger := kitlog.NewLogfmtLogger(kitlog.NewSyncWriter(os.Stderr))
+	logger = kitlog.With(logger, "ts", kitlog.DefaultTimestampUTC)
+	return level.NewFilter(logger, opt), nil
+}
+
+// loadDevice loads a device which logs to the run's logger
+func (rctx RunContext) loadDevice(udid string) (*device.Device, error) {
+	dev, err := device.Load(udid, rctx.DB)
+	if dev != nil {
+		dev.Logger = rctx.Logger
+	}
+	return dev, err
+}
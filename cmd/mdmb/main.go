@@ -2,17 +2,31 @@ package main
 
 import (
 	"bufio"
+	"context"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	mathrand "math/rand"
+	"net/http"
+	neturl "net/url"
 	"os"
+	"os/signal"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
 	"text/tabwriter"
 	"time"
 
+	kitlog "github.com/go-kit/kit/log"
+	"github.com/jessepeterson/cfgprofiles"
 	"github.com/jessepeterson/mdmb/internal/device"
 	bolt "go.etcd.io/bbolt"
 )
@@ -33,27 +47,61 @@ func help(_ string, _ []string, _ RunContext, usage func()) {
 
 // RunContext contains "global" runtime environment settings
 type RunContext struct {
-	DB    *bolt.DB
-	UUIDs []string
+	DB     device.Store
+	UUIDs  []string
+	Logger kitlog.Logger
 }
 
+// keychainPassphraseEnv is the environment variable with the default
+// -keychain-passphrase, to keep it out of process listings
+const keychainPassphraseEnv = "MDMB_KEYCHAIN_PASSPHRASE"
+
 func main() {
 	var subCmds []subCmd = []subCmd{
 		{"help", "Display usage help", help},
 		{"devices-list", "list created devices", devicesList},
+		{"devices-show", "show the complete state of devices", devicesShow},
 		{"devices-create", "create new devices", devicesCreate},
+		{"devices-clone", "create and enroll copies of a template device", devicesClone},
+		{"devices-remove", "unenroll and delete devices", devicesRemove},
 		{"devices-connect", "devices connect to MDM", devicesConnect},
+		{"devices-connect-loop", "devices continuously connect to MDM", devicesConnectLoop},
+		{"devices-push-listen", "listen for APNs-style pushes to trigger device connects", devicesPushListen},
+		{"devices-renew", "renew device MDM identity certificates via SCEP", devicesRenew},
 		{"devices-tokenupdate", "send another tokenupdate to MDM server", devicesTokenUpdate},
 		{"devices-profiles-list", "list device profiles", devicesProfilesList},
 		{"devices-profiles-install", "install profiles onto device (i.e. enroll)", devicesProfilesInstall},
+		{"devices-ade-enroll", "enroll devices as ADE (DEP) devices from an enrollment URL", devicesADEEnroll},
 		{"devices-profiles-remove", "remove profiles from device", devicesProfilesRemove},
+		{"devices-profiles-export", "write installed profile exactly as installed", devicesProfilesExport},
+		{"devices-keychain-list", "list device keychain items", devicesKeychainList},
+		{"devices-keychain-gc", "delete unreferenced device keychain items", devicesKeychainGC},
+		{"devices-identity-export", "write a device's MDM identity as PKCS#12 or PEM", devicesIdentityExport},
+		{"fleet-apply", "create and enroll the devices of a YAML fleet spec", fleetApply},
+		{"fleet-export", "write a YAML fleet spec of devices", fleetExport},
+		{"fleet-connect", "connect every enrolled device to MDM and report command activity", fleetConnectSubCmd},
+		{"inspect-cert", "display certificate details from a file or device MDM identity", inspectCert},
 		{"version", "display version", versionSubCmd},
 	}
 	f := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	var (
-		dbPath = f.String("db", "mdmb.db", "mdmb database file path")
-		uuids  = f.String("uuids", "", "comma-separated list of device UUIDs, '-' to read from stdin, or 'all' for all devices")
+		dbPath  = f.String("db", "mdmb.db", "mdmb database file path or "+device.MemoryDBPath+" for a database discarded on exit")
+		uuids   = f.String("uuids", "", "comma-separated list of device UUIDs, '-' to read from stdin, or 'all' for all devices")
+		scepCc  = f.Int("scep-concurrency", 0, "maximum concurrent SCEP operations (0 for unlimited)")
+		caCert  = f.String("ca-cert", "", "PEM file of CA certificates to trust, in addition to the system's, for MDM, SCEP, and other HTTPS servers")
+		timeout = f.Duration("timeout", 30*time.Second, "timeout for each HTTP request")
+		retries = f.Int("retries", 0, "retry HTTP requests failing with a network error or 5xx status this many times")
+		retryBD = f.Duration("retry-base-delay", time.Second, "delay before the first retry, doubled for each further retry")
+		rate    = f.Float64("rate", 0, "maximum HTTP requests per second across all devices (0 for unlimited)")
+		lvl     = f.String("loglevel", "info", "log level: debug, info, warn, or error")
+		debug   = f.Bool("v", false, "verbose (debug) logging, same as -loglevel debug")
+		proxy   = f.String("proxy", "", "proxy URL for all HTTP requests (default from HTTP_PROXY and HTTPS_PROXY)")
+		headers = headerFlag{}
+		record  = f.String("record", "", "directory to write every check-in and Connect request and response body to")
+		cmdDir  = f.String("command-queue", "", "directory of command plists for devices to process offline instead of contacting the MDM server")
+		kcPass  = f.String("keychain-passphrase", "", "passphrase to encrypt device private keys with (default from $"+keychainPassphraseEnv+")")
 	)
+	f.Var(headers, "header", "key=value header to set on every HTTP request (repeatable)")
 	f.Usage = func() {
 		fmt.Fprintf(f.Output(), "%s [flags] <subcommand> [flags]\n", f.Name())
 		fmt.Fprint(f.Output(), "\nFlags:\n")
@@ -73,15 +121,93 @@ func main() {
 		os.Exit(2)
 	}
 
-	db, err := bolt.Open(*dbPath, 0644, nil)
-	if err != nil {
+	if f.Args()[0] == "version" {
+		// report on the DB without creating or migrating it
+		rctx := RunContext{}
+		if _, err := os.Stat(*dbPath); err == nil {
+			// bolt creates missing files, even read-only
+			boltDB, err := bolt.Open(*dbPath, 0644, &bolt.Options{Timeout: time.Second, ReadOnly: true})
+			if err == nil {
+				defer boltDB.Close()
+				rctx.DB = device.NewBoltStore(boltDB)
+			}
+		}
+		versionSubCmd(f.Args()[0], f.Args()[1:], rctx, f.Usage)
+		return
+	}
+
+	var db device.Store
+	if *dbPath == device.MemoryDBPath {
+		db = device.NewMemoryStore()
+	} else {
+		boltDB, err := bolt.Open(*dbPath, 0644, &bolt.Options{Timeout: time.Second})
+		if errors.Is(err, bolt.ErrTimeout) {
+			log.Fatalf("database %s is locked: is another mdmb running? use -db for a separate database", *dbPath)
+		} else if err != nil {
+			log.Fatal(err)
+		}
+		defer boltDB.Close()
+		db = device.NewBoltStore(boltDB)
+	}
+
+	err := device.MigrateStore(db)
+	if errors.Is(err, device.ErrNewerSchema) {
+		log.Fatalf("database %s: %s: use a newer mdmb", *dbPath, err)
+	} else if err != nil {
+		log.Fatal(err)
+	}
+
+	if *kcPass == "" {
+		*kcPass = os.Getenv(keychainPassphraseEnv)
+	}
+	err = device.SetKeychainPassphrase(db, *kcPass)
+	if errors.Is(err, device.ErrKeychainPassphrase) {
+		log.Fatalf("database %s: %s", *dbPath, err)
+	} else if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
 
 	mathrand.Seed(time.Now().UnixNano())
+	device.SetSCEPConcurrency(*scepCc)
+	if err := device.SetRecordDir(*record); err != nil {
+		log.Fatal(err)
+	}
+	if err := device.SetCommandQueueDir(*cmdDir); err != nil {
+		log.Fatal(err)
+	}
+
+	var rootCAs *x509.CertPool
+	if *caCert != "" {
+		rootCAs, err = loadCertPool(*caCert)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	httpOpts := device.HTTPClientOptions{
+		RootCAs:        rootCAs,
+		Timeout:        *timeout,
+		Header:         http.Header(headers),
+		Retries:        *retries,
+		RetryBaseDelay: *retryBD,
+		Rate:           *rate,
+	}
+	if *proxy != "" {
+		httpOpts.Proxy, err = neturl.Parse(*proxy)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	device.SetHTTPClientOptions(httpOpts)
+
+	if *debug {
+		*lvl = "debug"
+	}
+	logger, err := newLogger(*lvl)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	rctx := RunContext{DB: db}
+	rctx := RunContext{DB: db, Logger: logger}
 
 	if *uuids != "" {
 		if *uuids == "all" {
@@ -123,6 +249,14 @@ func setSubCommandFlagSetUsage(f *flag.FlagSet, usage func()) {
 	}
 }
 
+// splitList splits a comma-separated flag value, returning nil for an empty value
+func splitList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	return strings.Split(s, ",")
+}
+
 func checkDeviceUUIDs(rctx RunContext, requireEmpty bool, subCmdName string) error {
 	if requireEmpty && len(rctx.UUIDs) != 0 {
 		return errors.New("cannot supply UUIDs for " + subCmdName)
@@ -135,219 +269,1456 @@ func checkDeviceUUIDs(rctx RunContext, requireEmpty bool, subCmdName string) err
 func devicesProfilesInstall(name string, args []string, rctx RunContext, usage func()) {
 	f := flag.NewFlagSet(name, flag.ExitOnError)
 	var (
-		file = f.String("f", "", "profile to install")
+		file     = f.String("f", "", "profile to install")
+		url      = f.String("url", "", "URL to fetch the profile to install from (instead of -f)")
+		insecure = f.Bool("insecure", false, "skip TLS certificate verification when fetching -url")
+		number   = f.Int("n", 0, "create this many new devices to install onto (instead of -uuids)")
+		platform = f.String("platform", "", "platform of the -n devices: "+strings.Join(device.Platforms, ", ")+" (default random)")
+		workers  = f.Int("w", 1, "number of workers (concurrency)")
+		only     = f.String("only-payloads", "", "comma-separated payload types or identifiers to exclusively install")
+		skip     = f.String("skip-payloads", "", "comma-separated payload types or identifiers to skip installing")
+		skew     = f.Duration("clock-skew", 0, "offset the clock used for SCEP requests (e.g. 10m or -10m)")
+		pollTO   = f.Duration("scep-poll-timeout", 0, "how long to poll a PENDING SCEP request (default from payload Retries and RetryDelay)")
+		signerV  = f.Duration("scep-signer-validity", 0, "validity of the temporary SCEP signer certificate (default 24h)")
+		chalURL  = f.String("scep-challenge-url", "", "URL to fetch each SCEP challenge from instead of using the payload's (SCEP variables like %SerialNumber% are replaced)")
+		ff       = f.Bool("fail-fast", false, failFastUsage)
+		kind     = f.String("enrollment-type", "device", "MDM enrollment type: device or user")
+		force    = f.Bool("force", false, "replace an installed profile even with an older PayloadVersion")
+		fresh    = f.Bool("fresh-scep", false, "request new SCEP certificates instead of reusing identities or pending requests from earlier installs")
+		signerCA = f.String("profile-ca", "", "PEM file of trust anchors the profile must be signed by (unsigned profiles are refused)")
+		preflt   = f.Bool("preflight", false, "check that the MDM servers can be reached before installing any payloads")
+		dryRun   = f.Bool("dry-run", false, "print the SCEP CSRs and check payload order without contacting servers or changing devices")
+		metCSV   = f.String("metrics-csv", "", "file to write the timing of every request to as CSV")
 	)
 	setSubCommandFlagSetUsage(f, usage)
 	f.Parse(args)
 
-	if *file == "" {
-		fmt.Fprintln(f.Output(), "must specify profile")
+	if *kind != "device" && *kind != "user" {
+		fmt.Fprintf(f.Output(), "invalid enrollment type: %s\n", *kind)
+		f.Usage()
+		os.Exit(2)
+	}
+
+	gen := device.NewDeviceGenerator(0)
+	if err := gen.SetPlatform(*platform); err != nil {
+		fmt.Fprintln(f.Output(), err)
+		f.Usage()
+		os.Exit(2)
+	}
+
+	if (*file == "") == (*url == "") {
+		fmt.Fprintln(f.Output(), "must specify one of profile file or URL")
 		f.Usage()
 		os.Exit(2)
 	}
 
-	ep, err := ioutil.ReadFile(*file)
+	var ep []byte
+	var err error
+	if *url != "" {
+		ep, err = fetchProfile(*url, *insecure)
+	} else {
+		ep, err = ioutil.ReadFile(*file)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	err = checkDeviceUUIDs(rctx, false, name)
+	err = checkDeviceUUIDs(rctx, *number > 0, name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, u := range rctx.UUIDs {
-		fmt.Println(u)
-		dev, err := device.Load(u, rctx.DB)
+	opts := &device.InstallOptions{
+		OnlyPayloads:        splitList(*only),
+		SkipPayloads:        splitList(*skip),
+		SCEPClockSkew:       *skew,
+		SCEPPollTimeout:     *pollTO,
+		SCEPSignerValidity:  *signerV,
+		UserEnrollment:      *kind == "user",
+		Force:               *force,
+		FreshSCEPIdentities: *fresh,
+		SCEPChallengeURL:    *chalURL,
+		Preflight:           *preflt,
+	}
+	if *signerCA != "" {
+		opts.ProfileSignerRoots, err = loadTrustAnchors(*signerCA)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
 		}
+	}
 
-		err = dev.InstallProfile(ep)
-		if err != nil {
-			log.Println(err)
-			continue
+	if *dryRun {
+		if dryRunProfileInstall(os.Stdout, ep, opts, rctx, gen, *number) > 0 {
+			os.Exit(1)
 		}
+		return
 	}
-}
 
-func devicesList(name string, args []string, rctx RunContext, usage func()) {
-	err := checkDeviceUUIDs(rctx, true, name)
-	if err != nil {
-		log.Fatal(err)
+	uuids := rctx.UUIDs
+	if *number > 0 {
+		fmt.Printf("creating %d device(s)\n", *number)
+		for i := 0; i < *number; i++ {
+			d, err := gen.NewRandomDevice(rctx.DB)
+			if err != nil {
+				log.Fatal(err)
+			}
+			err = d.Save()
+			if err != nil {
+				log.Fatal(err)
+			}
+			uuids = append(uuids, d.UDID)
+		}
 	}
 
-	uuids, err := device.List(rctx.DB)
-	if err != nil {
+	metrics := startMetrics()
+	results := startInstallWorkers(uuids, *workers, *ff, func(u string) error {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			return err
+		}
+		return dev.InstallProfileWithOptions(ep, opts)
+	})
+
+	errCt := printInstallResults(os.Stdout, results)
+	if err := metrics.stop(os.Stdout, *metCSV); err != nil {
 		log.Fatal(err)
 	}
-
-	for _, v := range uuids {
-		fmt.Println(v)
+	if errCt > 0 && *ff {
+		os.Exit(1)
 	}
 }
 
-func devicesCreate(name string, args []string, rctx RunContext, usage func()) {
+func devicesADEEnroll(name string, args []string, rctx RunContext, usage func()) {
 	f := flag.NewFlagSet(name, flag.ExitOnError)
 	var (
-		number = f.Int("n", 1, "number of devices")
+		url      = f.String("url", "", "ADE enrollment URL (the DEP profile url)")
+		insecure = f.Bool("insecure", false, "skip TLS certificate verification when fetching -url")
+		workers  = f.Int("w", 1, "number of workers (concurrency)")
+		ff       = f.Bool("fail-fast", false, failFastUsage)
 	)
 	setSubCommandFlagSetUsage(f, usage)
 	f.Parse(args)
 
-	err := checkDeviceUUIDs(rctx, true, name)
+	if *url == "" {
+		fmt.Fprintln(f.Output(), "must specify enrollment URL")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, false, name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	fmt.Printf("creating %d device(s)\n", *number)
-	for i := 0; i < *number; i++ {
-		d := device.New("", rctx.DB)
-		err := d.Save()
+	results := startInstallWorkers(rctx.UUIDs, *workers, *ff, func(u string) error {
+		dev, err := rctx.loadDevice(u)
 		if err != nil {
-			log.Fatal(err)
-			continue
+			return err
+		}
+		mi, err := dev.ADEMachineInfo()
+		if err != nil {
+			return err
+		}
+		ep, err := fetchADEProfile(*url, mi, *insecure)
+		if err != nil {
+			return err
 		}
+		return dev.InstallADEProfile(ep, nil)
+	})
 
-		fmt.Println(d.UDID)
+	if printInstallResults(os.Stdout, results) > 0 && *ff {
+		os.Exit(1)
 	}
+}
 
+// deviceListEntry is the devices-list output for a single device
+type deviceListEntry struct {
+	UDID                 string
+	Serial               string
+	ComputerName         string
+	Platform             string `json:",omitempty"`
+	Enrolled             bool
+	MDMProfileIdentifier string `json:",omitempty"`
 }
 
-func devicesTokenUpdate(name string, args []string, rctx RunContext, usage func()) {
+func devicesList(name string, args []string, rctx RunContext, usage func()) {
 	f := flag.NewFlagSet(name, flag.ExitOnError)
 	var (
-		number = f.String("addl", "", "additional text inside token update values")
+		long   = f.Bool("l", false, "list devices in a table with serial, name, and enrollment status")
+		asJSON = f.Bool("json", false, "list devices as JSON")
 	)
 	setSubCommandFlagSetUsage(f, usage)
 	f.Parse(args)
 
-	err := checkDeviceUUIDs(rctx, false, name)
+	err := checkDeviceUUIDs(rctx, true, name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, u := range rctx.UUIDs {
-		fmt.Println(u)
+	uuids, err := device.List(rctx.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-		dev, err := device.Load(u, rctx.DB)
-		if err != nil {
-			log.Println(err)
-			continue
+	if !*long && !*asJSON {
+		for _, v := range uuids {
+			fmt.Println(v)
 		}
+		return
+	}
 
-		client, err := dev.MDMClient()
+	entries := []deviceListEntry{}
+	for _, u := range uuids {
+		dev, err := rctx.loadDevice(u)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
+		}
+		entries = append(entries, deviceListEntry{
+			UDID:                 dev.UDID,
+			Serial:               dev.Serial,
+			ComputerName:         dev.ComputerName,
+			Platform:             dev.Platform,
+			Enrolled:             dev.MDMProfileIdentifier != "",
+			MDMProfileIdentifier: dev.MDMProfileIdentifier,
+		})
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
 
-		err = client.TokenUpdate(*number)
-		if err != nil {
-			log.Println(err)
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "UDID\tSerial\tComputer name\tPlatform\tEnrolled\n")
+	for _, e := range entries {
+		enrolled := "no"
+		if e.Enrolled {
+			enrolled = "yes (" + e.MDMProfileIdentifier + ")"
 		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", e.UDID, e.Serial, e.ComputerName, e.Platform, enrolled)
 	}
+	w.Flush()
 }
 
-func devicesConnect(name string, args []string, rctx RunContext, usage func()) {
+// deviceShowEntry is the devices-show output for a single device
+type deviceShowEntry struct {
+	UDID          string
+	Serial        string
+	ComputerName  string
+	Platform      string
+	ProductName   string
+	Model         string
+	ModelName     string
+	OSVersion     string
+	BuildVersion  string
+	HostName      string
+	LocalHostName string
+	MACAddress    string
+
+	Enrolled                bool
+	MDMProfileIdentifier    string `json:",omitempty"`
+	EnrollmentID            string `json:",omitempty"`
+	EnrollmentUserID        string `json:",omitempty"`
+	MDMIdentityKeychainUUID string `json:",omitempty"`
+	AwaitingConfiguration   bool
+	LastCommandUUID         string `json:",omitempty"`
+	// PendingReport is whether a command result is waiting to be resent
+	PendingReport bool
+
+	// PushToken, UnlockToken, and BootstrapToken are hex encoded. They
+	// and PushMagic are redacted without -secrets.
+	PushToken      string `json:",omitempty"`
+	PushMagic      string `json:",omitempty"`
+	UnlockToken    string `json:",omitempty"`
+	BootstrapToken string `json:",omitempty"`
+
+	Profiles []string
+	// KeychainItems counts the system keychain items by class
+	KeychainItems map[string]int
+	OSUpdates     []device.OSUpdate `json:",omitempty"`
+	// Settings are the Settings command items applied
+	Settings map[string]device.SettingsItem `json:",omitempty"`
+
+	Locked  bool
+	LockPIN string `json:",omitempty"`
+	Erased  bool
+}
+
+const redacted = "(redacted)"
+
+func newDeviceShowEntry(dev *device.Device, secrets bool) (*deviceShowEntry, error) {
+	secret := func(v string) string {
+		if v == "" || secrets {
+			return v
+		}
+		return redacted
+	}
+	e := &deviceShowEntry{
+		UDID:                    dev.UDID,
+		Serial:                  dev.Serial,
+		ComputerName:            dev.ComputerName,
+		Platform:                dev.Platform,
+		ProductName:             dev.ProductName,
+		Model:                   dev.Model(),
+		ModelName:               dev.ModelName(),
+		OSVersion:               dev.OSVersion,
+		BuildVersion:            dev.BuildVersion,
+		HostName:                dev.HostName,
+		LocalHostName:           dev.LocalHostName,
+		MACAddress:              dev.MACAddress,
+		Enrolled:                dev.MDMProfileIdentifier != "",
+		MDMProfileIdentifier:    dev.MDMProfileIdentifier,
+		EnrollmentID:            dev.EnrollmentID,
+		EnrollmentUserID:        dev.EnrollmentUserID,
+		MDMIdentityKeychainUUID: dev.MDMIdentityKeychainUUID,
+		AwaitingConfiguration:   dev.AwaitingConfiguration,
+		LastCommandUUID:         dev.LastCommandUUID,
+		PendingReport:           len(dev.PendingReport) > 0,
+		PushToken:               secret(hex.EncodeToString(dev.PushToken)),
+		PushMagic:               secret(dev.PushMagic),
+		UnlockToken:             secret(hex.EncodeToString(dev.UnlockToken)),
+		BootstrapToken:          secret(hex.EncodeToString(dev.BootstrapToken)),
+		KeychainItems:           make(map[string]int),
+		OSUpdates:               dev.OSUpdates,
+		Settings:                dev.Settings,
+		Locked:                  dev.Locked,
+		LockPIN:                 dev.LockPIN,
+		Erased:                  dev.Erased,
+	}
+	var err error
+	e.Profiles, err = dev.SystemProfileStore().ListUUIDs()
+	if err != nil {
+		return nil, err
+	}
+	items, err := device.LoadKeychainItems(dev.SystemKeychain(), 0)
+	if err != nil {
+		return nil, err
+	}
+	for _, kci := range items {
+		e.KeychainItems[keychainClassNames[kci.Class]]++
+	}
+	return e, nil
+}
+
+func devicesShow(name string, args []string, rctx RunContext, usage func()) {
 	f := flag.NewFlagSet(name, flag.ExitOnError)
 	var (
-		workers    = f.Int("w", 1, "number of workers (concurrency)")
-		iterations = f.Int("i", 1, "number of iterations of connects")
+		udid    = f.String("udid", "", "show this device (instead of -uuids)")
+		secrets = f.Bool("secrets", false, "show push, unlock, and bootstrap tokens and push magic instead of redacting them")
+		asJSON  = f.Bool("json", false, "show devices as JSON")
 	)
 	setSubCommandFlagSetUsage(f, usage)
 	f.Parse(args)
 
-	err := checkDeviceUUIDs(rctx, false, name)
+	err := checkDeviceUUIDs(rctx, *udid != "", name)
 	if err != nil {
 		log.Fatal(err)
 	}
+	uuids := rctx.UUIDs
+	if *udid != "" {
+		uuids = []string{*udid}
+	}
 
-	workerData := []*ConnectWorkerData{}
-
-	for _, u := range rctx.UUIDs {
-		dev, err := device.Load(u, rctx.DB)
+	entries := []*deviceShowEntry{}
+	for _, u := range uuids {
+		dev, err := rctx.loadDevice(u)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
 		}
-
-		client, err := dev.MDMClient()
+		e, err := newDeviceShowEntry(dev, *secrets)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
 		}
+		entries = append(entries, e)
+	}
 
-		workerData = append(workerData, &ConnectWorkerData{
-			Device:    dev,
-			MDMClient: client,
-		})
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
 
-	startConnectWorkers(workerData, *workers, *iterations)
+	yesNo := func(b bool) string {
+		if b {
+			return "yes"
+		}
+		return "no"
+	}
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 4, ' ', 0)
+	for i, e := range entries {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+		fmt.Fprintf(w, "UDID:\t%s\n", e.UDID)
+		fmt.Fprintf(w, "Serial:\t%s\n", e.Serial)
+		fmt.Fprintf(w, "Computer name:\t%s\n", e.ComputerName)
+		fmt.Fprintf(w, "Platform:\t%s\n", e.Platform)
+		fmt.Fprintf(w, "Product:\t%s (%s)\n", e.ProductName, e.ModelName)
+		fmt.Fprintf(w, "Model:\t%s\n", e.Model)
+		fmt.Fprintf(w, "OS:\t%s (%s)\n", e.OSVersion, e.BuildVersion)
+		fmt.Fprintf(w, "Host name:\t%s (%s)\n", e.HostName, e.LocalHostName)
+		fmt.Fprintf(w, "MAC address:\t%s\n", e.MACAddress)
+		enrolled := "no"
+		if e.Enrolled {
+			enrolled = "yes (" + e.MDMProfileIdentifier + ")"
+		}
+		fmt.Fprintf(w, "Enrolled:\t%s\n", enrolled)
+		if e.EnrollmentID != "" {
+			fmt.Fprintf(w, "Enrollment ID:\t%s\n", e.EnrollmentID)
+			fmt.Fprintf(w, "Enrollment user ID:\t%s\n", e.EnrollmentUserID)
+		}
+		fmt.Fprintf(w, "MDM identity:\t%s\n", e.MDMIdentityKeychainUUID)
+		fmt.Fprintf(w, "Awaiting configuration:\t%s\n", yesNo(e.AwaitingConfiguration))
+		fmt.Fprintf(w, "Last command:\t%s\n", e.LastCommandUUID)
+		fmt.Fprintf(w, "Pending result:\t%s\n", yesNo(e.PendingReport))
+		fmt.Fprintf(w, "Push token:\t%s\n", e.PushToken)
+		fmt.Fprintf(w, "Push magic:\t%s\n", e.PushMagic)
+		fmt.Fprintf(w, "Unlock token:\t%s\n", e.UnlockToken)
+		fmt.Fprintf(w, "Bootstrap token:\t%s\n", e.BootstrapToken)
+		fmt.Fprintf(w, "Profiles:\t%s\n", strings.Join(e.Profiles, ", "))
+		var counts []string
+		for _, class := range []string{"identity", "certificate", "key"} {
+			counts = append(counts, fmt.Sprintf("%d %s", e.KeychainItems[class], class))
+		}
+		fmt.Fprintf(w, "Keychain items:\t%s\n", strings.Join(counts, ", "))
+		var updates []string
+		for _, u := range e.OSUpdates {
+			update := fmt.Sprintf("%s (%s)", u.Version, u.Build)
+			switch {
+			case u.Status == device.OSUpdateStatusDownloading:
+				update += fmt.Sprintf(" downloading %.0f%%", u.DownloadPercentComplete*100)
+			case u.Status == device.OSUpdateStatusInstalling:
+				update += " installing"
+			case u.IsDownloaded:
+				update += " downloaded"
+			}
+			updates = append(updates, update)
+		}
+		fmt.Fprintf(w, "OS updates:\t%s\n", strings.Join(updates, ", "))
+		var settings []string
+		for item := range e.Settings {
+			settings = append(settings, item)
+		}
+		sort.Strings(settings)
+		fmt.Fprintf(w, "Settings:\t%s\n", strings.Join(settings, ", "))
+		locked := yesNo(e.Locked)
+		if e.Locked && e.LockPIN != "" {
+			locked += " (PIN " + e.LockPIN + ")"
+		}
+		fmt.Fprintf(w, "Locked:\t%s\n", locked)
+		fmt.Fprintf(w, "Erased:\t%s\n", yesNo(e.Erased))
+	}
+	w.Flush()
 }
 
-func devicesProfilesList(name string, args []string, rctx RunContext, usage func()) {
-	err := checkDeviceUUIDs(rctx, false, name)
+func devicesCreate(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		number   = f.Int("n", 1, "number of devices")
+		seed     = f.Int64("seed", 0, "seed for reproducible device identities (0 for random)")
+		apps     = f.String("apps", "", "JSON file of the app inventory for new devices")
+		updates  = f.String("os-updates", "", "JSON file of the OS updates available to new devices")
+		platform = f.String("platform", "", "device platform: "+strings.Join(device.Platforms, ", ")+" (default random)")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	gen := device.NewDeviceGenerator(*seed)
+	if err := gen.SetPlatform(*platform); err != nil {
+		fmt.Fprintln(f.Output(), err)
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, true, name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, u := range rctx.UUIDs {
-		fmt.Printf("profiles for UUID: %s\n", u)
-		dev, err := device.Load(u, rctx.DB)
+	var appInventory []device.App
+	if *apps != "" {
+		appsJSON, err := ioutil.ReadFile(*apps)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
+		}
+		err = json.Unmarshal(appsJSON, &appInventory)
+		if err != nil {
+			log.Fatalf("parsing %s: %s", *apps, err)
+		}
+	}
+	var osUpdates []device.OSUpdate
+	if *updates != "" {
+		updatesJSON, err := ioutil.ReadFile(*updates)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = json.Unmarshal(updatesJSON, &osUpdates)
+		if err != nil {
+			log.Fatalf("parsing %s: %s", *updates, err)
 		}
+	}
 
-		profileUUIDs, err := dev.SystemProfileStore().ListUUIDs()
+	fmt.Printf("creating %d device(s)\n", *number)
+	for i := 0; i < *number; i++ {
+		d, err := gen.NewRandomDevice(rctx.DB)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
 		}
-		for _, uuid := range profileUUIDs {
-			fmt.Println(uuid)
+		d.Apps = appInventory
+		d.OSUpdates = osUpdates
+		err = d.Save()
+		if err != nil {
+			log.Fatal(err)
+			continue
 		}
+
+		fmt.Println(d.UDID)
 	}
+
 }
 
-func devicesProfilesRemove(name string, args []string, rctx RunContext, usage func()) {
+func devicesClone(name string, args []string, rctx RunContext, usage func()) {
 	f := flag.NewFlagSet(name, flag.ExitOnError)
 	var (
-		id = f.String("i", "", "profile identifier")
+		from    = f.String("from", "", "UUID of the template device")
+		number  = f.Int("n", 1, "number of clones")
+		workers = f.Int("w", 1, "number of workers (concurrency)")
+		ff      = f.Bool("fail-fast", false, failFastUsage)
 	)
 	setSubCommandFlagSetUsage(f, usage)
 	f.Parse(args)
 
-	if *id == "" {
-		fmt.Fprintln(f.Output(), "must specify profile identifier")
+	if *from == "" {
+		fmt.Fprintln(f.Output(), "must specify template device UUID")
 		f.Usage()
 		os.Exit(2)
 	}
 
-	err := checkDeviceUUIDs(rctx, false, name)
+	err := checkDeviceUUIDs(rctx, true, name)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	for _, u := range rctx.UUIDs {
-		fmt.Println(u)
-		dev, err := device.Load(u, rctx.DB)
+	template, err := rctx.loadDevice(*from)
+	if err != nil {
+		log.Fatal(err)
+	}
+	pbs, err := template.CloneProfiles()
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := &device.InstallOptions{UserEnrollment: template.EnrollmentID != ""}
+
+	gen := device.NewDeviceGenerator(0)
+	fmt.Printf("creating %d clone(s) of %s with %d profile(s)\n", *number, template.UDID, len(pbs))
+	var uuids []string
+	for i := 0; i < *number; i++ {
+		d, err := gen.Clone(template)
 		if err != nil {
-			log.Println(err)
-			continue
+			log.Fatal(err)
+		}
+		err = d.Save()
+		if err != nil {
+			log.Fatal(err)
 		}
+		uuids = append(uuids, d.UDID)
+	}
 
-		err = dev.RemoveProfile(*id)
+	results := startInstallWorkers(uuids, *workers, *ff, func(u string) error {
+		dev, err := rctx.loadDevice(u)
 		if err != nil {
-			log.Println(err)
-			continue
+			return err
+		}
+		// each clone runs its own SCEP and MDM enrollment
+		for _, pb := range pbs {
+			err = dev.InstallProfileWithOptions(pb, opts)
+			if err != nil {
+				return err
+			}
 		}
+		return nil
+	})
+
+	if printInstallResults(os.Stdout, results) > 0 && *ff {
+		os.Exit(1)
 	}
 }
 
-func versionSubCmd(_ string, _ []string, _ RunContext, _ func()) {
-	fmt.Println(version)
+func fleetApply(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		file    = f.String("f", "", "YAML fleet spec")
+		workers = f.Int("w", 1, "number of workers (concurrency)")
+		ff      = f.Bool("fail-fast", false, failFastUsage)
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	if *file == "" {
+		fmt.Fprintln(f.Output(), "must specify fleet spec file")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, true, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	fleet, err := loadFleetSpec(*file)
+	if err != nil {
+		log.Fatal(err)
+	}
+	existing, err := device.SerialUDIDs(rctx.DB)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// devices are found by serial number: existing ones are left as they
+	// are and only enrolled if they aren't yet
+	gens := make(map[string]*device.DeviceGenerator)
+	profiles := make(map[string][]byte)
+	var (
+		uuids     []string
+		createdCt int
+	)
+	for _, fd := range fleet {
+		udid, ok := existing[fd.Serial]
+		if !ok {
+			gen, ok := gens[fd.Platform]
+			if !ok {
+				gen = device.NewDeviceGenerator(0)
+				if err := gen.SetPlatform(fd.Platform); err != nil {
+					log.Fatal(err)
+				}
+				gens[fd.Platform] = gen
+			}
+			d, err := gen.NewRandomDevice(rctx.DB)
+			if err != nil {
+				log.Fatal(err)
+			}
+			d.Serial = fd.Serial
+			if err := d.Save(); err != nil {
+				log.Fatal(err)
+			}
+			udid = d.UDID
+			createdCt++
+		}
+		if fd.Profile == "" {
+			continue
+		}
+		dev, err := rctx.loadDevice(udid)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if dev.MDMProfileIdentifier != "" {
+			continue
+		}
+		if _, ok := profiles[fd.Profile]; !ok {
+			profiles[fd.Profile], err = ioutil.ReadFile(fd.Profile)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		uuids = append(uuids, udid)
+	}
+	fmt.Printf("%d device(s) in fleet: created %d, enrolling %d\n", len(fleet), createdCt, len(uuids))
+	if len(uuids) == 0 {
+		return
+	}
+
+	profileOf := make(map[string][]byte)
+	for _, fd := range fleet {
+		if fd.Profile != "" {
+			profileOf[fd.Serial] = profiles[fd.Profile]
+		}
+	}
+	results := startInstallWorkers(uuids, *workers, *ff, func(u string) error {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			return err
+		}
+		return dev.InstallProfileWithOptions(profileOf[dev.Serial], nil)
+	})
+
+	if printInstallResults(os.Stdout, results) > 0 && *ff {
+		os.Exit(1)
+	}
+}
+
+func fleetExport(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		output  = f.String("o", "", "file to write the YAML fleet spec to (default stdout)")
+		profile = f.String("profile", "", "enrollment profile file for the fleet spec")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var devices []*device.Device
+	for _, u := range rctx.UUIDs {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Fatal(err)
+		}
+		devices = append(devices, dev)
+	}
+	spec := fleetSpecFromDevices(devices, *profile)
+	if *output == "" {
+		err = writeFleetSpec(os.Stdout, spec)
+	} else {
+		var fh *os.File
+		fh, err = os.Create(*output)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer fh.Close()
+		err = writeFleetSpec(fh, spec)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func fleetConnectSubCmd(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		workers    = f.Int("w", 1, "number of workers (concurrency)")
+		connects   = f.Int("i", 1, "number of connects of every device (0 runs until interrupted)")
+		interval   = f.Duration("interval", 0, "poll interval between connects of a device")
+		duration   = f.Duration("d", 0, "stop after duration (0 for no limit)")
+		validate   = f.Bool("validate", true, "check device enrollment state before each connect")
+		notNow     = f.String("not-now", "", notNowUsage)
+		failApps   = f.String("fail-apps", "", failAppsUsage)
+		metricsCSV = f.String("metrics-csv", "", "file to write the timing of every request to as CSV")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	// -uuids selects devices; otherwise the whole enrolled fleet connects
+	if len(rctx.UUIDs) == 0 {
+		var err error
+		rctx.UUIDs, err = device.Enrolled(rctx.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(rctx.UUIDs) == 0 {
+			log.Fatal("no enrolled devices in database")
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	cwds := loadConnectWorkerData(rctx, *validate, parseNotNowFlag(*notNow), splitList(*failApps))
+	fmt.Printf("starting %d workers for %d enrolled devices\n", *workers, len(cwds))
+	fc := newFleetConnect(cwds, *workers, *connects, *interval, os.Stdout)
+	metrics := startMetrics()
+	fc.run(ctx)
+	fc.printSummary(os.Stdout)
+	if err := metrics.stop(os.Stdout, *metricsCSV); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func devicesTokenUpdate(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		number = f.String("addl", "", "additional text inside token update values")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, u := range rctx.UUIDs {
+		fmt.Println(u)
+
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		client, err := dev.MDMClient()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = client.TokenUpdate(*number)
+		if err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func devicesConnect(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		workers    = f.Int("w", 1, "number of workers (concurrency)")
+		iterations = f.Int("i", 1, "number of iterations of connects")
+		validate   = f.Bool("validate", true, "check device enrollment state before each connect")
+		interval   = f.Duration("interval", 0, "poll interval between iterations of connects")
+		notNow     = f.String("not-now", "", notNowUsage)
+		failApps   = f.String("fail-apps", "", failAppsUsage)
+		metricsCSV = f.String("metrics-csv", "", "file to write the timing of every request to as CSV")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cwds := loadConnectWorkerData(rctx, *validate, parseNotNowFlag(*notNow), splitList(*failApps))
+	metrics := startMetrics()
+	startConnectWorkers(cwds, *workers, *iterations, *interval)
+	if err := metrics.stop(os.Stdout, *metricsCSV); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func devicesPushListen(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		addr     = f.String("listen", ":8443", "address to listen on")
+		certFile = f.String("tls-cert", "", "TLS certificate file (HTTP if not given)")
+		keyFile  = f.String("tls-key", "", "TLS key file")
+		validate = f.Bool("validate", true, "check device enrollment state before each connect")
+		notNow   = f.String("not-now", "", notNowUsage)
+		failApps = f.String("fail-apps", "", failAppsUsage)
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pl := NewPushListener(loadConnectWorkerData(rctx, *validate, parseNotNowFlag(*notNow), splitList(*failApps)))
+	log.Printf("listening for pushes on %s", *addr)
+	if *certFile != "" {
+		err = http.ListenAndServeTLS(*addr, *certFile, *keyFile, pl)
+	} else {
+		err = http.ListenAndServe(*addr, pl)
+	}
+	log.Fatal(err)
+}
+
+const failFastUsage = "stop and exit non-zero on the first device error (transient errors count once the global -retries are used up)"
+
+const notNowUsage = "answer commands NotNow for this many connects before processing them: cycles for all commands and/or RequestType=cycles, comma-separated"
+
+const failAppsUsage = "comma-separated identifiers of apps whose MDM installs fail"
+
+// parseNotNowFlag parses a -not-now flag value or exits
+func parseNotNowFlag(s string) *device.NotNowPolicy {
+	if s == "" {
+		return nil
+	}
+	p, err := device.ParseNotNowPolicy(s)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+func loadConnectWorkerData(rctx RunContext, validate bool, notNow *device.NotNowPolicy, failApps []string) []*ConnectWorkerData {
+	workerData := []*ConnectWorkerData{}
+
+	for _, u := range rctx.UUIDs {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		dev.SkipValidate = !validate
+
+		client, err := dev.MDMClient()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		client.NotNow = notNow
+		client.FailApps = failApps
+
+		workerData = append(workerData, &ConnectWorkerData{
+			Device:    dev,
+			MDMClient: client,
+		})
+	}
+
+	return workerData
+}
+
+func devicesConnectLoop(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		interval = f.Duration("interval", time.Minute, "time between connects for each device")
+		duration = f.Duration("d", 0, "stop after duration (0 runs until interrupted)")
+		events   = f.String("events", "-", "file to write JSON events to, '-' for stdout")
+		validate = f.Bool("validate", true, "check device enrollment state before each connect")
+		renew    = f.Duration("renew-within", 0, "renew MDM identities expiring within this duration before connecting (0 disables)")
+		notNow   = f.String("not-now", "", notNowUsage)
+		failApps = f.String("fail-apps", "", failAppsUsage)
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := os.Stdout
+	if *events != "-" {
+		out, err = os.Create(*events)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if *duration > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *duration)
+		defer cancel()
+	}
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt)
+	go func() {
+		<-sigs
+		cancel()
+	}()
+
+	fr := NewFleetRunner(loadConnectWorkerData(rctx, *validate, parseNotNowFlag(*notNow), splitList(*failApps)), *interval)
+	fr.RenewWithin = *renew
+	fr.Run(ctx)
+	enc := json.NewEncoder(out)
+	for ev := range fr.Events() {
+		if err := enc.Encode(ev); err != nil {
+			log.Println(err)
+		}
+	}
+}
+
+func devicesProfilesList(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		udid = f.String("udid", "", "list profiles of this device (instead of -uuids)")
+		long = f.Bool("l", false, "list profile identifier, display name, UUID, and payload types")
+		id   = f.String("profile", "", "only write this profile identifier as an XML plist (signed profiles are unwrapped)")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, *udid != "", name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uuids := rctx.UUIDs
+	if *udid != "" {
+		uuids = []string{*udid}
+	}
+
+	for _, u := range uuids {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if *id != "" {
+			pb, err := dev.SystemProfileStore().LoadXML(*id)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			os.Stdout.Write(pb)
+			continue
+		}
+
+		fmt.Printf("profiles for UUID: %s\n", u)
+		if *long {
+			err = printProfiles(dev.SystemProfileStore())
+			if err != nil {
+				log.Println(err)
+			}
+			continue
+		}
+
+		profileUUIDs, err := dev.SystemProfileStore().ListUUIDs()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		for _, uuid := range profileUUIDs {
+			fmt.Println(uuid)
+		}
+	}
+}
+
+func printProfiles(ps *device.ProfileStore) error {
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 4, ' ', 0)
+	managed, err := ps.ManagedIDs()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "Identifier\tDisplay name\tUUID\tManaged\tPayload types\n")
+	err = ps.ForEach(func(id string, p *cfgprofiles.Profile) error {
+		var types []string
+		for _, plc := range p.PayloadContent {
+			if pl := cfgprofiles.CommonPayload(plc.Payload); pl != nil {
+				types = append(types, pl.PayloadType)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%s\n", p.PayloadIdentifier, p.PayloadDisplayName, p.PayloadUUID, managed[id], strings.Join(types, ", "))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+func devicesProfilesRemove(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		id = f.String("i", "", "profile identifier")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	if *id == "" {
+		fmt.Fprintln(f.Output(), "must specify profile identifier")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, u := range rctx.UUIDs {
+		fmt.Println(u)
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = dev.RemoveProfile(*id)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+	}
+}
+
+func devicesRemove(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		all = f.Bool("all", false, "remove every device (instead of -uuids)")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, *all, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	uuids := rctx.UUIDs
+	if *all {
+		uuids, err = device.List(rctx.DB)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	for _, u := range uuids {
+		fmt.Println(u)
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		err = dev.Purge()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+	}
+}
+
+var keychainClassNames = map[int]string{
+	device.ClassCertificate: "certificate",
+	device.ClassKey:         "key",
+	device.ClassIdentity:    "identity",
+}
+
+func devicesKeychainList(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		class = f.String("class", "", "only list items of class: certificate, key, or identity")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	classNum := 0
+	for c, n := range keychainClassNames {
+		if n == *class {
+			classNum = c
+		}
+	}
+	if *class != "" && classNum == 0 {
+		fmt.Fprintf(f.Output(), "invalid class: %s\n", *class)
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, u := range rctx.UUIDs {
+		fmt.Printf("keychain items for UUID: %s\n", u)
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		items, err := device.LoadKeychainItems(dev.SystemKeychain(), classNum)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		w := tabwriter.NewWriter(os.Stdout, 4, 4, 4, ' ', 0)
+		fmt.Fprintf(w, "UUID\tClass\tDetails\n")
+		for _, kci := range items {
+			var details string
+			switch kci.Class {
+			case device.ClassIdentity:
+				details = "key " + kci.IdentityKeyUUID + ", certificate " + kci.IdentityCertificateUUID
+				if kci.UUID == dev.MDMIdentityKeychainUUID {
+					details += " (MDM identity)"
+				}
+			case device.ClassKey:
+				if kci.Key != nil {
+					details = fmt.Sprintf("RSA %d bits", kci.Key.N.BitLen())
+				}
+			case device.ClassCertificate:
+				if kci.Certificate != nil {
+					details = fmt.Sprintf("%s, expires %s", kci.Certificate.Subject.CommonName, kci.Certificate.NotAfter.Format(time.RFC3339))
+				}
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\n", kci.UUID, keychainClassNames[kci.Class], details)
+		}
+		w.Flush()
+	}
+}
+
+func devicesKeychainGC(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		dryRun = f.Bool("dry-run", true, "only report unreferenced items (use -dry-run=false to delete them)")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	verb := "deleted"
+	if *dryRun {
+		verb = "would delete"
+	}
+	var total, totalSize int
+	for _, u := range rctx.UUIDs {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		count, size, err := dev.KeychainGC(*dryRun)
+		if err != nil {
+			log.Printf("device %s: %s", u, err)
+		}
+		if count > 0 {
+			fmt.Printf("%s: %s %d unreferenced keychain item(s), %d bytes\n", u, verb, count, size)
+		}
+		total += count
+		totalSize += size
+	}
+	fmt.Printf("%s %d unreferenced keychain item(s), %d bytes\n", verb, total, totalSize)
+}
+
+func inspectCert(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		udid = f.String("udid", "", "show the MDM identity certificate of this device (instead of -uuids)")
+		file = f.String("file", "", "PEM or DER certificate file to inspect")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	if *udid != "" && *file != "" {
+		fmt.Fprintln(f.Output(), "-udid and -file are mutually exclusive")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	if *file != "" {
+		err := checkDeviceUUIDs(rctx, true, name+" with -file")
+		if err != nil {
+			log.Fatal(err)
+		}
+		b, err := ioutil.ReadFile(*file)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cert, err := parseCertificate(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		printCertificate(os.Stdout, cert)
+		return
+	}
+
+	err := checkDeviceUUIDs(rctx, *udid != "", name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	uuids := rctx.UUIDs
+	if *udid != "" {
+		uuids = []string{*udid}
+	}
+
+	for _, u := range uuids {
+		fmt.Printf("MDM identity certificate for UUID: %s\n", u)
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		cert, _, err := dev.MDMIdentity()
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		printCertificate(os.Stdout, cert)
+	}
+}
+
+func devicesProfilesExport(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		id  = f.String("i", "", "profile identifier")
+		out = f.String("o", "-", "output file, '-' for stdout")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	if *id == "" {
+		fmt.Fprintln(f.Output(), "must specify profile identifier")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rctx.UUIDs) != 1 {
+		log.Fatal("must supply exactly one device UUID for " + name)
+	}
+
+	dev, err := rctx.loadDevice(rctx.UUIDs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	pb, err := dev.SystemProfileStore().LoadRaw(*id)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *out == "-" {
+		_, err = os.Stdout.Write(pb)
+	} else {
+		err = ioutil.WriteFile(*out, pb, 0644)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func devicesRenew(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		within = f.Duration("within", 0, "only renew identities expiring within this duration (0 always renews)")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	for _, u := range rctx.UUIDs {
+		dev, err := rctx.loadDevice(u)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		if *within > 0 {
+			expiring, err := dev.MDMIdentityExpiresWithin(*within)
+			if err != nil {
+				log.Println(fmt.Errorf("device %s: %w", u, err))
+				continue
+			}
+			if !expiring {
+				fmt.Printf("%s\tnot due\n", u)
+				continue
+			}
+		}
+
+		err = dev.RenewMDMIdentity()
+		if err != nil {
+			log.Println(fmt.Errorf("renew for device %s: %w", u, err))
+			continue
+		}
+		fmt.Printf("%s\trenewed\n", u)
+	}
+}
+
+func devicesIdentityExport(name string, args []string, rctx RunContext, usage func()) {
+	f := flag.NewFlagSet(name, flag.ExitOnError)
+	var (
+		out      = f.String("o", "", "output PKCS#12 file, or with -pem the prefix of the .key and .crt files")
+		password = f.String("password", "", "PKCS#12 password")
+		usePEM   = f.Bool("pem", false, "write separate PEM key and certificate files instead of PKCS#12")
+	)
+	setSubCommandFlagSetUsage(f, usage)
+	f.Parse(args)
+
+	if *out == "" {
+		fmt.Fprintln(f.Output(), "must specify output file")
+		f.Usage()
+		os.Exit(2)
+	}
+
+	err := checkDeviceUUIDs(rctx, false, name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(rctx.UUIDs) != 1 {
+		log.Fatal("must supply exactly one device UUID for " + name)
+	}
+
+	dev, err := rctx.loadDevice(rctx.UUIDs[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	if dev.MDMIdentityKeychainUUID == "" {
+		log.Fatalf("device %s has no MDM identity: is it enrolled?", dev.UDID)
+	}
+
+	if !*usePEM {
+		p12, err := dev.MDMIdentityPKCS12(*password)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = ioutil.WriteFile(*out, p12, 0600)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	cert, key, err := dev.MDMIdentity()
+	if err != nil {
+		log.Fatal(err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	err = ioutil.WriteFile(*out+".key", keyPEM, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+	err = ioutil.WriteFile(*out+".crt", certPEM, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func versionSubCmd(_ string, _ []string, rctx RunContext, _ func()) {
+	fmt.Println(version)
+
+	w := tabwriter.NewWriter(os.Stdout, 4, 4, 2, ' ', 0)
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		fmt.Fprintf(w, "module:\t%s %s\n", bi.Main.Path, bi.Main.Version)
+		settings := map[string]string{}
+		for _, s := range bi.Settings {
+			settings[s.Key] = s.Value
+		}
+		if rev := settings["vcs.revision"]; rev != "" {
+			if settings["vcs.modified"] == "true" {
+				rev += " (modified)"
+			}
+			fmt.Fprintf(w, "commit:\t%s\n", rev)
+		}
+		if t := settings["vcs.time"]; t != "" {
+			fmt.Fprintf(w, "commit time:\t%s\n", t)
+		}
+		fmt.Fprintf(w, "go:\t%s\n", bi.GoVersion)
+	} else {
+		fmt.Fprintf(w, "go:\t%s\n", runtime.Version())
+	}
+	schema := strconv.Itoa(device.SchemaVersion)
+	if rctx.DB != nil {
+		if v, err := device.DBSchemaVersion(rctx.DB); err == nil && v != 0 && v != device.SchemaVersion {
+			schema += fmt.Sprintf(" (database has %d)", v)
+		}
+	}
+	fmt.Fprintf(w, "db schema:\t%s\n", schema)
+	w.Flush()
 }
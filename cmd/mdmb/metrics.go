@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jessepeterson/mdmb/internal/device"
+)
+
+// metricsCollector collects the request timings of a run for a summary
+// and optional CSV of the raw samples
+type metricsCollector struct {
+	started time.Time
+
+	mu      sync.Mutex
+	samples []device.MetricSample
+	// phases are in the order first seen
+	phases []string
+}
+
+// startMetrics starts collecting device request timings
+func startMetrics() *metricsCollector {
+	m := &metricsCollector{started: time.Now()}
+	device.SetMetricsFunc(m.add)
+	return m
+}
+
+func (m *metricsCollector) add(s device.MetricSample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := false
+	for _, p := range m.phases {
+		if p == s.Phase {
+			seen = true
+			break
+		}
+	}
+	if !seen {
+		m.phases = append(m.phases, s.Phase)
+	}
+	m.samples = append(m.samples, s)
+}
+
+// stop stops collecting. csvFile, if set, is written with the samples.
+func (m *metricsCollector) stop(out io.Writer, csvFile string) error {
+	device.SetMetricsFunc(nil)
+	m.printSummary(out)
+	if csvFile == "" {
+		return nil
+	}
+	return m.writeCSV(csvFile)
+}
+
+// percentile returns the nearest-rank percentile p of sorted durations
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(float64(len(sorted))*p/100+0.5) - 1
+	if i < 0 {
+		i = 0
+	} else if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// printSummary writes the request and error counts and latency
+// percentiles (of successful requests) per phase and the overall request
+// throughput
+func (m *metricsCollector) printSummary(out io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.samples) == 0 {
+		return
+	}
+	elapsed := time.Since(m.started)
+	w := tabwriter.NewWriter(out, 4, 4, 4, ' ', 0)
+	fmt.Fprintf(w, "\nPhase\tRequests\tErrors\tp50\tp95\tp99\n")
+	var errCt int
+	for _, phase := range m.phases {
+		var durations []time.Duration
+		var phaseErrCt, ct int
+		for _, s := range m.samples {
+			if s.Phase != phase {
+				continue
+			}
+			ct++
+			if s.Err != nil {
+				phaseErrCt++
+				continue
+			}
+			durations = append(durations, s.Duration)
+		}
+		errCt += phaseErrCt
+		sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\t%s\t%s\n", phase, ct, phaseErrCt,
+			percentile(durations, 50).Round(time.Microsecond),
+			percentile(durations, 95).Round(time.Microsecond),
+			percentile(durations, 99).Round(time.Microsecond))
+	}
+	fmt.Fprintf(w, "\nTotal requests\t%d\n", len(m.samples))
+	fmt.Fprintf(w, "Request errors\t%d\n", errCt)
+	fmt.Fprintf(w, "Throughput\t%.1f requests/s\n", float64(len(m.samples))/elapsed.Seconds())
+	w.Flush()
+}
+
+// writeCSV writes the samples to file with a header row
+func (m *metricsCollector) writeCSV(file string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cw := csv.NewWriter(f)
+	cw.Write([]string{"started", "udid", "phase", "duration_ms", "error"})
+	for _, s := range m.samples {
+		var errStr string
+		if s.Err != nil {
+			errStr = s.Err.Error()
+		}
+		cw.Write([]string{
+			s.Started.UTC().Format(time.RFC3339Nano),
+			s.UDID,
+			s.Phase,
+			strconv.FormatFloat(float64(s.Duration)/float64(time.Millisecond), 'f', 3, 64),
+			errStr,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// PushListener is a stand-in for APNs: it accepts push notifications on
+// the APNs provider API path (POST /3/device/<token>) and connects the
+// device with that push token to its MDM server
+type PushListener struct {
+	// devices are keyed by every hex encoded push token the device has
+	// reported, including those from devices-tokenupdate -addl
+	devices map[string]*pushToken
+}
+
+type pushDevice struct {
+	cwd *ConnectWorkerData
+	// pushes coalesce while a connect is pending
+	pushed chan struct{}
+}
+
+// pushToken is a push token of a device and the push magic reported
+// with it
+type pushToken struct {
+	*pushDevice
+	magic string
+}
+
+func NewPushListener(cwds []*ConnectWorkerData) *PushListener {
+	pl := &PushListener{devices: make(map[string]*pushToken)}
+	for _, cwd := range cwds {
+		if len(cwd.Device.PushToken) == 0 {
+			log.Printf("device %s has no push token", cwd.Device.UDID)
+			continue
+		}
+		pd := &pushDevice{cwd: cwd, pushed: make(chan struct{}, 1)}
+		pl.devices[hex.EncodeToString(cwd.Device.PushToken)] = &pushToken{pd, cwd.Device.PushMagic}
+		for token, magic := range cwd.Device.AdditionalPushTokens {
+			pl.devices[token] = &pushToken{pd, magic}
+		}
+		go pd.connectOnPush()
+	}
+	return pl
+}
+
+func (pd *pushDevice) connectOnPush() {
+	for range pd.pushed {
+		err := connectWork(pd.cwd)
+		if err != nil {
+			log.Printf("device %s connect: %s", pd.cwd.Device.UDID, err)
+		} else {
+			log.Printf("device %s connected", pd.cwd.Device.UDID)
+		}
+	}
+}
+
+type apnsMDMNotification struct {
+	MDM string `json:"mdm"`
+}
+
+func apnsError(w http.ResponseWriter, status int, reason string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"reason": reason})
+}
+
+func (pl *PushListener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		apnsError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+		return
+	}
+	token := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/3/device/"))
+	pd, ok := pl.devices[token]
+	if !ok {
+		apnsError(w, http.StatusBadRequest, "BadDeviceToken")
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		apnsError(w, http.StatusBadRequest, "PayloadEmpty")
+		return
+	}
+	n := &apnsMDMNotification{}
+	if err := json.Unmarshal(body, n); err != nil || n.MDM == "" {
+		apnsError(w, http.StatusBadRequest, "BadPayload")
+		return
+	}
+	if n.MDM != pd.magic {
+		log.Printf("device %s push magic mismatch: %s", pd.cwd.Device.UDID, n.MDM)
+	}
+
+	select {
+	case pd.pushed <- struct{}{}:
+	default:
+		// a connect is already pending
+	}
+
+	apnsID := r.Header.Get("apns-id")
+	if apnsID == "" {
+		apnsID = strings.ToUpper(uuid.NewString())
+	}
+	w.Header().Set("apns-id", apnsID)
+	w.WriteHeader(http.StatusOK)
+}
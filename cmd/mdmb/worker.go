@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math"
 	"os"
@@ -16,19 +18,38 @@ import (
 type ConnectWorkerData struct {
 	Device    *device.Device
 	MDMClient *device.MDMClient
+
+	// mu serializes connects of the device so that concurrent workers
+	// (e.g. later iterations or pushes) never share it mid-session
+	mu sync.Mutex
 }
 
 func connectWork(cwd *ConnectWorkerData) error {
 	if cwd.MDMClient == nil || cwd.Device == nil {
 		return errors.New("invalid mdm client or device")
 	}
+	cwd.mu.Lock()
+	defer cwd.mu.Unlock()
 	return cwd.MDMClient.Connect()
 }
 
-func startConnectWorkers(cwds []*ConnectWorkerData, workers, iterations int) {
+// renewWork renews the device's MDM identity if its certificate expires
+// within window and reports whether it did
+func renewWork(cwd *ConnectWorkerData, window time.Duration) (bool, error) {
+	cwd.mu.Lock()
+	defer cwd.mu.Unlock()
+	expiring, err := cwd.Device.MDMIdentityExpiresWithin(window)
+	if err != nil || !expiring {
+		return false, err
+	}
+	return true, cwd.Device.RenewMDMIdentity()
+}
+
+func startConnectWorkers(cwds []*ConnectWorkerData, workers, iterations int, interval time.Duration) {
 	var wg sync.WaitGroup
 	queue := make(chan *ConnectWorkerData, workers)
 	var (
+		mu      sync.Mutex // protects the stats
 		totalCt int
 		errCt   int
 		durrAcc time.Duration
@@ -42,13 +63,15 @@ func startConnectWorkers(cwds []*ConnectWorkerData, workers, iterations int) {
 		go func() {
 			defer wg.Done()
 			for cwd := range queue {
-				totalCt++
 				started := time.Now()
 				err := connectWork(cwd)
 				d := time.Since(started)
+				mu.Lock()
+				totalCt++
 				durrVals[totalCt-1] = d
 				if err != nil {
 					errCt++
+					mu.Unlock()
 					fmt.Println()
 					log.Println(fmt.Errorf("device connect for device %s: %w", cwd.Device.UDID, err))
 					continue
@@ -68,11 +91,15 @@ func startConnectWorkers(cwds []*ConnectWorkerData, workers, iterations int) {
 				if d > durrHi {
 					durrHi = d
 				}
+				mu.Unlock()
 			}
 		}()
 	}
 	start := time.Now()
 	for i := 0; i < iterations; i++ {
+		if i > 0 && interval > 0 {
+			time.Sleep(interval)
+		}
 		for _, cwd := range cwds {
 			queue <- cwd
 		}
@@ -103,3 +130,75 @@ func startConnectWorkers(cwds []*ConnectWorkerData, workers, iterations int) {
 	fmt.Fprintf(w, "Stddev MDM connect elapsed\t%s\n", time.Duration(durrSd))
 	w.Flush()
 }
+
+type installResult struct {
+	UDID    string
+	Err     error
+	Skipped bool
+}
+
+// startInstallWorkers calls install for each UDID using workers
+// concurrent workers. If failFast is set the first error cancels any
+// installs not yet started. Transient HTTP errors are retried by the
+// device's HTTP client (see -retries) so an error here is fatal.
+func startInstallWorkers(udids []string, workers int, failFast bool, install func(string) error) []installResult {
+	if workers < 1 {
+		workers = 1
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make([]installResult, len(udids))
+	queue := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range queue {
+				results[i].UDID = udids[i]
+				if ctx.Err() != nil {
+					results[i].Skipped = true
+					continue
+				}
+				results[i].Err = install(udids[i])
+				if results[i].Err != nil {
+					log.Println(fmt.Errorf("install for device %s: %w", udids[i], results[i].Err))
+					if failFast {
+						cancel()
+					}
+				}
+			}
+		}()
+	}
+	for i := range udids {
+		queue <- i
+	}
+	close(queue)
+	wg.Wait()
+	return results
+}
+
+// printInstallResults writes a per-device summary and returns the error count
+func printInstallResults(out io.Writer, results []installResult) int {
+	var errCt, skipCt int
+	w := tabwriter.NewWriter(out, 4, 4, 4, ' ', 0)
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			skipCt++
+			fmt.Fprintf(w, "%s\tskipped\n", r.UDID)
+		case r.Err != nil:
+			errCt++
+			fmt.Fprintf(w, "%s\terror: %s\n", r.UDID, r.Err)
+		default:
+			fmt.Fprintf(w, "%s\tok\n", r.UDID)
+		}
+	}
+	fmt.Fprintf(w, "\nInstalled\t%d\n", len(results)-errCt-skipCt)
+	fmt.Fprintf(w, "Errors\t%d\n", errCt)
+	if skipCt > 0 {
+		fmt.Fprintf(w, "Skipped\t%d\n", skipCt)
+	}
+	w.Flush()
+	return errCt
+}
@@ -0,0 +1,82 @@
+package device
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// MachineInfo is the device information an ADE (DEP) device sends to the
+// MDM server's enrollment URL to fetch its enrollment profile
+type MachineInfo struct {
+	IMEI     string `plist:",omitempty"`
+	LANGUAGE string `plist:",omitempty"`
+	MEID     string `plist:",omitempty"`
+	PRODUCT  string
+	SERIAL   string
+	UDID     string
+	VERSION  string
+}
+
+// ADEMachineInfo returns the CMS signed MachineInfo for fetching the ADE
+// enrollment profile. A real device signs with an Apple-issued device
+// identity; ours is self-signed so the MDM server must not validate it.
+func (device *Device) ADEMachineInfo() ([]byte, error) {
+	mi := &MachineInfo{
+		LANGUAGE: "en-US",
+		PRODUCT:  device.ProductName,
+		SERIAL:   device.Serial,
+		UDID:     device.UDID,
+		VERSION:  device.BuildVersion,
+	}
+	if mi.PRODUCT == "" || mi.VERSION == "" {
+		return nil, errors.New("device has no product name or build version")
+	}
+	miBytes, err := plist.Marshal(mi)
+	if err != nil {
+		return nil, err
+	}
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		return nil, err
+	}
+	signedData, err := pkcs7.NewSignedData(miBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = signedData.AddSigner(cert, key, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return signedData.Finish()
+}
+
+// InstallADEProfile installs an enrollment profile fetched with
+// ADEMachineInfo. The device awaits configuration (reported in its
+// TokenUpdate) until the MDM server sends DeviceConfigured.
+func (device *Device) InstallADEProfile(pb []byte, opts *InstallOptions) error {
+	device.AwaitingConfiguration = true
+	err := device.InstallProfileWithOptions(pb, opts)
+	if err != nil {
+		device.AwaitingConfiguration = false
+		return err
+	}
+	return device.Save()
+}
+
+func (c *MDMClient) handleDeviceConfigured(reqType, commandUUID string) (interface{}, error) {
+	c.Device.AwaitingConfiguration = false
+	err := c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	// now no longer awaiting configuration
+	err = c.escrowBootstrapToken()
+	if err != nil {
+		level.Warn(c.Device.logger()).Log("msg", "SetBootstrapToken failed", "err", err)
+	}
+	return c.acknowledged(reqType, commandUUID), nil
+}
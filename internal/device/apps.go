@@ -0,0 +1,282 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// Managed app install states. Apps installed by MDM progress through
+// these, one per Connect, ending Managed or (for MDMClient.FailApps)
+// Failed.
+const (
+	AppStatusQueued      = "Queued"
+	AppStatusDownloading = "Downloading"
+	AppStatusInstalling  = "Installing"
+	AppStatusManaged     = "Managed"
+	AppStatusFailed      = "Failed"
+)
+
+// App is an application in the simulated device's app inventory
+type App struct {
+	Identifier   string
+	Name         string
+	Version      string
+	ShortVersion string
+	BundleSize   int  `json:",omitempty" plist:",omitempty"`
+	Installing   bool `json:"-" plist:",omitempty"`
+
+	// Managed is set for apps installed by the MDM server, as opposed to
+	// apps the user installed. Seeded apps may set it to start out managed.
+	Managed bool `json:",omitempty" plist:"-"`
+	// Status is the managed app install state. Seeded managed apps without
+	// one are reported Managed.
+	Status          string `json:",omitempty" plist:"-"`
+	ManagementFlags int    `json:",omitempty" plist:"-"`
+	// Removable is whether the user may remove a managed app
+	Removable bool `json:",omitempty" plist:"-"`
+}
+
+type InstalledApplicationListCommand struct {
+	ConnectResponseCommand
+	Identifiers     []string `plist:",omitempty"`
+	ManagedAppsOnly bool     `plist:",omitempty"`
+}
+
+type InstalledApplicationList struct {
+	Command     InstalledApplicationListCommand
+	CommandUUID string
+}
+
+type InstalledApplicationListResponse struct {
+	ConnectRequest
+	InstalledApplicationList []App
+}
+
+func (c *MDMClient) handleInstalledApplicationList(respBytes []byte) (interface{}, error) {
+	cmd := &InstalledApplicationList{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	resp := &InstalledApplicationListResponse{
+		ConnectRequest:           *c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID),
+		InstalledApplicationList: []App{},
+	}
+	filter := make(map[string]bool)
+	for _, id := range cmd.Command.Identifiers {
+		filter[id] = true
+	}
+	for _, app := range c.Device.Apps {
+		if len(filter) > 0 && !filter[app.Identifier] {
+			continue
+		}
+		if app.Status == AppStatusQueued || app.Status == AppStatusFailed || (cmd.Command.ManagedAppsOnly && !app.Managed) {
+			continue
+		}
+		app.Installing = app.Status == AppStatusDownloading || app.Status == AppStatusInstalling
+		resp.InstalledApplicationList = append(resp.InstalledApplicationList, app)
+	}
+	return resp, nil
+}
+
+// advanceAppInstalls moves each managed app being installed to its next
+// install state and reports whether any app changed. Installs of the apps
+// in failApps end Failed.
+func (device *Device) advanceAppInstalls(failApps []string) bool {
+	changed := false
+	for i := range device.Apps {
+		app := &device.Apps[i]
+		switch app.Status {
+		case AppStatusQueued:
+			app.Status = AppStatusDownloading
+		case AppStatusDownloading:
+			app.Status = AppStatusInstalling
+		case AppStatusInstalling:
+			app.Status = AppStatusManaged
+			for _, id := range failApps {
+				if id == app.Identifier {
+					app.Status = AppStatusFailed
+				}
+			}
+			level.Info(device.logger()).Log("msg", "app install finished", "app", app.Identifier, "status", app.Status)
+		default:
+			continue
+		}
+		changed = true
+	}
+	return changed
+}
+
+type InstallApplicationCommand struct {
+	ConnectResponseCommand
+	Identifier         string `plist:",omitempty"`
+	ITunesStoreID      int    `plist:"iTunesStoreID,omitempty"`
+	ManifestURL        string `plist:",omitempty"`
+	ManagedAppBundleID string `plist:",omitempty"`
+	ManagementFlags    int    `plist:",omitempty"`
+	Attributes         struct {
+		Removable *bool `plist:",omitempty"`
+	} `plist:",omitempty"`
+}
+
+type InstallApplication struct {
+	Command     InstallApplicationCommand
+	CommandUUID string
+}
+
+type InstallApplicationResponse struct {
+	ConnectRequest
+	Identifier string
+	// ManagedAppBundleID is the bundle identifier of the app, from the
+	// command or its manifest
+	ManagedAppBundleID string
+	State              string
+}
+
+type appManifest struct {
+	Items []struct {
+		Metadata struct {
+			BundleIdentifier string `plist:"bundle-identifier"`
+			BundleVersion    string `plist:"bundle-version"`
+			Title            string `plist:"title"`
+		} `plist:"metadata"`
+	} `plist:"items"`
+}
+
+// appFromManifest fetches an app manifest and returns the (first) app
+func appFromManifest(url string) (*App, error) {
+	resp, err := NewHTTPClient(nil).Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching app manifest: HTTP status %s", resp.Status)
+	}
+	manifestBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	manifest := &appManifest{}
+	err = plist.Unmarshal(manifestBytes, manifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing app manifest: %w", err)
+	}
+	if len(manifest.Items) < 1 || manifest.Items[0].Metadata.BundleIdentifier == "" {
+		return nil, errors.New("app manifest has no bundle-identifier")
+	}
+	md := manifest.Items[0].Metadata
+	return &App{
+		Identifier:   md.BundleIdentifier,
+		Name:         md.Title,
+		Version:      md.BundleVersion,
+		ShortVersion: md.BundleVersion,
+	}, nil
+}
+
+func (c *MDMClient) handleInstallApplication(respBytes []byte) (interface{}, error) {
+	cmd := &InstallApplication{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	id := cmd.Command.Identifier
+	if id == "" {
+		id = cmd.Command.ManagedAppBundleID
+	}
+	app := &App{Identifier: id, Name: id}
+	if cmd.Command.ManifestURL != "" {
+		app, err = appFromManifest(cmd.Command.ManifestURL)
+		if err != nil {
+			level.Warn(c.Device.logger()).Log("msg", "fetching app manifest", "request_type", cmd.Command.RequestType, "command_uuid", cmd.CommandUUID, "err", err)
+			chain := MDMErrorChain{}.Add(12010, "MCMDMErrorDomain", "The app manifest could not be fetched").AddError(err)
+			return c.errorChainResponse(cmd.Command.RequestType, cmd.CommandUUID, chain), nil
+		}
+	}
+	if app.Identifier == "" {
+		return c.errorResponse(cmd.Command.RequestType, cmd.CommandUUID, 12010, "MCMDMErrorDomain", "no app identifier or manifest URL"), nil
+	}
+	app.Managed = true
+	app.Status = AppStatusQueued
+	app.ManagementFlags = cmd.Command.ManagementFlags
+	// apps are removable unless the attributes say otherwise
+	app.Removable = cmd.Command.Attributes.Removable == nil || *cmd.Command.Attributes.Removable
+
+	replaced := false
+	for i := range c.Device.Apps {
+		if c.Device.Apps[i].Identifier == app.Identifier {
+			c.Device.Apps[i] = *app
+			replaced = true
+		}
+	}
+	if !replaced {
+		c.Device.Apps = append(c.Device.Apps, *app)
+	}
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return &InstallApplicationResponse{
+		ConnectRequest:     *c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID),
+		Identifier:         app.Identifier,
+		ManagedAppBundleID: app.Identifier,
+		State:              app.Status,
+	}, nil
+}
+
+type ManagedApplicationListCommand struct {
+	ConnectResponseCommand
+	Identifiers []string `plist:",omitempty"`
+}
+
+type ManagedApplicationList struct {
+	Command     ManagedApplicationListCommand
+	CommandUUID string
+}
+
+type ManagedApplication struct {
+	Status          string
+	ManagementFlags int
+	Removable       bool
+}
+
+type ManagedApplicationListResponse struct {
+	ConnectRequest
+	ManagedApplicationList map[string]ManagedApplication
+}
+
+func (c *MDMClient) handleManagedApplicationList(respBytes []byte) (interface{}, error) {
+	cmd := &ManagedApplicationList{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	filter := make(map[string]bool)
+	for _, id := range cmd.Command.Identifiers {
+		filter[id] = true
+	}
+	resp := &ManagedApplicationListResponse{
+		ConnectRequest:         *c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID),
+		ManagedApplicationList: make(map[string]ManagedApplication),
+	}
+	for _, app := range c.Device.Apps {
+		if !app.Managed || (len(filter) > 0 && !filter[app.Identifier]) {
+			continue
+		}
+		status := app.Status
+		if status == "" {
+			status = AppStatusManaged
+		}
+		resp.ManagedApplicationList[app.Identifier] = ManagedApplication{
+			Status:          status,
+			ManagementFlags: app.ManagementFlags,
+			Removable:       app.Removable,
+		}
+	}
+	return resp, nil
+}
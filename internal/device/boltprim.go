@@ -1,45 +1,34 @@
 package device
 
 import (
-	"bytes"
 	"strconv"
-
-	bolt "go.etcd.io/bbolt"
 )
 
-// BucketPutOrDelete Puts a value to a BoltDB bucket. If the value is empty the key is Deleted.
-func BucketPutOrDelete(tx *bolt.Tx, bucket, key string, value []byte) error {
-	b, err := tx.CreateBucketIfNotExists([]byte(bucket))
-	if err != nil {
-		return err
-	}
+// BucketPutOrDelete Puts a value to a Store bucket. If the value is empty the key is Deleted.
+func BucketPutOrDelete(tx Tx, bucket, key string, value []byte) error {
 	if len(value) == 0 {
-		return b.Delete([]byte(key))
+		return tx.Delete(bucket, key)
 	}
-	return b.Put([]byte(key), value)
+	return tx.Put(bucket, key, value)
 }
 
 // BucketGet retrieves a value from a bucket or returns nil.
-func BucketGet(tx *bolt.Tx, bucket, key string) []byte {
-	b := tx.Bucket([]byte(bucket))
-	if b == nil {
-		return nil
-	}
-	return b.Get([]byte(key))
+func BucketGet(tx Tx, bucket, key string) []byte {
+	return tx.Get(bucket, key)
 }
 
-// BucketPutOrDeleteString Puts a value to a BoltDB bucket. If the value is empty the key is Deleted.
-func BucketPutOrDeleteString(tx *bolt.Tx, bucket, key, value string) error {
+// BucketPutOrDeleteString Puts a value to a Store bucket. If the value is empty the key is Deleted.
+func BucketPutOrDeleteString(tx Tx, bucket, key, value string) error {
 	return BucketPutOrDelete(tx, bucket, key, []byte(value))
 }
 
 // BucketGetString retrieves a value from a bucket or returns "".
-func BucketGetString(tx *bolt.Tx, bucket, key string) string {
+func BucketGetString(tx Tx, bucket, key string) string {
 	return string(BucketGet(tx, bucket, key))
 }
 
-// BucketPutOrDeleteInt Puts a value to a BoltDB bucket. If the value is 0 the key is Deleted.
-func BucketPutOrDeleteInt(tx *bolt.Tx, bucket, key string, value int) error {
+// BucketPutOrDeleteInt Puts a value to a Store bucket. If the value is 0 the key is Deleted.
+func BucketPutOrDeleteInt(tx Tx, bucket, key string, value int) error {
 	var byteValue []byte
 	if value != 0 {
 		byteValue = []byte(strconv.Itoa(value))
@@ -48,26 +37,45 @@ func BucketPutOrDeleteInt(tx *bolt.Tx, bucket, key string, value int) error {
 }
 
 // BucketGetInt retrieves a value from a bucket or returns 0.
-func BucketGetInt(tx *bolt.Tx, bucket, key string) int {
+func BucketGetInt(tx Tx, bucket, key string) int {
 	i, _ := strconv.Atoi(string(BucketGet(tx, bucket, key)))
 	return i
 
 }
 
 // BucketGetKeysWithPrefix retrieves a list of keys with a prefix in a bucket
-func BucketGetKeysWithPrefix(tx *bolt.Tx, bucket string, prefix string, stripPrefix bool) []string {
-	b := tx.Bucket([]byte(bucket))
-	if b == nil {
-		return nil
+func BucketGetKeysWithPrefix(tx Tx, bucket string, prefix string, stripPrefix bool) []string {
+	keys := tx.KeysWithPrefix(bucket, prefix)
+	if stripPrefix {
+		for i := range keys {
+			keys[i] = keys[i][len(prefix):]
+		}
 	}
-	c := b.Cursor()
-	var results []string
-	prefixBytes := []byte(prefix)
-	for k, _ := c.Seek(prefixBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, _ = c.Next() {
+	return keys
+}
+
+// BucketForEachWithPrefix calls fn for each key and value with a prefix in a
+// bucket. Iteration stops at the first error from fn which is returned.
+// Keys and values are only valid for the life of the transaction.
+func BucketForEachWithPrefix(tx Tx, bucket string, prefix string, stripPrefix bool, fn func(k, v []byte) error) error {
+	for _, k := range tx.KeysWithPrefix(bucket, prefix) {
+		v := tx.Get(bucket, k)
 		if stripPrefix {
 			k = k[len(prefix):]
 		}
-		results = append(results, string(k))
+		if err := fn([]byte(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BucketDeleteWithPrefix deletes all keys with a prefix in a bucket
+func BucketDeleteWithPrefix(tx Tx, bucket string, prefix string) error {
+	for _, k := range tx.KeysWithPrefix(bucket, prefix) {
+		if err := tx.Delete(bucket, k); err != nil {
+			return err
+		}
 	}
-	return results
+	return nil
 }
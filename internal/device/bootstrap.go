@@ -0,0 +1,95 @@
+package device
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// Bootstrap tokens are only supported by macOS devices and are only
+// escrowed with servers advertising the bootstrap token capability. They're
+// escrowed once the device is done awaiting configuration.
+
+type SetBootstrapTokenRequest struct {
+	AwaitingConfiguration bool   `plist:",omitempty"`
+	BootstrapToken        []byte `plist:",omitempty"`
+	EnrollmentID          string `plist:",omitempty"`
+	MessageType           string
+	UDID                  string `plist:",omitempty"`
+}
+
+type GetBootstrapTokenRequest struct {
+	EnrollmentID string `plist:",omitempty"`
+	MessageType  string
+	UDID         string `plist:",omitempty"`
+}
+
+type GetBootstrapTokenResponse struct {
+	BootstrapToken []byte
+}
+
+// escrowBootstrapToken generates (if needed) and sends the device's
+// bootstrap token to the MDM server
+func (c *MDMClient) escrowBootstrapToken() error {
+	if !c.Device.isMac() || c.Device.AwaitingConfiguration {
+		return nil
+	}
+	if !c.HasServerCapability(CapabilityBootstrapToken) {
+		level.Debug(c.Device.logger()).Log("msg", "skipping SetBootstrapToken", "reason", "server does not support bootstrap tokens")
+		return nil
+	}
+	if len(c.Device.BootstrapToken) == 0 {
+		token := make([]byte, 32)
+		if _, err := rand.Read(token); err != nil {
+			return err
+		}
+		c.Device.BootstrapToken = token
+		if err := c.Device.Save(); err != nil {
+			return err
+		}
+	}
+	sbt := &SetBootstrapTokenRequest{
+		BootstrapToken: c.Device.BootstrapToken,
+		MessageType:    "SetBootstrapToken",
+		UDID:           c.Device.UDID,
+	}
+	if c.Device.EnrollmentID != "" {
+		sbt.UDID = ""
+		sbt.EnrollmentID = c.Device.EnrollmentID
+	}
+	return c.checkinRequest(sbt)
+}
+
+// GetBootstrapToken retrieves the bootstrap token escrowed with the MDM
+// server and checks it matches the token the device escrowed
+func (c *MDMClient) GetBootstrapToken() ([]byte, error) {
+	if !c.enrolled() {
+		return nil, errors.New("device not enrolled")
+	}
+	gbt := &GetBootstrapTokenRequest{
+		MessageType: "GetBootstrapToken",
+		UDID:        c.Device.UDID,
+	}
+	if c.Device.EnrollmentID != "" {
+		gbt.UDID = ""
+		gbt.EnrollmentID = c.Device.EnrollmentID
+	}
+	body, err := c.checkinRequestBody(gbt)
+	if err != nil {
+		return nil, err
+	}
+	resp := &GetBootstrapTokenResponse{}
+	if len(body) > 0 {
+		err = plist.Unmarshal(body, resp)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if string(resp.BootstrapToken) != string(c.Device.BootstrapToken) {
+		return resp.BootstrapToken, fmt.Errorf("MDM server bootstrap token does not match the escrowed token")
+	}
+	return resp.BootstrapToken, nil
+}
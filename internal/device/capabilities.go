@@ -0,0 +1,83 @@
+package device
+
+import (
+	"crypto/sha256"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/uuid"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// MDM server capabilities advertised in the MDM payload's
+// ServerCapabilities
+const (
+	// CapabilityPerUserConnections means the server supports macOS user
+	// channel requests
+	CapabilityPerUserConnections = "com.apple.mdm.per-user-connections"
+	// CapabilityBootstrapToken means the server supports escrowing
+	// bootstrap tokens
+	CapabilityBootstrapToken = "com.apple.mdm.bootstraptoken"
+)
+
+// setMDMPayload sets the MDM payload and the server capabilities it
+// advertises
+func (c *MDMClient) setMDMPayload(pld *cfgprofiles.MDMPayload) {
+	c.MDMPayload = pld
+	c.serverCapabilities = nil
+	if pld == nil {
+		return
+	}
+	c.serverCapabilities = make(map[string]bool)
+	for _, v := range pld.ServerCapabilities {
+		c.serverCapabilities[v] = true
+	}
+}
+
+// HasServerCapability reports whether the MDM payload advertises the
+// server capability
+func (c *MDMClient) HasServerCapability(capability string) bool {
+	return c.serverCapabilities[capability]
+}
+
+// consoleUser returns the user ID, short name, and full name of the
+// simulated console user of a Mac, derived from the device so they are
+// stable across runs
+func (device *Device) consoleUser() (userID, shortName, longName string) {
+	userID = strings.ToUpper(uuid.NewSHA1(uuid.NameSpaceOID, []byte(device.UDID)).String())
+	longName = "mdmb"
+	if i := strings.Index(device.ComputerName, "'s "); i > 0 {
+		longName = device.ComputerName[:i]
+	}
+	shortName = strings.ToLower(strings.ReplaceAll(longName, " ", ""))
+	return
+}
+
+// userTokenUpdate sends the TokenUpdate of the console user's channel as
+// macOS does when the server supports per-user connections
+func (c *MDMClient) userTokenUpdate() error {
+	if !c.Device.isMac() || c.Device.EnrollmentID != "" {
+		return nil
+	}
+	if !c.HasServerCapability(CapabilityPerUserConnections) {
+		level.Debug(c.Device.logger()).Log("msg", "skipping user channel TokenUpdate", "reason", "server does not support per-user connections")
+		return nil
+	}
+	topic, err := c.topic()
+	if err != nil {
+		return err
+	}
+	// the user channel has its own push token
+	sum := sha256.Sum256(append(append([]byte{}, c.Device.PushToken...), "user"...))
+	userID, shortName, longName := c.Device.consoleUser()
+	return c.checkinRequest(&TokenUpdateRequest{
+		MessageType:   "TokenUpdate",
+		PushMagic:     c.Device.PushMagic + "user",
+		Token:         sum[:],
+		Topic:         topic,
+		UDID:          c.Device.UDID,
+		UserID:        userID,
+		UserShortName: shortName,
+		UserLongName:  longName,
+	})
+}
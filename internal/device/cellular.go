@@ -0,0 +1,66 @@
+package device
+
+import (
+	"crypto/sha256"
+	"strings"
+)
+
+// synthetic cellular identifiers are derived from the device UDID so
+// they're stable across runs without needing to be stored
+
+// deviceDigits returns n decimal digits deterministically derived from
+// the device UDID and a label
+func (device *Device) deviceDigits(label string, n int) string {
+	var b strings.Builder
+	for i := 0; b.Len() < n; i++ {
+		sum := sha256.Sum256([]byte(label + device.UDID + string(rune('a'+i))))
+		for _, c := range sum {
+			if b.Len() == n {
+				break
+			}
+			b.WriteByte('0' + c%10)
+		}
+	}
+	return b.String()
+}
+
+// luhnDigit computes the Luhn check digit for a string of decimal digits
+func luhnDigit(digits string) byte {
+	sum := 0
+	for i := len(digits) - 1; i >= 0; i-- {
+		d := int(digits[i] - '0')
+		// double every second digit from the right, starting with the
+		// rightmost since the check digit will be appended after it
+		if (len(digits)-1-i)%2 == 0 {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+	}
+	return byte('0' + (10-sum%10)%10)
+}
+
+// IMEI returns a stable 15 digit IMEI with a valid Luhn check digit
+func (device *Device) IMEI() string {
+	body := "35" + device.deviceDigits("imei", 12)
+	return body + string(luhnDigit(body))
+}
+
+// MEID returns the MEID (the IMEI without its check digit, as reported
+// by dual-mode devices)
+func (device *Device) MEID() string {
+	return device.IMEI()[:14]
+}
+
+// ICCID returns a stable 20 digit ICCID with a valid Luhn check digit
+func (device *Device) ICCID() string {
+	body := "8901" + device.deviceDigits("iccid", 15)
+	return body + string(luhnDigit(body))
+}
+
+const (
+	cellCarrierSettingsVersion = "47.1"
+	cellCurrentCarrierNetwork  = "mdmb Mobile"
+)
@@ -0,0 +1,67 @@
+package device
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// certificateFromPayload parses the DER (or PEM) certificate of a
+// certificate payload
+func certificateFromPayload(pl *cfgprofiles.CertificatePKCS1Payload) (*x509.Certificate, error) {
+	if len(pl.PayloadContent) == 0 {
+		return nil, fmt.Errorf("certificate payload %s has no content", pl.PayloadUUID)
+	}
+	der := pl.PayloadContent
+	if block, _ := pem.Decode(der); block != nil {
+		der = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("certificate payload %s: %w", pl.PayloadUUID, err)
+	}
+	return cert, nil
+}
+
+// installCertificatePayload stores the certificate of a certificate
+// payload as a keychain item and returns its UUID
+func (device *Device) installCertificatePayload(profileID string, pl *cfgprofiles.CertificatePKCS1Payload) (string, error) {
+	cert, err := certificateFromPayload(pl)
+	if err != nil {
+		return "", err
+	}
+	kci := NewKeychainItem(device.SystemKeychain(), ClassCertificate)
+	kci.Certificate = cert
+	err = device.store.Update(func(tx Tx) error {
+		if err := kci.put(tx); err != nil {
+			return err
+		}
+		return device.SystemProfileStore().putPayloadRefString(tx, profileID, &pl.Payload, "keychain_certificate", kci.UUID)
+	})
+	if err != nil {
+		return "", err
+	}
+	return kci.UUID, nil
+}
+
+// removeCertificatePayload deletes the keychain certificate installed by
+// the certificate payload pld
+func (device *Device) removeCertificatePayload(profileID string, pld *cfgprofiles.Payload) error {
+	ps := device.SystemProfileStore()
+	ref, err := ps.loadPayloadRefString(profileID, pld, "keychain_certificate")
+	if err != nil || ref == "" {
+		return err
+	}
+	kci, err := LoadKeychainItem(device.SystemKeychain(), ref)
+	if err != nil {
+		return err
+	}
+	return device.store.Update(func(tx Tx) error {
+		if err := kci.delete(tx); err != nil {
+			return err
+		}
+		return ps.putPayloadRefString(tx, profileID, pld, "keychain_certificate", "")
+	})
+}
@@ -4,12 +4,18 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/go-kit/kit/log/level"
 	"github.com/groob/plist"
 	"github.com/jessepeterson/cfgprofiles"
 )
 
 func (c *MDMClient) handleMDMCommand(reqType, commandUUID string, respBytes []byte) (interface{}, error) {
-	if c.notNow {
+	deferred, err := c.deferCommand(reqType, commandUUID)
+	if err != nil {
+		return nil, err
+	}
+	if deferred {
+		level.Info(c.Device.logger()).Log("msg", "deferring command", "request_type", reqType, "command_uuid", commandUUID, "not_now", c.Device.NotNowCounts[commandUUID])
 		return &ConnectRequest{
 			UDID:        c.Device.UDID,
 			CommandUUID: commandUUID,
@@ -22,24 +28,89 @@ func (c *MDMClient) handleMDMCommand(reqType, commandUUID string, respBytes []by
 	case "DeviceInformation":
 		return c.handleDeviceInfo(respBytes)
 	case "ProfileList":
-		return c.handleProfileList(reqType, commandUUID)
+		return c.handleProfileList(respBytes)
+	case "DeclarativeManagement":
+		return c.handleDeclarativeManagement(respBytes)
+	case "DeviceConfigured":
+		return c.handleDeviceConfigured(reqType, commandUUID)
+	case "DeviceLock":
+		return c.handleDeviceLock(respBytes)
+	case "ClearPasscode":
+		return c.handleClearPasscode(respBytes)
+	case "EraseDevice":
+		return c.handleEraseDevice(respBytes)
+	case "InstallApplication", "InstallEnterpriseApplication":
+		return c.handleInstallApplication(respBytes)
+	case "ManagedApplicationList":
+		return c.handleManagedApplicationList(respBytes)
+	case "InstalledApplicationList":
+		return c.handleInstalledApplicationList(respBytes)
+	case "CertificateList":
+		return c.handleCertificateList(respBytes)
 	case "InstallProfile":
 		return c.handleInstallProfile(respBytes)
-	default:
-		fmt.Printf("MDM command not handled: %s UUID %s\n", reqType, commandUUID)
+	case "RemoveProfile":
+		return c.handleRemoveProfile(respBytes)
+	case "RefreshCellularPlans":
+		// nothing to refresh for a simulated device
 		return &ConnectRequest{
 			UDID:        c.Device.UDID,
 			CommandUUID: commandUUID,
+			Status:      "Acknowledged",
 			RequestType: reqType,
-			Status:      "Error",
-			ErrorChain: []ErrorChain{
-				{
-					ErrorCode:            12021,
-					ErrorDomain:          "MCMDMErrorDomain",
-					LocalizedDescription: fmt.Sprintf("Unknown command: %s <MDMClientError:91>", reqType),
-				},
-			},
 		}, nil
+	case "AvailableOSUpdates":
+		return c.handleAvailableOSUpdates(reqType, commandUUID)
+	case "OSUpdateStatus":
+		return c.handleOSUpdateStatus(reqType, commandUUID)
+	case "ScheduleOSUpdate":
+		return c.handleScheduleOSUpdate(respBytes)
+	case "Settings":
+		return c.handleSettings(respBytes)
+	case "LOMSetupRequest":
+		return c.handleLOMSetupRequest(reqType, commandUUID)
+	case "LOMDeviceRequest":
+		return c.handleLOMDeviceRequest(respBytes)
+	default:
+		level.Warn(c.Device.logger()).Log("msg", "MDM command not handled", "request_type", reqType, "command_uuid", commandUUID)
+		return c.errorResponse(reqType, commandUUID, 12021, "MCMDMErrorDomain", fmt.Sprintf("Unknown command: %s <MDMClientError:91>", reqType)), nil
+	}
+}
+
+// acknowledged creates an Acknowledged command response
+func (c *MDMClient) acknowledged(reqType, commandUUID string) *ConnectRequest {
+	return &ConnectRequest{
+		UDID:        c.Device.UDID,
+		CommandUUID: commandUUID,
+		Status:      "Acknowledged",
+		RequestType: reqType,
+	}
+}
+
+// commandFormatError creates a CommandFormatError command response for a
+// structurally invalid command
+func (c *MDMClient) commandFormatError(reqType, commandUUID string) *ConnectRequest {
+	return &ConnectRequest{
+		UDID:        c.Device.UDID,
+		CommandUUID: commandUUID,
+		Status:      "CommandFormatError",
+		RequestType: reqType,
+	}
+}
+
+// errorResponse creates an Error command response with a single error
+func (c *MDMClient) errorResponse(reqType, commandUUID string, code int, domain, desc string) *ConnectRequest {
+	return c.errorChainResponse(reqType, commandUUID, MDMErrorChain{}.Add(code, domain, desc))
+}
+
+// errorChainResponse creates an Error command response with chain
+func (c *MDMClient) errorChainResponse(reqType, commandUUID string, chain MDMErrorChain) *ConnectRequest {
+	return &ConnectRequest{
+		UDID:        c.Device.UDID,
+		CommandUUID: commandUUID,
+		RequestType: reqType,
+		Status:      "Error",
+		ErrorChain:  chain,
 	}
 }
 
@@ -55,7 +126,7 @@ type DeviceInfo struct {
 
 type DeviceInfoResponse struct {
 	ConnectRequest
-	QueryResponses map[string]string
+	QueryResponses map[string]interface{}
 }
 
 func (c *MDMClient) handleDeviceInfo(respBytes []byte) (interface{}, error) {
@@ -71,7 +142,7 @@ func (c *MDMClient) handleDeviceInfo(respBytes []byte) (interface{}, error) {
 			CommandUUID: cmd.CommandUUID,
 			RequestType: cmd.Command.RequestType,
 		},
-		QueryResponses: make(map[string]string),
+		QueryResponses: make(map[string]interface{}),
 	}
 	// TODO: check MDM enrollment permission bits in all of this?
 	queries := cmd.Command.Queries
@@ -88,27 +159,70 @@ func (c *MDMClient) handleDeviceInfo(respBytes []byte) (interface{}, error) {
 		case "DeviceName":
 			resp.QueryResponses[v] = c.Device.ComputerName
 		case "SerialNumber":
-			resp.QueryResponses[v] = c.Device.Serial
+			// not available to user enrollments
+			if c.Device.EnrollmentID == "" {
+				resp.QueryResponses[v] = c.Device.Serial
+			}
 		case "UDID":
-			resp.QueryResponses[v] = c.Device.UDID
+			if c.Device.EnrollmentID == "" {
+				resp.QueryResponses[v] = c.Device.UDID
+			}
+		case "EnrollmentID":
+			if c.Device.EnrollmentID != "" {
+				resp.QueryResponses[v] = c.Device.EnrollmentID
+			}
+		case "ProductName":
+			if c.Device.ProductName != "" {
+				resp.QueryResponses[v] = c.Device.ProductName
+			}
+		case "Model":
+			if model := c.Device.Model(); model != "" {
+				resp.QueryResponses[v] = model
+			}
+		case "ModelName":
+			if modelName := c.Device.ModelName(); modelName != "" {
+				resp.QueryResponses[v] = modelName
+			}
+		case "OSVersion":
+			if c.Device.OSVersion != "" {
+				resp.QueryResponses[v] = c.Device.OSVersion
+			}
+		case "BuildVersion":
+			if c.Device.BuildVersion != "" {
+				resp.QueryResponses[v] = c.Device.BuildVersion
+			}
+		case "IsMultiUser":
+			resp.QueryResponses[v] = false
+		case "IMEI":
+			resp.QueryResponses[v] = c.Device.IMEI()
+		case "MEID":
+			resp.QueryResponses[v] = c.Device.MEID()
+		case "ICCID":
+			resp.QueryResponses[v] = c.Device.ICCID()
+		case "CarrierSettingsVersion":
+			resp.QueryResponses[v] = cellCarrierSettingsVersion
+		case "CurrentCarrierNetwork":
+			resp.QueryResponses[v] = cellCurrentCarrierNetwork
 		default:
 			unknownQueries = append(unknownQueries, v)
 		}
 	}
-	fmt.Printf("unknown DeviceInfo queries: %s\n", strings.Join(unknownQueries, ", "))
+	if len(unknownQueries) > 0 {
+		level.Info(c.Device.logger()).Log("msg", "unknown DeviceInformation queries", "queries", strings.Join(unknownQueries, ","))
+	}
 	return resp, nil
 }
 
-// type ProfileListCommand struct {
-// 	ConnectResponseCommand
-// 	ManagedOnly                  bool `plist:",omitempty"`
-// 	RequestRequiresNetworkTether bool `plist:",omitempty"`
-// }
+type ProfileListCommand struct {
+	ConnectResponseCommand
+	ManagedOnly                  bool `plist:",omitempty"`
+	RequestRequiresNetworkTether bool `plist:",omitempty"`
+}
 
-// type ProfileList struct {
-// 	Command     ProfileListCommand
-// 	CommandUUID string
-// }
+type ProfileList struct {
+	Command     ProfileListCommand
+	CommandUUID string
+}
 
 type ProfileListResponse struct {
 	ConnectRequest
@@ -122,50 +236,136 @@ type profileListProfile struct {
 
 // Reassembles profile payloads with only the generic "common" payload and wraps in profile wrapper struct
 func profileForProfileList(p *cfgprofiles.Profile) *profileListProfile {
-	genericPayloads := []*cfgprofiles.Payload{}
-	for _, v := range p.PayloadContent {
-		genericPayloads = append(genericPayloads, cfgprofiles.CommonPayload(v.Payload))
-		fmt.Println(genericPayloads)
-	}
 	newProfile := &profileListProfile{
 		Profile: *p,
 	}
 	newProfile.Profile.PayloadContent = nil
-	for _, v := range genericPayloads {
-		newProfile.Profile.AddPayload(v)
+	for _, v := range p.PayloadContent {
+		newProfile.Profile.AddPayload(cfgprofiles.CommonPayload(v.Payload))
 	}
 	return newProfile
 }
 
-func (c *MDMClient) handleProfileList(reqType, commandUUID string) (interface{}, error) {
-	// since we don't handle any of the custom command members just
-	// ignore it for now
-	//
-	// cmd := &ProfileList{}
-	// err := plist.Unmarshal(respBytes, cmd)
-	// if err != nil {
-	// 	return nil, err
-	// }
+func (c *MDMClient) handleProfileList(respBytes []byte) (interface{}, error) {
+	cmd := &ProfileList{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
 	resp := &ProfileListResponse{
 		ConnectRequest: ConnectRequest{
 			UDID:        c.Device.UDID,
 			Status:      "Acknowledged",
-			CommandUUID: commandUUID,
-			RequestType: reqType,
+			CommandUUID: cmd.CommandUUID,
+			RequestType: cmd.Command.RequestType,
 		},
+		ProfileList: []*profileListProfile{},
+	}
+	ps := c.Device.SystemProfileStore()
+	var managed map[string]bool
+	if cmd.Command.ManagedOnly {
+		managed, err = ps.ManagedIDs()
+		if err != nil {
+			return nil, err
+		}
 	}
-	uuids, err := c.Device.SystemProfileStore().ListUUIDs()
+	// read all profiles in one transaction, reducing each to its
+	// common payloads as we go rather than holding every full profile
+	err = ps.ForEach(func(id string, p *cfgprofiles.Profile) error {
+		if cmd.Command.ManagedOnly && !managed[id] {
+			return nil
+		}
+		resp.ProfileList = append(resp.ProfileList, profileForProfileList(p))
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	for _, uuid := range uuids {
-		// fmt.Println(uuid)
-		p, err := c.Device.SystemProfileStore().Load(uuid)
+	return resp, nil
+}
+
+type CertificateListCommand struct {
+	ConnectResponseCommand
+	ManagedOnly bool `plist:",omitempty"`
+}
+
+type CertificateList struct {
+	Command     CertificateListCommand
+	CommandUUID string
+}
+
+type CertificateListItem struct {
+	CommonName string
+	Data       []byte
+	IsIdentity bool
+}
+
+type CertificateListResponse struct {
+	ConnectRequest
+	CertificateList []CertificateListItem
+}
+
+func (c *MDMClient) handleCertificateList(respBytes []byte) (interface{}, error) {
+	cmd := &CertificateList{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	kc := c.Device.SystemKeychain()
+	identities, err := LoadKeychainItems(kc, ClassIdentity)
+	if err != nil {
+		return nil, err
+	}
+	// identityCerts are referenced by any identity, managedCerts only by
+	// identities or certificate payloads of managed profiles
+	identityCerts := make(map[string]bool)
+	managedCerts := make(map[string]bool)
+	managedIdentities := make(map[string]bool)
+	if cmd.Command.ManagedOnly {
+		ps := c.Device.SystemProfileStore()
+		ids, err := ps.managedPayloadRefStrings("keychain_identity")
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			managedIdentities[id] = true
+		}
+		certIDs, err := ps.managedPayloadRefStrings("keychain_certificate")
 		if err != nil {
-			fmt.Printf("error loading profile: %s\n", err)
+			return nil, err
+		}
+		for _, id := range certIDs {
+			managedCerts[id] = true
 		}
-		newProfile := profileForProfileList(p)
-		resp.ProfileList = append(resp.ProfileList, newProfile)
+	}
+	for _, kci := range identities {
+		identityCerts[kci.IdentityCertificateUUID] = true
+		if managedIdentities[kci.UUID] {
+			managedCerts[kci.IdentityCertificateUUID] = true
+		}
+	}
+	certs, err := LoadKeychainItems(kc, ClassCertificate)
+	if err != nil {
+		return nil, err
+	}
+	resp := &CertificateListResponse{
+		ConnectRequest: ConnectRequest{
+			UDID:        c.Device.UDID,
+			Status:      "Acknowledged",
+			CommandUUID: cmd.CommandUUID,
+			RequestType: cmd.Command.RequestType,
+		},
+		CertificateList: []CertificateListItem{},
+	}
+	for _, kci := range certs {
+		if cmd.Command.ManagedOnly && !managedCerts[kci.UUID] {
+			continue
+		}
+		resp.CertificateList = append(resp.CertificateList, CertificateListItem{
+			CommonName: kci.Certificate.Subject.CommonName,
+			Data:       kci.Certificate.Raw,
+			IsIdentity: identityCerts[kci.UUID],
+		})
 	}
 	return resp, nil
 }
@@ -181,28 +381,55 @@ type InstallProfile struct {
 	CommandUUID string
 }
 
-type InstallProfileResponse struct {
-	ConnectRequest
-	RequestType string
-}
-
 func (c *MDMClient) handleInstallProfile(respBytes []byte) (interface{}, error) {
 	cmd := &InstallProfile{}
 	err := plist.Unmarshal(respBytes, cmd)
 	if err != nil {
 		return nil, err
 	}
+	// Payload is the base64-decoded profile exactly as sent by the server
 	err = c.Device.installProfileFromMDM(cmd.Command.Payload)
+	if err != nil {
+		level.Warn(c.Device.logger()).Log("msg", "InstallProfile failed", "command_uuid", cmd.CommandUUID, "err", err)
+		chain := MDMErrorChain{}.Add(4001, "MCInstallationErrorDomain", "Profile Installation Failed").AddError(err)
+		return c.errorChainResponse(cmd.Command.RequestType, cmd.CommandUUID, chain), nil
+	}
+	return &ConnectRequest{
+		UDID:        c.Device.UDID,
+		Status:      "Acknowledged",
+		CommandUUID: cmd.CommandUUID,
+		RequestType: cmd.Command.RequestType,
+	}, nil
+}
+
+type RemoveProfileCommand struct {
+	ConnectResponseCommand
+	Identifier string
+}
+
+type RemoveProfile struct {
+	Command     RemoveProfileCommand
+	CommandUUID string
+}
+
+func (c *MDMClient) handleRemoveProfile(respBytes []byte) (interface{}, error) {
+	cmd := &RemoveProfile{}
+	err := plist.Unmarshal(respBytes, cmd)
 	if err != nil {
 		return nil, err
 	}
-	resp := &InstallProfileResponse{
-		ConnectRequest: ConnectRequest{
-			UDID:        c.Device.UDID,
-			Status:      "Acknowledged",
-			CommandUUID: cmd.CommandUUID,
-			RequestType: cmd.Command.RequestType,
-		},
+	// removing the MDM profile unenrolls the device (and ends the
+	// Connect session)
+	err = c.Device.RemoveProfile(cmd.Command.Identifier)
+	if err != nil {
+		level.Warn(c.Device.logger()).Log("msg", "RemoveProfile failed", "command_uuid", cmd.CommandUUID, "profile", cmd.Command.Identifier, "err", err)
+		chain := MDMErrorChain{}.Add(1001, "MCProfileErrorDomain", "Profile Removal Failed").AddError(err)
+		return c.errorChainResponse(cmd.Command.RequestType, cmd.CommandUUID, chain), nil
 	}
-	return resp, nil
+	return &ConnectRequest{
+		UDID:        c.Device.UDID,
+		Status:      "Acknowledged",
+		CommandUUID: cmd.CommandUUID,
+		RequestType: cmd.Command.RequestType,
+	}, nil
 }
@@ -0,0 +1,278 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// Declarative management (DDM) is spoken over the check-in endpoint using
+// DeclarativeManagement messages. Only activation and configuration
+// declarations are synchronized. Configurations aren't applied in any way
+// beyond being stored and reported as active.
+
+type DeclarativeManagementRequest struct {
+	Data         []byte `plist:",omitempty"`
+	Endpoint     string
+	EnrollmentID string `plist:",omitempty"`
+	MessageType  string
+	UDID         string `plist:",omitempty"`
+}
+
+type ddmSyncTokens struct {
+	SyncTokens struct {
+		DeclarationsToken string
+		Timestamp         string
+	}
+}
+
+type ddmManifestItem struct {
+	Identifier  string
+	ServerToken string
+}
+
+type ddmDeclarationItems struct {
+	Declarations struct {
+		Activations    []ddmManifestItem
+		Assets         []ddmManifestItem
+		Configurations []ddmManifestItem
+		Management     []ddmManifestItem
+	}
+	DeclarationsToken string
+}
+
+type ddmDeclaration struct {
+	Type        string
+	Identifier  string
+	ServerToken string
+	Payload     json.RawMessage
+}
+
+type ddmActivationPayload struct {
+	StandardConfigurations []string
+}
+
+type ddmDeclarationStatus struct {
+	Active      bool   `json:"active"`
+	Identifier  string `json:"identifier"`
+	Valid       string `json:"valid"`
+	ServerToken string `json:"server-token"`
+}
+
+type ddmStatusReport struct {
+	StatusItems struct {
+		Management struct {
+			Declarations struct {
+				Activations    []ddmDeclarationStatus `json:"activations"`
+				Configurations []ddmDeclarationStatus `json:"configurations"`
+				Assets         []ddmDeclarationStatus `json:"assets"`
+				Management     []ddmDeclarationStatus `json:"management"`
+			} `json:"declarations"`
+		} `json:"management"`
+	}
+	Errors []interface{}
+}
+
+// declarativeManagement sends a DeclarativeManagement check-in message to
+// endpoint and decodes the JSON response body into v (if not nil)
+func (c *MDMClient) declarativeManagement(endpoint string, data []byte, v interface{}) error {
+	dmr := &DeclarativeManagementRequest{
+		Data:        data,
+		Endpoint:    endpoint,
+		MessageType: "DeclarativeManagement",
+		UDID:        c.Device.UDID,
+	}
+	if c.Device.EnrollmentID != "" {
+		dmr.UDID = ""
+		dmr.EnrollmentID = c.Device.EnrollmentID
+	}
+	body, err := c.checkinRequestBody(dmr)
+	if err != nil {
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+	err = json.Unmarshal(body, v)
+	if err != nil {
+		return fmt.Errorf("decoding DDM %s response: %w", endpoint, err)
+	}
+	return nil
+}
+
+func (device *Device) ddmDeclarationsToken() (token string, err error) {
+	err = device.store.View(func(tx Tx) error {
+		token = BucketGetString(tx, "ddm_declarations_token", device.UDID)
+		return nil
+	})
+	return
+}
+
+// saveDDMDeclarations replaces the stored declarations
+func (device *Device) saveDDMDeclarations(token string, decls []*ddmDeclaration) error {
+	return device.store.Update(func(tx Tx) error {
+		err := BucketDeleteWithPrefix(tx, "ddm_declarations", device.UDID+"_")
+		if err != nil {
+			return err
+		}
+		for _, d := range decls {
+			declJSON, err := json.Marshal(d)
+			if err != nil {
+				return err
+			}
+			err = BucketPutOrDelete(tx, "ddm_declarations", device.UDID+"_"+d.Identifier, declJSON)
+			if err != nil {
+				return err
+			}
+		}
+		return BucketPutOrDeleteString(tx, "ddm_declarations_token", device.UDID, token)
+	})
+}
+
+// purgeDDM deletes all stored declarations
+func (device *Device) purgeDDM() error {
+	return device.store.Update(func(tx Tx) error {
+		err := BucketDeleteWithPrefix(tx, "ddm_declarations", device.UDID+"_")
+		if err != nil {
+			return err
+		}
+		return BucketPutOrDeleteString(tx, "ddm_declarations_token", device.UDID, "")
+	})
+}
+
+// fetchDDMDeclarations fetches each declaration in items of kind
+// ("activation" or "configuration")
+func (c *MDMClient) fetchDDMDeclarations(kind string, items []ddmManifestItem) ([]*ddmDeclaration, error) {
+	var decls []*ddmDeclaration
+	for _, item := range items {
+		d := &ddmDeclaration{}
+		err := c.declarativeManagement("declaration/"+kind+"/"+item.Identifier, nil, d)
+		if err != nil {
+			return nil, err
+		}
+		decls = append(decls, d)
+	}
+	return decls, nil
+}
+
+// syncDeclarativeManagement fetches any changed declarations and sends a
+// status report of them
+func (c *MDMClient) syncDeclarativeManagement() error {
+	tokens := &ddmSyncTokens{}
+	err := c.declarativeManagement("tokens", nil, tokens)
+	if err != nil {
+		return err
+	}
+	current, err := c.Device.ddmDeclarationsToken()
+	if err != nil {
+		return err
+	}
+	if tokens.SyncTokens.DeclarationsToken != "" && tokens.SyncTokens.DeclarationsToken == current {
+		// nothing changed
+		return nil
+	}
+
+	items := &ddmDeclarationItems{}
+	err = c.declarativeManagement("declaration-items", nil, items)
+	if err != nil {
+		return err
+	}
+	activations, err := c.fetchDDMDeclarations("activation", items.Declarations.Activations)
+	if err != nil {
+		return err
+	}
+	configurations, err := c.fetchDDMDeclarations("configuration", items.Declarations.Configurations)
+	if err != nil {
+		return err
+	}
+	err = c.Device.saveDDMDeclarations(items.DeclarationsToken, append(activations, configurations...))
+	if err != nil {
+		return err
+	}
+
+	statusJSON, err := json.Marshal(ddmStatus(activations, configurations))
+	if err != nil {
+		return err
+	}
+	return c.declarativeManagement("status", statusJSON, nil)
+}
+
+// ddmStatus reports activations as active when all their configurations
+// were received, and configurations as active when an active activation
+// references them
+func ddmStatus(activations, configurations []*ddmDeclaration) *ddmStatusReport {
+	report := &ddmStatusReport{Errors: []interface{}{}}
+	decls := &report.StatusItems.Management.Declarations
+	decls.Activations = []ddmDeclarationStatus{}
+	decls.Configurations = []ddmDeclarationStatus{}
+	decls.Assets = []ddmDeclarationStatus{}
+	decls.Management = []ddmDeclarationStatus{}
+
+	received := make(map[string]bool)
+	for _, d := range configurations {
+		received[d.Identifier] = true
+	}
+
+	activated := make(map[string]bool)
+	for _, d := range activations {
+		status := ddmDeclarationStatus{Identifier: d.Identifier, ServerToken: d.ServerToken, Valid: "valid"}
+		payload := &ddmActivationPayload{}
+		if err := json.Unmarshal(d.Payload, payload); err != nil {
+			status.Valid = "invalid"
+		} else {
+			status.Active = true
+			for _, id := range payload.StandardConfigurations {
+				if !received[id] {
+					status.Active = false
+				}
+			}
+			if status.Active {
+				for _, id := range payload.StandardConfigurations {
+					activated[id] = true
+				}
+			}
+		}
+		decls.Activations = append(decls.Activations, status)
+	}
+
+	for _, d := range configurations {
+		decls.Configurations = append(decls.Configurations, ddmDeclarationStatus{
+			Active:      activated[d.Identifier],
+			Identifier:  d.Identifier,
+			Valid:       "valid",
+			ServerToken: d.ServerToken,
+		})
+	}
+	return report
+}
+
+type DeclarativeManagementCommand struct {
+	ConnectResponseCommand
+	Data []byte `plist:",omitempty"`
+}
+
+type DeclarativeManagement struct {
+	Command     DeclarativeManagementCommand
+	CommandUUID string
+}
+
+func (c *MDMClient) handleDeclarativeManagement(respBytes []byte) (interface{}, error) {
+	cmd := &DeclarativeManagement{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if c.MDMPayload == nil {
+		return nil, errors.New("no MDM payload")
+	}
+	err = c.syncDeclarativeManagement()
+	if err != nil {
+		level.Warn(c.Device.logger()).Log("msg", "DeclarativeManagement sync failed", "command_uuid", cmd.CommandUUID, "err", err)
+		chain := MDMErrorChain{}.Add(12000, "MCMDMErrorDomain", "Declarative management synchronization failed").AddError(err)
+		return c.errorChainResponse(cmd.Command.RequestType, cmd.CommandUUID, chain), nil
+	}
+	return c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID), nil
+}
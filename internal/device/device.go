@@ -1,11 +1,16 @@
 package device
 
 import (
+	crand "crypto/rand"
+	"fmt"
+	"io"
 	"math/rand"
+	"net"
 	"strings"
+	"time"
 
+	"github.com/go-kit/kit/log"
 	"github.com/google/uuid"
-	bolt "go.etcd.io/bbolt"
 )
 
 // Device represents a pseudo Apple device for MDM interactions
@@ -13,11 +18,78 @@ type Device struct {
 	UDID         string
 	Serial       string
 	ComputerName string
+	// Platform is one of the Platform constants
+	Platform     string
+	ProductName  string
+	OSVersion    string
+	BuildVersion string
+
+	HostName      string
+	LocalHostName string
+	MACAddress    string
+
+	// PushToken and PushMagic are the (fake) APNs values reported in
+	// TokenUpdate
+	PushToken []byte
+	PushMagic string
+	// AdditionalPushTokens maps the hex encoded push tokens reported in
+	// TokenUpdate with additional text to their push magic
+	AdditionalPushTokens map[string]string
+
+	// UnlockToken is reported in TokenUpdate by iOS and iPadOS devices and
+	// must match in ClearPasscode commands
+	UnlockToken []byte
+
+	// BootstrapToken is escrowed with the MDM server (macOS only)
+	BootstrapToken []byte
 
 	MDMIdentityKeychainUUID string
 	MDMProfileIdentifier    string
+	// EnrollmentID identifies a user enrollment in place of the UDID and
+	// EnrollmentUserID the enrolled user
+	EnrollmentID     string
+	EnrollmentUserID string
+
+	LOMMACAddress      string
+	LOMIPv6Address     string
+	LOMSecret          string
+	LOMLastRequestType string
+
+	// Erased is set by EraseDevice. An erased device no longer connects.
+	Erased bool
+	// Locked and LockPIN are set by DeviceLock and cleared by ClearPasscode
+	Locked  bool
+	LockPIN string
+
+	// LastCommandUUID is the last command received from the MDM server.
+	// PendingReport is the Connect report with a command's result until
+	// the server has received it. The next Connect session re-sends it
+	// (instead of reporting Idle) if a session was interrupted.
+	LastCommandUUID string
+	PendingReport   []byte
+	// NotNowCounts are the NotNow responses so far by CommandUUID of
+	// commands deferred by the NotNow policy
+	NotNowCounts map[string]int
+
+	// AwaitingConfiguration is set during ADE enrollment until the MDM
+	// server sends DeviceConfigured
+	AwaitingConfiguration bool
+
+	// Apps is the simulated app inventory
+	Apps []App
+	// OSUpdates are the simulated OS updates available to the device
+	OSUpdates []OSUpdate
+	// Settings are the items last applied by Settings commands
+	Settings map[string]SettingsItem
+
+	// SkipValidate disables the Validate self-check before each Connect
+	SkipValidate bool
 
-	boltDB *bolt.DB
+	// Logger receives the device's structured (leveled) log events. Nil
+	// discards them.
+	Logger log.Logger
+
+	store Store
 
 	sysKeychain     *Keychain
 	sysProfileStore *ProfileStore
@@ -25,26 +97,282 @@ type Device struct {
 }
 
 // New creates a new device with a random serial number and UDID
-func New(name string, db *bolt.DB) *Device {
+func New(name string, db Store) (*Device, error) {
 	device := &Device{
 		ComputerName: name,
 		Serial:       randSerial(),
 		UDID:         strings.ToUpper(uuid.NewString()),
-		boltDB:       db,
+		store:        db,
 	}
 	if name == "" {
 		device.ComputerName = device.Serial + "'s Computer"
 	}
-	return device
+	device.setNetworkNames(rand.Intn)
+	if err := device.setPushCredentials(crand.Reader); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
+
+// logger returns the device's logger with its UDID
+func (device *Device) logger() log.Logger {
+	if device.Logger == nil {
+		return log.NewNopLogger()
+	}
+	return log.With(device.Logger, "udid", device.UDID)
+}
+
+// setPushCredentials generates a 32 byte push token and a push magic UUID
+func (device *Device) setPushCredentials(r io.Reader) error {
+	token := make([]byte, 32)
+	if _, err := io.ReadFull(r, token); err != nil {
+		return err
+	}
+	magic, err := uuid.NewRandomFromReader(r)
+	if err != nil {
+		return err
+	}
+	device.PushToken = token
+	device.PushMagic = strings.ToUpper(magic.String())
+	return nil
+}
+
+// an Apple OUI for generated MAC addresses
+var macOUI = []byte{0xa4, 0x83, 0xe7}
+
+// setNetworkNames fills host names from the computer name and generates
+// a MAC address
+func (device *Device) setNetworkNames(intn func(int) int) {
+	var b strings.Builder
+	for _, r := range device.ComputerName {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == ' ' || r == '-':
+			b.WriteByte('-')
+		}
+	}
+	device.LocalHostName = b.String()
+	device.HostName = device.LocalHostName + ".local"
+	mac := append([]byte{}, macOUI...)
+	for i := 0; i < 3; i++ {
+		mac = append(mac, byte(intn(256)))
+	}
+	device.MACAddress = net.HardwareAddr(mac).String()
 }
 
 // numbers plus capital letters without I, L, O for readability
 const serialLetters = "0123456789ABCDEFGHJKMNPQRSTUVWXYZ"
 
 func randSerial() string {
+	return randSerialFrom(rand.Intn)
+}
+
+func randSerialFrom(intn func(int) int) string {
 	b := make([]byte, 12)
 	for i := range b {
-		b[i] = serialLetters[rand.Intn(len(serialLetters))]
+		b[i] = serialLetters[intn(len(serialLetters))]
 	}
 	return string(b)
 }
+
+// Device platforms
+const (
+	PlatformIOS   = "ios"
+	PlatformMacOS = "macos"
+	PlatformTVOS  = "tvos"
+)
+
+// Platforms are the supported device platforms
+var Platforms = []string{PlatformIOS, PlatformMacOS, PlatformTVOS}
+
+type productVersion struct {
+	Platform    string
+	ProductName string
+	// Model is reported as the Authenticate Model: the model family on
+	// iOS and tvOS but the ProductName on macOS
+	Model        string
+	Kind         string
+	OSVersion    string
+	BuildVersion string
+}
+
+// plausible, coherent product and OS version combinations
+var productVersions = []productVersion{
+	{PlatformIOS, "iPhone14,2", "iPhone", "iPhone", "16.3.1", "20D67"},
+	{PlatformIOS, "iPhone14,5", "iPhone", "iPhone", "16.6", "20G75"},
+	{PlatformIOS, "iPhone15,2", "iPhone", "iPhone", "17.1", "21B74"},
+	{PlatformIOS, "iPad13,4", "iPad", "iPad", "16.6", "20G75"},
+	{PlatformIOS, "iPad14,1", "iPad", "iPad", "17.1", "21B74"},
+	{PlatformMacOS, "Mac14,2", "Mac14,2", "MacBook Air", "13.4", "22F66"},
+	{PlatformMacOS, "MacBookPro18,3", "MacBookPro18,3", "MacBook Pro", "12.6", "21G115"},
+	{PlatformMacOS, "Macmini9,1", "Macmini9,1", "Mac mini", "14.1", "23B74"},
+	{PlatformTVOS, "AppleTV6,2", "AppleTV", "Apple TV", "16.6", "20M73"},
+	{PlatformTVOS, "AppleTV11,1", "AppleTV", "Apple TV", "17.1", "21K69"},
+}
+
+// lookupProductVersion finds the product for productName or returns nil
+func lookupProductVersion(productName string) *productVersion {
+	for i := range productVersions {
+		if productVersions[i].ProductName == productName {
+			return &productVersions[i]
+		}
+	}
+	return nil
+}
+
+// platformForProductName guesses the platform of products not in
+// productVersions by their ProductName prefix
+func platformForProductName(productName string) string {
+	if pv := lookupProductVersion(productName); pv != nil {
+		return pv.Platform
+	}
+	switch {
+	case strings.HasPrefix(productName, "Mac"), strings.HasPrefix(productName, "iMac"):
+		return PlatformMacOS
+	case strings.HasPrefix(productName, "AppleTV"):
+		return PlatformTVOS
+	case productName != "":
+		return PlatformIOS
+	}
+	return ""
+}
+
+// ValidPlatform reports whether platform is one of Platforms
+func ValidPlatform(platform string) bool {
+	for _, p := range Platforms {
+		if p == platform {
+			return true
+		}
+	}
+	return false
+}
+
+// ModelName returns the marketing model name (e.g. "iPhone") for the
+// device's ProductName or "" if it's unknown
+func (device *Device) ModelName() string {
+	if pv := lookupProductVersion(device.ProductName); pv != nil {
+		return pv.Kind
+	}
+	return ""
+}
+
+// Model returns the Authenticate and DeviceInformation Model for the
+// device's ProductName, which is the ProductName itself if it's unknown
+func (device *Device) Model() string {
+	if pv := lookupProductVersion(device.ProductName); pv != nil {
+		return pv.Model
+	}
+	return device.ProductName
+}
+
+// isMac reports whether the device is a Mac
+func (device *Device) isMac() bool {
+	return device.Platform == PlatformMacOS
+}
+
+var computerNameOwners = []string{
+	"Alex", "Sam", "Jordan", "Taylor", "Morgan", "Casey", "Riley", "Jamie",
+	"Avery", "Quinn", "Robin", "Drew", "Charlie", "Skyler", "Reese", "Parker",
+}
+
+// DeviceGenerator creates devices with random but plausible identities.
+// Serial numbers are unique among the devices a generator creates. It is
+// not safe for concurrent use.
+type DeviceGenerator struct {
+	rand     *rand.Rand
+	serials  map[string]bool
+	products []productVersion
+}
+
+// NewDeviceGenerator creates a generator. A seed of 0 seeds from the
+// current time. Any other seed generates a reproducible set of devices.
+func NewDeviceGenerator(seed int64) *DeviceGenerator {
+	if seed == 0 {
+		seed = time.Now().UnixNano()
+	}
+	return &DeviceGenerator{
+		rand:    rand.New(rand.NewSource(seed)),
+		serials: make(map[string]bool),
+	}
+}
+
+// SetPlatform limits the devices the generator creates to platform. An
+// empty platform creates devices of any platform.
+func (g *DeviceGenerator) SetPlatform(platform string) error {
+	if platform == "" {
+		g.products = nil
+		return nil
+	}
+	if !ValidPlatform(platform) {
+		return fmt.Errorf("unknown platform %q: must be one of %s", platform, strings.Join(Platforms, ", "))
+	}
+	g.products = nil
+	for _, pv := range productVersions {
+		if pv.Platform == platform {
+			g.products = append(g.products, pv)
+		}
+	}
+	return nil
+}
+
+// NewRandomDevice creates a new device with a random v4 UDID, serial
+// number, computer name, and product and OS version
+func (g *DeviceGenerator) NewRandomDevice(db Store) (*Device, error) {
+	products := g.products
+	if len(products) == 0 {
+		products = productVersions
+	}
+	return g.newDevice(db, products[g.rand.Intn(len(products))])
+}
+
+// Clone creates a new device with the same product and OS version and app
+// inventory as template but its own random UDID, serial number, computer
+// name, and push credentials. The clone isn't enrolled.
+func (g *DeviceGenerator) Clone(template *Device) (*Device, error) {
+	pv := productVersion{
+		Platform:     template.Platform,
+		ProductName:  template.ProductName,
+		Model:        template.Model(),
+		Kind:         template.ModelName(),
+		OSVersion:    template.OSVersion,
+		BuildVersion: template.BuildVersion,
+	}
+	if pv.Kind == "" {
+		pv.Kind = "Device"
+	}
+	device, err := g.newDevice(template.store, pv)
+	if err != nil {
+		return nil, err
+	}
+	device.Apps = append([]App(nil), template.Apps...)
+	device.OSUpdates = append([]OSUpdate(nil), template.OSUpdates...)
+	return device, nil
+}
+
+func (g *DeviceGenerator) newDevice(db Store, pv productVersion) (*Device, error) {
+	serial := randSerialFrom(g.rand.Intn)
+	for g.serials[serial] {
+		serial = randSerialFrom(g.rand.Intn)
+	}
+	g.serials[serial] = true
+
+	// uuid.NewRandomFromReader only errors if the reader does
+	udid, _ := uuid.NewRandomFromReader(g.rand)
+	owner := computerNameOwners[g.rand.Intn(len(computerNameOwners))]
+	device := &Device{
+		UDID:         strings.ToUpper(udid.String()),
+		Serial:       serial,
+		ComputerName: owner + "'s " + pv.Kind,
+		Platform:     pv.Platform,
+		ProductName:  pv.ProductName,
+		OSVersion:    pv.OSVersion,
+		BuildVersion: pv.BuildVersion,
+		store:        db,
+	}
+	device.setNetworkNames(g.rand.Intn)
+	if err := device.setPushCredentials(g.rand); err != nil {
+		return nil, err
+	}
+	return device, nil
+}
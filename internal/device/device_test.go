@@ -0,0 +1,31 @@
+package device
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDeviceGeneratorSeeded(t *testing.T) {
+	batch := func() []*Device {
+		gen := NewDeviceGenerator(42)
+		var devices []*Device
+		for i := 0; i < 3; i++ {
+			device, err := gen.NewRandomDevice(NewMemoryStore())
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices = append(devices, device)
+		}
+		return devices
+	}
+	first, second := batch(), batch()
+	for i := range first {
+		a, b := first[i], second[i]
+		if a.UDID != b.UDID || a.Serial != b.Serial || a.ComputerName != b.ComputerName || a.MACAddress != b.MACAddress {
+			t.Errorf("device %d: have %s %s, want %s %s", i, b.UDID, b.Serial, a.UDID, a.Serial)
+		}
+		if len(a.PushToken) == 0 || !bytes.Equal(a.PushToken, b.PushToken) || a.PushMagic != b.PushMagic {
+			t.Errorf("device %d: have push token %x magic %s, want %x %s", i, b.PushToken, b.PushMagic, a.PushToken, a.PushMagic)
+		}
+	}
+}
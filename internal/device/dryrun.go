@@ -0,0 +1,128 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// DryRunPayload describes how a payload of a profile would be installed
+type DryRunPayload struct {
+	PayloadType string
+	PayloadUUID string
+	// Skipped is set if InstallOptions exclude the payload
+	Skipped bool
+	// CSR is the certificate request a SCEP payload would send
+	CSR *x509.CertificateRequest
+	// Identity is the certificate a PKCS#12 payload would install
+	Identity *x509.Certificate
+}
+
+// DryRunProfileInstall processes a profile as InstallProfileWithOptions
+// would, in installation order, but without contacting SCEP or MDM servers
+// and without changing the device. SCEP payloads generate their key and
+// CSR (with SCEP variables substituted), PKCS#12 payloads are decoded, and
+// MDM payloads must reference an identity payload installed before them.
+func (device *Device) DryRunProfileInstall(pb []byte, opts *InstallOptions) ([]DryRunPayload, error) {
+	if len(pb) == 0 {
+		return nil, errors.New("empty profile")
+	}
+	pb, err := unwrapSignedProfile(pb, opts.profileSignerRoots())
+	if err != nil {
+		return nil, err
+	}
+	p := &cfgprofiles.Profile{}
+	err = plist.Unmarshal(pb, p)
+	if err != nil {
+		return nil, err
+	}
+	err = device.ValidateProfileInstall(p, false)
+	if err != nil {
+		return nil, err
+	}
+
+	orderedPayloads := classifyAndSortProfilePayloads(p, false)
+
+	scepSANs, err := scepSubjectAltNames(pb)
+	if err != nil {
+		return nil, err
+	}
+	pkcs12s, err := pkcs12PayloadContents(pb)
+	if err != nil {
+		return nil, err
+	}
+
+	var results []DryRunPayload
+	// identity payload UUIDs processed so far
+	identities := make(map[string]bool)
+	for _, pr := range orderedPayloads {
+		if pr.CommonPayload == nil {
+			continue
+		}
+		result := DryRunPayload{
+			PayloadType: pr.CommonPayload.PayloadType,
+			PayloadUUID: pr.CommonPayload.PayloadUUID,
+		}
+		if opts.skipPayload(pr.CommonPayload) {
+			result.Skipped = true
+			results = append(results, result)
+			continue
+		}
+		switch pl := pr.Payload.(type) {
+		case *cfgprofiles.SCEPPayload:
+			applySCEPEnvOverrides(pl)
+			if _, err := fingerprintHash(pl.PayloadContent.CAFingerprint); err != nil {
+				return results, fmt.Errorf("SCEP payload %s: %w", pl.PayloadUUID, err)
+			}
+			// a challenge URL isn't fetched as that would use up a
+			// one-time challenge
+			if err := device.resolveSCEPChallenge(pl, ""); err != nil {
+				return results, fmt.Errorf("SCEP payload %s: %w", pl.PayloadUUID, err)
+			}
+			key, err := keyFromSCEPProfilePayload(pl, rand.Reader)
+			if err != nil {
+				return results, fmt.Errorf("SCEP payload %s: %w", pl.PayloadUUID, err)
+			}
+			csrBytes, err := csrFromSCEPProfilePayload(pl, scepSANs[pl.PayloadUUID], device, rand.Reader, key)
+			if err != nil {
+				return results, fmt.Errorf("SCEP payload %s: %w", pl.PayloadUUID, err)
+			}
+			result.CSR, err = x509.ParseCertificateRequest(csrBytes)
+			if err != nil {
+				return results, fmt.Errorf("SCEP payload %s: %w", pl.PayloadUUID, err)
+			}
+			identities[pl.PayloadUUID] = true
+		case *cfgprofiles.CertificatePKCS1Payload:
+			if _, err := certificateFromPayload(pl); err != nil {
+				return results, err
+			}
+		case *cfgprofiles.MDMPayload:
+			applyMDMEnvOverrides(pl)
+			if err := validateMDMPayloadURLs(pl); err != nil {
+				return results, err
+			}
+			if !identities[pl.IdentityCertificateUUID] {
+				return results, fmt.Errorf("MDM payload %s: identity payload UUID %s not installed before it", pl.PayloadUUID, pl.IdentityCertificateUUID)
+			}
+		case *cfgprofiles.Payload:
+			if pl.PayloadType != pkcs12PayloadType {
+				break
+			}
+			content := pkcs12s[pl.PayloadUUID]
+			if content == nil || len(content.PayloadContent) == 0 {
+				return results, fmt.Errorf("PKCS#12 payload %s has no content", pl.PayloadUUID)
+			}
+			_, result.Identity, err = decodePKCS12Identity(content.PayloadContent, content.Password)
+			if err != nil {
+				return results, fmt.Errorf("PKCS#12 payload %s: %w", pl.PayloadUUID, err)
+			}
+			identities[pl.PayloadUUID] = true
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
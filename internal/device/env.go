@@ -0,0 +1,34 @@
+package device
+
+import (
+	"os"
+
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// Environment variables which, when set, take precedence over the
+// corresponding values in installed profiles
+const (
+	EnvSCEPChallenge = "MDMB_SCEP_CHALLENGE"
+	EnvSCEPURL       = "MDMB_SCEP_URL"
+	EnvMDMCheckInURL = "MDMB_MDM_CHECKIN_URL"
+	EnvMDMConnectURL = "MDMB_MDM_CONNECT_URL"
+)
+
+func overrideFromEnv(s *string, key string) {
+	if v := os.Getenv(key); v != "" {
+		*s = v
+	}
+}
+
+// applySCEPEnvOverrides replaces SCEP payload values with any set environment overrides
+func applySCEPEnvOverrides(pl *cfgprofiles.SCEPPayload) {
+	overrideFromEnv(&pl.PayloadContent.URL, EnvSCEPURL)
+	overrideFromEnv(&pl.PayloadContent.Challenge, EnvSCEPChallenge)
+}
+
+// applyMDMEnvOverrides replaces MDM payload values with any set environment overrides
+func applyMDMEnvOverrides(pl *cfgprofiles.MDMPayload) {
+	overrideFromEnv(&pl.CheckInURL, EnvMDMCheckInURL)
+	overrideFromEnv(&pl.ServerURL, EnvMDMConnectURL)
+}
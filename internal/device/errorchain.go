@@ -0,0 +1,88 @@
+package device
+
+import (
+	"errors"
+	"strings"
+)
+
+// mdmbErrorDomain and mdmbErrorCode are the ErrorDomain and ErrorCode of
+// errors from mdmb itself rather than simulated device errors
+const (
+	mdmbErrorDomain = "mdmb-handle-mdm-command"
+	mdmbErrorCode   = 99998
+)
+
+// MDMError is an error with the ErrorCode and ErrorDomain a device
+// reports it with. Err, if set, is the error that caused it and becomes
+// the next entry of the error chain.
+type MDMError struct {
+	Code   int
+	Domain string
+	// Description is the LocalizedDescription. Without one the
+	// description is that of Err.
+	Description string
+	Err         error
+}
+
+func (e *MDMError) Error() string {
+	switch {
+	case e.Err == nil:
+		return e.Description
+	case e.Description == "":
+		return e.Err.Error()
+	}
+	return e.Description + ": " + e.Err.Error()
+}
+
+func (e *MDMError) Unwrap() error {
+	return e.Err
+}
+
+// MDMErrorChain builds the ErrorChain of an Error command response,
+// starting with the outermost error and followed by its causes
+type MDMErrorChain []ErrorChain
+
+// Add appends an error. mdmb's devices are US English so the description
+// is used for both LocalizedDescription and USEnglishDescription.
+func (ec MDMErrorChain) Add(code int, domain, desc string) MDMErrorChain {
+	return append(ec, ErrorChain{
+		ErrorCode:            code,
+		ErrorDomain:          domain,
+		LocalizedDescription: desc,
+		USEnglishDescription: desc,
+	})
+}
+
+// AddError appends err and each of its causes (by errors.Unwrap): an
+// MDMError with its code and domain and any other error, like the context
+// added by fmt.Errorf, with mdmb's own code and domain.
+func (ec MDMErrorChain) AddError(err error) MDMErrorChain {
+	for err != nil {
+		code, domain := mdmbErrorCode, mdmbErrorDomain
+		if mdmErr, ok := err.(*MDMError); ok {
+			code, domain = mdmErr.Code, mdmErr.Domain
+			if mdmErr.Description == "" && mdmErr.Err != nil {
+				// the cause describes this error so is not an entry of its own
+				err = mdmErr.Err
+			}
+		}
+		ec = ec.Add(code, domain, errorContext(err))
+		err = errors.Unwrap(err)
+	}
+	return ec
+}
+
+// errorContext returns the description of err without that of the error
+// it wraps: "parsing: EOF" wrapping "EOF" is described by "parsing"
+func errorContext(err error) string {
+	if mdmErr, ok := err.(*MDMError); ok && mdmErr.Description != "" {
+		return mdmErr.Description
+	}
+	desc := err.Error()
+	if cause := errors.Unwrap(err); cause != nil {
+		if context := strings.TrimSuffix(desc, ": "+cause.Error()); context != desc {
+			return context
+		}
+	}
+	return desc
+}
@@ -0,0 +1,65 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestMDMErrorChainAddError(t *testing.T) {
+	type entry struct {
+		code   int
+		domain string
+		desc   string
+	}
+	cause := errors.New("unexpected EOF")
+	parseErr := &MDMError{Code: 1000, Domain: "MCProfileErrorDomain", Description: "parsing profile", Err: cause}
+	for _, test := range []struct {
+		name string
+		err  error
+		want []entry
+	}{
+		{
+			name: "plain",
+			err:  cause,
+			want: []entry{{mdmbErrorCode, mdmbErrorDomain, "unexpected EOF"}},
+		},
+		{
+			name: "MDMError",
+			err:  parseErr,
+			want: []entry{
+				{1000, "MCProfileErrorDomain", "parsing profile"},
+				{mdmbErrorCode, mdmbErrorDomain, "unexpected EOF"},
+			},
+		},
+		{
+			name: "wrapped MDMError",
+			err:  fmt.Errorf("installing com.example: %w", parseErr),
+			want: []entry{
+				{mdmbErrorCode, mdmbErrorDomain, "installing com.example"},
+				{1000, "MCProfileErrorDomain", "parsing profile"},
+				{mdmbErrorCode, mdmbErrorDomain, "unexpected EOF"},
+			},
+		},
+		{
+			name: "described by its cause",
+			err:  &MDMError{Code: 4001, Domain: "MCInstallationErrorDomain", Err: fmt.Errorf("reading: %w", cause)},
+			want: []entry{
+				{4001, "MCInstallationErrorDomain", "reading"},
+				{mdmbErrorCode, mdmbErrorDomain, "unexpected EOF"},
+			},
+		},
+	} {
+		var have []entry
+		for _, e := range (MDMErrorChain{}).AddError(test.err) {
+			if e.LocalizedDescription != e.USEnglishDescription {
+				t.Errorf("%s: have LocalizedDescription %q, USEnglishDescription %q", test.name, e.LocalizedDescription, e.USEnglishDescription)
+			}
+			have = append(have, entry{e.ErrorCode, e.ErrorDomain, e.LocalizedDescription})
+		}
+		if !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%s: have chain %v, want %v", test.name, have, test.want)
+		}
+	}
+}
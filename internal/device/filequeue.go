@@ -0,0 +1,156 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// commandQueueDir, if set, is a directory of command files devices
+// process instead of talking to an MDM server
+var commandQueueDir string
+
+// SetCommandQueueDir makes devices work offline from the command files
+// (plists, one command per file) in dir instead of an MDM server. Each
+// Connect session delivers the files in filename order, skipping those
+// the device already responded to, and writes each response to a file of
+// the same name under dir/out/<UDID>. A command answered NotNow is
+// delivered again by a later session. Check-in messages are written to
+// dir/out/<UDID> as well and get an empty response. It should be called
+// before any devices are processed. An empty dir talks to the MDM server
+// as usual.
+func SetCommandQueueDir(dir string) error {
+	if dir != "" {
+		fi, err := os.Stat(dir)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			return fmt.Errorf("command queue %s is not a directory", dir)
+		}
+	}
+	commandQueueDir = dir
+	return nil
+}
+
+// queueOutDir is where the device's responses to queued commands go
+func (c *MDMClient) queueOutDir() (string, error) {
+	dir := filepath.Join(commandQueueDir, "out", c.Device.UDID)
+	return dir, os.MkdirAll(dir, 0755)
+}
+
+// queueCheckin writes a check-in message body in place of sending it
+func (c *MDMClient) queueCheckin(messageType string, body []byte) error {
+	dir, err := c.queueOutDir()
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "checkin-"+messageType+".plist"), body, 0644)
+}
+
+// queuedCommandFiles returns the names of the command files in filename
+// order
+func queuedCommandFiles() ([]string, error) {
+	infos, err := ioutil.ReadDir(commandQueueDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, fi := range infos {
+		if fi.Mode().IsRegular() && strings.HasSuffix(fi.Name(), ".plist") {
+			names = append(names, fi.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// queueResponded reports whether the device responded to command file
+// name other than NotNow
+func queueResponded(outDir, name string) (bool, error) {
+	b, err := ioutil.ReadFile(filepath.Join(outDir, name))
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	r := &ConnectRequest{}
+	if err := plist.Unmarshal(b, r); err != nil {
+		return false, fmt.Errorf("response %s: %w", name, err)
+	}
+	return r.Status != "NotNow", nil
+}
+
+// queueConnectReport takes the place of sending a Connect report to the
+// MDM server: a command result is written to the out file of its command
+// and the next command file the device hasn't responded to is returned
+// (nil if there is none)
+func (c *MDMClient) queueConnectReport(report []byte) ([]byte, error) {
+	outDir, err := c.queueOutDir()
+	if err != nil {
+		return nil, err
+	}
+	names, err := queuedCommandFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	r := &ConnectRequest{}
+	if err := plist.Unmarshal(report, r); err != nil {
+		return nil, err
+	}
+	if r.Status != "Idle" {
+		name := c.queueCommand
+		if name == "" {
+			// a result pending from an earlier session
+			name, err = queueCommandFile(names, r.CommandUUID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if name == "" {
+			level.Warn(c.Device.logger()).Log("msg", "no queued command for result", "command_uuid", r.CommandUUID)
+		} else if err := ioutil.WriteFile(filepath.Join(outDir, name), report, 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	c.queueCommand = ""
+	for _, name := range names {
+		responded, err := queueResponded(outDir, name)
+		if err != nil {
+			return nil, err
+		}
+		if responded {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(commandQueueDir, name))
+		if err != nil {
+			return nil, err
+		}
+		level.Debug(c.Device.logger()).Log("msg", "queued command", "file", name)
+		c.queueCommand = name
+		return b, nil
+	}
+	return nil, nil
+}
+
+// queueCommandFile returns the name of the command file with commandUUID
+func queueCommandFile(names []string, commandUUID string) (string, error) {
+	for _, name := range names {
+		b, err := ioutil.ReadFile(filepath.Join(commandQueueDir, name))
+		if err != nil {
+			return "", err
+		}
+		if resp, _ := parseConnectResponse(b); resp.CommandUUID != "" && resp.CommandUUID == commandUUID {
+			return name, nil
+		}
+	}
+	return "", nil
+}
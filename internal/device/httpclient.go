@@ -0,0 +1,129 @@
+package device
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/go-kit/kit/log"
+	httptransport "github.com/go-kit/kit/transport/http"
+	scepclient "github.com/micromdm/scep/v2/client"
+	scepserver "github.com/micromdm/scep/v2/server"
+)
+
+// defaultHTTPTimeout limits each HTTP request unless HTTPClientOptions
+// sets a timeout
+const defaultHTTPTimeout = 30 * time.Second
+
+// HTTPClientOptions configure the HTTP clients used for MDM, SCEP, and app
+// manifest requests
+type HTTPClientOptions struct {
+	// RootCAs, if not nil, is the complete set of CAs trusted to verify
+	// servers, as with tls.Config. To trust additional CAs alongside the
+	// system's, start from x509.SystemCertPool. The MDM server certificate
+	// is only verified when RootCAs is set.
+	RootCAs *x509.CertPool
+	// Timeout limits each request. Zero or less uses the default.
+	Timeout time.Duration
+	// Proxy, if not nil, is used for all requests instead of the proxy
+	// from the HTTP_PROXY and HTTPS_PROXY environment variables
+	Proxy *url.URL
+	// Header is added to every request, replacing any header of the same
+	// name. Keys must be in canonical form (see http.Header.Add).
+	Header http.Header
+	// Retries is how many times a request failing with a network error
+	// or a 5xx status is retried, with exponential backoff starting at
+	// RetryBaseDelay (zero or less uses the default). A Retry-After
+	// header overrides the backoff. Timeout applies to each attempt.
+	Retries        int
+	RetryBaseDelay time.Duration
+	// Rate, if more than zero, limits all requests (including retries)
+	// to this many per second on average, shared by all clients
+	Rate float64
+}
+
+var httpOpts = HTTPClientOptions{Timeout: defaultHTTPTimeout}
+
+// SetHTTPClientOptions configures the HTTP clients devices use. It should
+// be called before any devices are processed.
+func SetHTTPClientOptions(opts HTTPClientOptions) {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultHTTPTimeout
+	}
+	if opts.RetryBaseDelay <= 0 {
+		opts.RetryBaseDelay = defaultRetryBaseDelay
+	}
+	requestLimiter = nil
+	if opts.Rate > 0 {
+		// a burst of one spreads requests evenly
+		requestLimiter = newTokenBucket(opts.Rate, 1)
+	}
+	httpOpts = opts
+}
+
+// headerTransport sets headers on each request
+type headerTransport struct {
+	header http.Header
+	next   http.RoundTripper
+}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	// RoundTrippers mustn't modify the request
+	req = req.Clone(req.Context())
+	for k, vs := range t.header {
+		req.Header[k] = append([]string(nil), vs...)
+	}
+	return t.next.RoundTrip(req)
+}
+
+// NewHTTPClient creates an HTTP client using the options from
+// SetHTTPClientOptions. tlsConfig, if not nil, is used for TLS
+// connections and gets the configured root CAs if it has none.
+func NewHTTPClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		tlsConfig = &tls.Config{}
+	}
+	if tlsConfig.RootCAs == nil {
+		tlsConfig.RootCAs = httpOpts.RootCAs
+	}
+	tr := http.DefaultTransport.(*http.Transport).Clone()
+	tr.TLSClientConfig = tlsConfig
+	if httpOpts.Proxy != nil {
+		tr.Proxy = http.ProxyURL(httpOpts.Proxy)
+	}
+	var rt http.RoundTripper = tr
+	if len(httpOpts.Header) > 0 {
+		rt = &headerTransport{header: httpOpts.Header, next: rt}
+	}
+	if httpOpts.Retries > 0 || requestLimiter != nil {
+		// the client timeout would cover all attempts and rate limiting
+		return &http.Client{Transport: &retryTransport{
+			retries:   httpOpts.Retries,
+			baseDelay: httpOpts.RetryBaseDelay,
+			timeout:   httpOpts.Timeout,
+			limiter:   requestLimiter,
+			next:      rt,
+		}}
+	}
+	return &http.Client{Transport: rt, Timeout: httpOpts.Timeout}
+}
+
+// newSCEPClient is scepclient.New but using NewHTTPClient
+func newSCEPClient(serverURL string, logger log.Logger) (scepclient.Client, error) {
+	if !strings.HasPrefix(serverURL, "http") {
+		serverURL = "http://" + serverURL
+	}
+	tgt, err := url.Parse(serverURL)
+	if err != nil {
+		return nil, err
+	}
+	client := httptransport.SetClient(NewHTTPClient(nil))
+	logging := scepserver.EndpointLoggingMiddleware(logger)
+	return &scepserver.Endpoints{
+		GetEndpoint:  logging(httptransport.NewClient("GET", tgt, scepserver.EncodeSCEPRequest, scepserver.DecodeSCEPResponse, client).Endpoint()),
+		PostEndpoint: logging(httptransport.NewClient("POST", tgt, scepserver.EncodeSCEPRequest, scepserver.DecodeSCEPResponse, client).Endpoint()),
+	}, nil
+}
@@ -1,7 +1,9 @@
 package device
 
 import (
-	bolt "go.etcd.io/bbolt"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
 )
 
 const (
@@ -12,10 +14,10 @@ type Keychain struct {
 	ID   string
 	Type string
 
-	DB *bolt.DB
+	DB Store
 }
 
-func NewKeychain(id, kcType string, db *bolt.DB) *Keychain {
+func NewKeychain(id, kcType string, db Store) *Keychain {
 	return &Keychain{
 		ID:   id,
 		Type: kcType,
@@ -25,7 +27,160 @@ func NewKeychain(id, kcType string, db *bolt.DB) *Keychain {
 
 func (device *Device) SystemKeychain() *Keychain {
 	if device.sysKeychain == nil {
-		device.sysKeychain = NewKeychain(device.UDID, KeychainSystem, device.boltDB)
+		device.sysKeychain = NewKeychain(device.UDID, KeychainSystem, device.store)
 	}
 	return device.sysKeychain
 }
+
+// purge deletes all items in the keychain
+func (kc *Keychain) purge() error {
+	prefix := kc.ID + "_" + kc.Type + "_"
+	return kc.DB.Update(func(tx Tx) error {
+		err := BucketDeleteWithPrefix(tx, "keychain_items_item", prefix)
+		if err != nil {
+			return err
+		}
+		return BucketDeleteWithPrefix(tx, "keychain_item_class", prefix)
+	})
+}
+
+// saveIdentity stores key and cert as keychain items along with an
+// identity item referencing them and returns the identity UUID
+func (kc *Keychain) saveIdentity(key *rsa.PrivateKey, cert *x509.Certificate) (idUUID string, err error) {
+	err = kc.DB.Update(func(tx Tx) error {
+		idUUID, err = kc.putIdentity(tx, key, cert)
+		return err
+	})
+	return
+}
+
+// putIdentity is saveIdentity in tx
+func (kc *Keychain) putIdentity(tx Tx, key *rsa.PrivateKey, cert *x509.Certificate) (string, error) {
+	kciKey := NewKeychainItem(kc, ClassKey)
+	kciKey.Key = key
+	err := kciKey.put(tx)
+	if err != nil {
+		return "", err
+	}
+
+	kciCert := NewKeychainItem(kc, ClassCertificate)
+	kciCert.Certificate = cert
+	err = kciCert.put(tx)
+	if err != nil {
+		return "", err
+	}
+
+	kciID := NewKeychainItem(kc, ClassIdentity)
+	kciID.IdentityKeyUUID = kciKey.UUID
+	kciID.IdentityCertificateUUID = kciCert.UUID
+	err = kciID.put(tx)
+	if err != nil {
+		return "", err
+	}
+
+	return kciID.UUID, nil
+}
+
+// identityCertificate loads the certificate of the identity item uuid
+func (kc *Keychain) identityCertificate(uuid string) (*x509.Certificate, error) {
+	kciID, err := LoadKeychainItem(kc, uuid)
+	if err != nil {
+		return nil, err
+	}
+	kciCert, err := LoadKeychainItem(kc, kciID.IdentityCertificateUUID)
+	if err != nil {
+		return nil, err
+	}
+	if kciCert.Certificate == nil {
+		return nil, errors.New("identity has no certificate")
+	}
+	return kciCert.Certificate, nil
+}
+
+// deleteIdentity deletes an identity item and the key and certificate
+// items it references
+func (kc *Keychain) deleteIdentity(uuid string) error {
+	items, err := kc.identityItems(uuid)
+	if err != nil {
+		return err
+	}
+	return kc.DB.Update(func(tx Tx) error {
+		for _, kci := range items {
+			if err := kci.delete(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// identityItems loads the certificate, key, and identity items of the
+// identity item uuid
+func (kc *Keychain) identityItems(uuid string) ([]*KeychainItem, error) {
+	kciID, err := LoadKeychainItem(kc, uuid)
+	if err != nil {
+		return nil, err
+	}
+
+	kciKey, err := LoadKeychainItem(kc, kciID.IdentityKeyUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	kciCert, err := LoadKeychainItem(kc, kciID.IdentityCertificateUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	return []*KeychainItem{kciCert, kciKey, kciID}, nil
+}
+
+// KeychainGC finds system keychain items that neither the MDM identity
+// nor any installed profile payload references (e.g. after failed
+// installs) and, unless dryRun, deletes them. It returns the number and
+// total size of the unreferenced items.
+func (device *Device) KeychainGC(dryRun bool) (count, size int, err error) {
+	reachable := make(map[string]bool)
+	if device.MDMIdentityKeychainUUID != "" {
+		reachable[device.MDMIdentityKeychainUUID] = true
+	}
+	// refs are matched across all stores rather than just the device's
+	// so refs in the legacy (unscoped) key format, from a DB that hasn't
+	// been migrated, still count. Keychain item UUIDs are unique so
+	// another device's refs can't keep this device's items.
+	for _, ekey := range []string{"keychain_identity", "keychain_certificate", "scep_pending_key"} {
+		refs, err := allPayloadRefStrings(device.store, ekey)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, ref := range refs {
+			reachable[ref] = true
+		}
+	}
+
+	items, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		return 0, 0, err
+	}
+	for _, kci := range items {
+		if kci.Class == ClassIdentity && reachable[kci.UUID] {
+			reachable[kci.IdentityKeyUUID] = true
+			reachable[kci.IdentityCertificateUUID] = true
+		}
+	}
+
+	for _, kci := range items {
+		if reachable[kci.UUID] {
+			continue
+		}
+		count++
+		size += len(kci.Item)
+		if dryRun {
+			continue
+		}
+		if err := kci.Delete(); err != nil {
+			return count, size, err
+		}
+	}
+	return count, size, nil
+}
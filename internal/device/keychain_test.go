@@ -0,0 +1,70 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// saveTestIdentity saves a new self-signed identity in the device's
+// system keychain and returns its identity UUID
+func saveTestIdentity(t *testing.T, device *Device) string {
+	t.Helper()
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idUUID, err := device.SystemKeychain().saveIdentity(key, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return idUUID
+}
+
+func TestKeychainGC(t *testing.T) {
+	db := NewMemoryStore()
+	device := newTestDevice(t, db)
+	mdmID := saveTestIdentity(t, device)
+	device.MDMIdentityKeychainUUID = mdmID
+	scopedID := saveTestIdentity(t, device)
+	legacyID := saveTestIdentity(t, device)
+	saveTestIdentity(t, device) // unreferenced
+
+	pld := &cfgprofiles.Payload{PayloadIdentifier: "com.example.scep", PayloadUUID: "SCEP-UUID"}
+	err := device.SystemProfileStore().savePayloadRefString("com.example.profile", pld, "keychain_identity", scopedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a ref in the key format from before refs were scoped by store
+	err = db.Update(func(tx Tx) error {
+		return BucketPutOrDeleteString(tx, "profile_payload_refs", "com.example.legacy_com.example.scep_SCEP-UUID_keychain_identity", legacyID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	count, _, err := device.KeychainGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the unreferenced identity and its key and certificate
+	if count != 3 {
+		t.Errorf("dry run: have %d unreferenced items, want 3", count)
+	}
+	if _, _, err := device.KeychainGC(false); err != nil {
+		t.Fatal(err)
+	}
+	items, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, want := len(items), 9; have != want {
+		t.Errorf("items after GC: have %d, want %d", have, want)
+	}
+	for _, idUUID := range []string{mdmID, scopedID, legacyID} {
+		if _, err := device.SystemKeychain().identityCertificate(idUUID); err != nil {
+			t.Errorf("referenced identity %s: %v", idUUID, err)
+		}
+	}
+}
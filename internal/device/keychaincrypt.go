@@ -0,0 +1,154 @@
+package device
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/x509"
+	"errors"
+	"sync"
+
+	"github.com/go-kit/kit/log/level"
+	"golang.org/x/crypto/scrypt"
+)
+
+// encryptedKeyPrefix starts an encrypted ClassKey item. Unencrypted
+// (DER) keys start with 0x30 so can't be mistaken for one.
+var encryptedKeyPrefix = []byte("mdmb-aes-gcm:")
+
+// meta bucket keys for the keychain passphrase
+const (
+	keychainSaltKey     = "keychain_salt"
+	keychainVerifierKey = "keychain_verifier"
+)
+
+// scrypt parameters for deriving the keychain key from the passphrase
+const (
+	keychainScryptN = 1 << 15
+	keychainScryptR = 8
+	keychainScryptP = 1
+)
+
+// ErrKeychainPassphrase is returned for a keychain passphrase other than
+// the one the database's keys were encrypted with
+var ErrKeychainPassphrase = errors.New("wrong keychain passphrase")
+
+// keychainAEAD, if set, encrypts ClassKey items as they're saved
+var keychainAEAD cipher.AEAD
+
+// plaintextKeyWarning warns once about unencrypted CA-issued identities
+var plaintextKeyWarning sync.Once
+
+// SetKeychainPassphrase encrypts private keys saved to keychains in db
+// with AES-GCM, using a key derived from passphrase with scrypt, and
+// decrypts them as they're loaded. The salt and a value to check the
+// passphrase against are stored in db on first use; a different
+// passphrase later returns ErrKeychainPassphrase. Keys already saved
+// unencrypted still load. An empty passphrase saves keys unencrypted (the
+// default) and encrypted keys can't be loaded. It should be called before
+// any devices are processed.
+func SetKeychainPassphrase(db Store, passphrase string) error {
+	keychainAEAD = nil
+	if passphrase == "" {
+		return nil
+	}
+	return db.Update(func(tx Tx) error {
+		salt := append([]byte(nil), BucketGet(tx, metaBucket, keychainSaltKey)...)
+		if len(salt) == 0 {
+			salt = make([]byte, 16)
+			if _, err := rand.Read(salt); err != nil {
+				return err
+			}
+			if err := BucketPutOrDelete(tx, metaBucket, keychainSaltKey, salt); err != nil {
+				return err
+			}
+		}
+		key, err := scrypt.Key([]byte(passphrase), salt, keychainScryptN, keychainScryptR, keychainScryptP, 32)
+		if err != nil {
+			return err
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return err
+		}
+		// the verifier is an encryption of its own name
+		if verifier := BucketGet(tx, metaBucket, keychainVerifierKey); len(verifier) > 0 {
+			if _, err := openKeychainItem(aead, verifier, []byte(keychainVerifierKey)); err != nil {
+				return ErrKeychainPassphrase
+			}
+		} else {
+			verifier, err := sealKeychainItem(aead, []byte(keychainVerifierKey), []byte(keychainVerifierKey))
+			if err != nil {
+				return err
+			}
+			if err := BucketPutOrDelete(tx, metaBucket, keychainVerifierKey, verifier); err != nil {
+				return err
+			}
+		}
+		keychainAEAD = aead
+		return nil
+	})
+}
+
+// sealKeychainItem encrypts item bound to aad (the item's store key, so
+// encrypted items can't be swapped)
+func sealKeychainItem(aead cipher.AEAD, item, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed := append(append([]byte(nil), encryptedKeyPrefix...), nonce...)
+	return aead.Seal(sealed, nonce, item, aad), nil
+}
+
+// openKeychainItem decrypts an item from sealKeychainItem
+func openKeychainItem(aead cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	sealed = bytes.TrimPrefix(sealed, encryptedKeyPrefix)
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("encrypted keychain item too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, aad)
+}
+
+// sealed returns the raw item to store: encrypted for keys if a keychain
+// passphrase is set
+func (kci *KeychainItem) sealed() ([]byte, error) {
+	if kci.Class != ClassKey || keychainAEAD == nil {
+		return kci.Item, nil
+	}
+	return sealKeychainItem(keychainAEAD, kci.Item, []byte(kci.storeKey()))
+}
+
+// unseal decrypts the raw item if it's encrypted
+func (kci *KeychainItem) unseal() error {
+	if !bytes.HasPrefix(kci.Item, encryptedKeyPrefix) {
+		return nil
+	}
+	if keychainAEAD == nil {
+		return errors.New("keychain item is encrypted: a keychain passphrase is required")
+	}
+	item, err := openKeychainItem(keychainAEAD, kci.Item, []byte(kci.storeKey()))
+	if err != nil {
+		return errors.New("decrypting keychain item: wrong keychain passphrase or corrupt item")
+	}
+	kci.Item = item
+	return nil
+}
+
+// warnPlaintextKey warns (once) if the key of an identity with a CA
+// issued certificate is stored unencrypted. mdmb can't tell a test CA
+// from a real one; self-signed identities are assumed to be for testing.
+func (device *Device) warnPlaintextKey(cert *x509.Certificate) {
+	if keychainAEAD != nil || cert == nil || bytes.Equal(cert.RawIssuer, cert.RawSubject) {
+		return
+	}
+	plaintextKeyWarning.Do(func() {
+		level.Warn(device.logger()).Log("msg", "identity private keys are stored unencrypted: use a keychain passphrase for identities from real CAs", "issuer", cert.Issuer.String())
+	})
+}
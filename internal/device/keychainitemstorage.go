@@ -3,51 +3,61 @@ package device
 import (
 	"errors"
 	"strings"
-
-	bolt "go.etcd.io/bbolt"
 )
 
-func (kci *KeychainItem) boltKey() string {
+func (kci *KeychainItem) storeKey() string {
 	return strings.Join([]string{kci.Keychain.ID, kci.Keychain.Type, kci.UUID}, "_")
 }
 
-// Save writes a keychain item to a keychain's BoltDB.
+// Save writes a keychain item to a keychain's Store.
 func (kci *KeychainItem) Save() error {
+	return kci.Keychain.DB.Update(kci.put)
+}
+
+// put writes a keychain item in tx
+func (kci *KeychainItem) put(tx Tx) error {
 	err := kci.encode()
 	if err != nil {
 		return err
 	}
-	return kci.Keychain.DB.Update(func(tx *bolt.Tx) error {
-		err := BucketPutOrDelete(tx, "keychain_items_item", kci.boltKey(), kci.Item)
-		if err != nil {
-			return err
-		}
-		return BucketPutOrDeleteInt(tx, "keychain_item_class", kci.boltKey(), kci.Class)
-	})
+	item, err := kci.sealed()
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDelete(tx, "keychain_items_item", kci.storeKey(), item)
+	if err != nil {
+		return err
+	}
+	return BucketPutOrDeleteInt(tx, "keychain_item_class", kci.storeKey(), kci.Class)
 }
 
 func (kci *KeychainItem) Delete() error {
-	return kci.Keychain.DB.Update(func(tx *bolt.Tx) error {
-		err := BucketPutOrDelete(tx, "keychain_items_item", kci.boltKey(), nil)
-		if err != nil {
-			return err
-		}
-		return BucketPutOrDeleteInt(tx, "keychain_item_class", kci.boltKey(), 0)
-	})
+	return kci.Keychain.DB.Update(kci.delete)
 }
 
-// LoadKeychainItem loads a *KeychainItem from a keychain's BoltDB.
+// delete deletes a keychain item in tx
+func (kci *KeychainItem) delete(tx Tx) error {
+	err := BucketPutOrDelete(tx, "keychain_items_item", kci.storeKey(), nil)
+	if err != nil {
+		return err
+	}
+	return BucketPutOrDeleteInt(tx, "keychain_item_class", kci.storeKey(), 0)
+}
+
+// LoadKeychainItem loads a *KeychainItem from a keychain's Store.
 func LoadKeychainItem(kc *Keychain, uuid string) (kci *KeychainItem, err error) {
 	kci = &KeychainItem{
 		Keychain: kc,
 		UUID:     uuid,
 	}
-	err = kc.DB.View(func(tx *bolt.Tx) error {
-		kci.Item = BucketGet(tx, "keychain_items_item", kci.boltKey())
+	err = kc.DB.View(func(tx Tx) error {
+		// copied: decoded certificates keep referencing the item, which
+		// is only valid during the transaction
+		kci.Item = append([]byte(nil), BucketGet(tx, "keychain_items_item", kci.storeKey())...)
 		if len(kci.Item) == 0 {
 			return errors.New("empty keychain item")
 		}
-		kci.Class = BucketGetInt(tx, "keychain_item_class", kci.boltKey())
+		kci.Class = BucketGetInt(tx, "keychain_item_class", kci.storeKey())
 		if kci.Class == 0 {
 			return errors.New("invalid keychain item class 0")
 		}
@@ -56,6 +66,38 @@ func LoadKeychainItem(kc *Keychain, uuid string) (kci *KeychainItem, err error)
 	if err != nil {
 		return
 	}
+	err = kci.unseal()
+	if err != nil {
+		return
+	}
 	err = kci.decode()
 	return
 }
+
+// LoadKeychainItems loads all items of class from a keychain's Store.
+// A class of 0 loads items of every class.
+func LoadKeychainItems(kc *Keychain, class int) (items []*KeychainItem, err error) {
+	prefix := strings.Join([]string{kc.ID, kc.Type, ""}, "_")
+	err = kc.DB.View(func(tx Tx) error {
+		return BucketForEachWithPrefix(tx, "keychain_items_item", prefix, true, func(k, v []byte) error {
+			kci := &KeychainItem{
+				Keychain: kc,
+				UUID:     string(k),
+			}
+			kci.Class = BucketGetInt(tx, "keychain_item_class", kci.storeKey())
+			if class != 0 && kci.Class != class {
+				return nil
+			}
+			kci.Item = append([]byte(nil), v...)
+			if err := kci.unseal(); err != nil {
+				return err
+			}
+			if err := kci.decode(); err != nil {
+				return err
+			}
+			items = append(items, kci)
+			return nil
+		})
+	})
+	return
+}
@@ -0,0 +1,119 @@
+package device
+
+import (
+	"bytes"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+type DeviceLockCommand struct {
+	ConnectResponseCommand
+	PIN         string `plist:",omitempty"`
+	Message     string `plist:",omitempty"`
+	PhoneNumber string `plist:",omitempty"`
+}
+
+type DeviceLock struct {
+	Command     DeviceLockCommand
+	CommandUUID string
+}
+
+func (c *MDMClient) handleDeviceLock(respBytes []byte) (interface{}, error) {
+	cmd := &DeviceLock{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	c.Device.Locked = true
+	c.Device.LockPIN = cmd.Command.PIN
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID), nil
+}
+
+type ClearPasscodeCommand struct {
+	ConnectResponseCommand
+	UnlockToken []byte `plist:",omitempty"`
+}
+
+type ClearPasscode struct {
+	Command     ClearPasscodeCommand
+	CommandUUID string
+}
+
+func (c *MDMClient) handleClearPasscode(respBytes []byte) (interface{}, error) {
+	cmd := &ClearPasscode{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(cmd.Command.UnlockToken, c.Device.UnlockToken) {
+		return c.errorResponse(cmd.Command.RequestType, cmd.CommandUUID, 12022, "MCMDMErrorDomain", "Invalid unlock token"), nil
+	}
+	c.Device.Locked = false
+	c.Device.LockPIN = ""
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID), nil
+}
+
+type EraseDeviceCommand struct {
+	ConnectResponseCommand
+	// PIN locks a Mac after erasing it (macOS only)
+	PIN string `plist:",omitempty"`
+}
+
+type EraseDevice struct {
+	Command     EraseDeviceCommand
+	CommandUUID string
+}
+
+// handleEraseDevice only marks the device erased (and locked with the PIN,
+// if any) so that the command can still be acknowledged. The Connect
+// session erases it afterwards.
+func (c *MDMClient) handleEraseDevice(respBytes []byte) (interface{}, error) {
+	cmd := &EraseDevice{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	c.Device.Erased = true
+	if cmd.Command.PIN != "" {
+		c.Device.Locked = true
+		c.Device.LockPIN = cmd.Command.PIN
+	}
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID), nil
+}
+
+// erase wipes the keychain, profile store, and declarations, unenrolling the device
+// without a CheckOut as a real device would
+func (c *MDMClient) erase() error {
+	level.Info(c.Device.logger()).Log("msg", "erasing device")
+	err := c.Device.SystemKeychain().purge()
+	if err != nil {
+		return err
+	}
+	err = c.Device.SystemProfileStore().purge()
+	if err != nil {
+		return err
+	}
+	err = c.Device.purgeDDM()
+	if err != nil {
+		return err
+	}
+	err = c.unenroll()
+	if err != nil {
+		return err
+	}
+	c.Device.mdmClient = nil
+	return c.Device.Save()
+}
@@ -0,0 +1,142 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"github.com/groob/plist"
+)
+
+// LOM (Lights Out Management) commands are recorded in device state only.
+// No LOM network traffic is ever sent.
+
+const lomProtocolVersion = 1
+
+type LOMSetupRequestResponse struct {
+	ConnectRequest
+	ProtocolVersion        int
+	LOMDeviceMACAddress    string
+	PrimaryIPv6AddressList []string
+	LOMDeviceSecret        string
+}
+
+// lomMACAddress derives a stable locally-administered MAC from the UDID
+func (device *Device) lomMACAddress() string {
+	sum := sha256.Sum256([]byte("lom" + device.UDID))
+	mac := net.HardwareAddr(sum[:6])
+	mac[0] = (mac[0] | 0x02) & 0xfe
+	return mac.String()
+}
+
+// lomIPv6Address derives a link-local IPv6 address from a MAC (EUI-64)
+func lomIPv6Address(macStr string) (string, error) {
+	mac, err := net.ParseMAC(macStr)
+	if err != nil {
+		return "", err
+	}
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:11], mac[0:3])
+	ip[8] ^= 0x02
+	ip[11], ip[12] = 0xff, 0xfe
+	copy(ip[13:16], mac[3:6])
+	return ip.String(), nil
+}
+
+func (c *MDMClient) handleLOMSetupRequest(reqType, commandUUID string) (interface{}, error) {
+	dev := c.Device
+	if dev.LOMMACAddress == "" {
+		dev.LOMMACAddress = dev.lomMACAddress()
+	}
+	if dev.LOMIPv6Address == "" {
+		ip, err := lomIPv6Address(dev.LOMMACAddress)
+		if err != nil {
+			return nil, err
+		}
+		dev.LOMIPv6Address = ip
+	}
+	if dev.LOMSecret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		dev.LOMSecret = base64.StdEncoding.EncodeToString(b)
+	}
+	err := dev.Save()
+	if err != nil {
+		return nil, err
+	}
+	return &LOMSetupRequestResponse{
+		ConnectRequest: ConnectRequest{
+			UDID:        dev.UDID,
+			Status:      "Acknowledged",
+			CommandUUID: commandUUID,
+			RequestType: reqType,
+		},
+		ProtocolVersion:        lomProtocolVersion,
+		LOMDeviceMACAddress:    dev.LOMMACAddress,
+		PrimaryIPv6AddressList: []string{dev.LOMIPv6Address},
+		LOMDeviceSecret:        dev.LOMSecret,
+	}, nil
+}
+
+type LOMDeviceRequestItem struct {
+	DeviceDNSName            string `plist:",omitempty"`
+	DeviceRequestType        string
+	DeviceRequestUUID        string   `plist:",omitempty"`
+	LOMProtocolVersion       int      `plist:",omitempty"`
+	PrimaryIPv6AddressList   []string `plist:",omitempty"`
+	SecondaryIPv6AddressList []string `plist:",omitempty"`
+}
+
+type LOMDeviceRequestCommand struct {
+	ConnectResponseCommand
+	RequestList []LOMDeviceRequestItem
+}
+
+type LOMDeviceRequest struct {
+	Command     LOMDeviceRequestCommand
+	CommandUUID string
+}
+
+type LOMDeviceResponseItem struct {
+	DeviceRequestType         string
+	DeviceRequestUUID         string `plist:",omitempty"`
+	DeviceRequestReturnStatus string
+}
+
+type LOMDeviceRequestResponse struct {
+	ConnectRequest
+	ResponseList []LOMDeviceResponseItem
+}
+
+func (c *MDMClient) handleLOMDeviceRequest(respBytes []byte) (interface{}, error) {
+	cmd := &LOMDeviceRequest{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if c.Device.LOMSecret == "" {
+		return nil, errors.New("LOM device request before LOM setup")
+	}
+	resp := &LOMDeviceRequestResponse{
+		ConnectRequest: ConnectRequest{
+			UDID:        c.Device.UDID,
+			Status:      "Acknowledged",
+			CommandUUID: cmd.CommandUUID,
+			RequestType: cmd.Command.RequestType,
+		},
+	}
+	for _, req := range cmd.Command.RequestList {
+		c.Device.LOMLastRequestType = req.DeviceRequestType
+		resp.ResponseList = append(resp.ResponseList, LOMDeviceResponseItem{
+			DeviceRequestType:         req.DeviceRequestType,
+			DeviceRequestUUID:         req.DeviceRequestUUID,
+			DeviceRequestReturnStatus: "Success",
+		})
+	}
+	return resp, c.Device.Save()
+}
@@ -2,30 +2,51 @@ package device
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
 	"crypto/tls"
 	"encoding/base64"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/go-kit/kit/log/level"
 	"github.com/groob/plist"
 	"go.mozilla.org/pkcs7"
 )
 
 func (c *MDMClient) authenticate() error {
+	topic, err := c.topic()
+	if err != nil {
+		return err
+	}
 	ar := &AuthenticationRequest{
 		DeviceName:  c.Device.ComputerName,
 		MessageType: "Authenticate",
-		Topic:       c.MDMPayload.Topic,
+		Topic:       topic,
 		UDID:        c.Device.UDID,
-		// TODO: requires Model, ModelName, EnrollmentID
-		//       https://developer.apple.com/documentation/devicemanagement/authenticaterequest
+		Model:       c.Device.Model(),
+		ModelName:   c.Device.ModelName(),
 
 		// non-required fields
+		BuildVersion: c.Device.BuildVersion,
+		OSVersion:    c.Device.OSVersion,
+		ProductName:  c.Device.ProductName,
 		SerialNumber: c.Device.Serial,
 	}
+	if c.Device.EnrollmentID != "" {
+		// user enrollments don't reveal hardware identifiers
+		ar.UDID = ""
+		ar.SerialNumber = ""
+		ar.EnrollmentID = c.Device.EnrollmentID
+		ar.EnrollmentUserID = c.Device.EnrollmentUserID
+	}
 
 	return c.checkinRequest(ar)
 }
@@ -43,8 +64,10 @@ type AuthenticationRequest struct {
 	ProductName  string `plist:",omitempty"`
 	SerialNumber string `plist:",omitempty"`
 	Topic        string
-	UDID         string
+	UDID         string `plist:",omitempty"`
 	EnrollmentID string `plist:",omitempty"` // macOS 10.15 and iOS 13.0 and later
+	// EnrollmentUserID is set for user enrollments
+	EnrollmentUserID string `plist:",omitempty"`
 }
 
 type ErrorChain struct {
@@ -55,20 +78,56 @@ type ErrorChain struct {
 }
 
 type ConnectRequest struct {
-	UDID        string
-	CommandUUID string `plist:",omitempty"`
-	Status      string
-	ErrorChain  []ErrorChain `plist:",omitempty"`
+	UDID         string `plist:",omitempty"`
+	EnrollmentID string `plist:",omitempty"` // user enrollment
+	CommandUUID  string `plist:",omitempty"`
+	Status       string
+	ErrorChain   []ErrorChain `plist:",omitempty"`
 
 	RequestType string `plist:",omitempty"`
 }
 
+func (r *ConnectRequest) connectStatus() string {
+	return r.Status
+}
+
+// respondTo makes r the response to the command commandUUID. The server
+// correlates the result with its command by the CommandUUID.
+func (r *ConnectRequest) respondTo(reqType, commandUUID string) {
+	r.CommandUUID = commandUUID
+	if r.RequestType == "" {
+		r.RequestType = reqType
+	}
+}
+
+// setEnrollmentID identifies a user enrollment by its EnrollmentID
+// instead of the device UDID
+func (r *ConnectRequest) setEnrollmentID(id string) {
+	r.UDID = ""
+	r.EnrollmentID = id
+}
+
+// reportCommandResult hands the response status for a command to the
+// CommandResultFunc, if any
+func (c *MDMClient) reportCommandResult(reqType, commandUUID string, connReq interface{}) {
+	if c.CommandResultFunc == nil {
+		return
+	}
+	var status string
+	if cr, ok := connReq.(interface{ connectStatus() string }); ok {
+		status = cr.connectStatus()
+	}
+	c.CommandResultFunc(reqType, commandUUID, status)
+}
+
 // type ConnectResponse struct {
 // 	Command     interface{}
 // 	CommandUUID string
 // }
 
-// Generates "SignMessage" HTTP header data
+// mdmP7Sign generates the Mdm-Signature HTTP header for SignMessage
+// enrollments: a base64 encoded detached CMS signature of body (the exact
+// bytes sent) by the device identity
 func (c *MDMClient) mdmP7Sign(body []byte) (string, error) {
 	if !c.MDMPayload.SignMessage {
 		return "", nil
@@ -80,7 +139,10 @@ func (c *MDMClient) mdmP7Sign(body []byte) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	signedData.AddSigner(c.IdentityCertificate, c.IdentityPrivateKey, pkcs7.SignerInfoConfig{})
+	err = signedData.AddSigner(c.IdentityCertificate, c.IdentityPrivateKey, pkcs7.SignerInfoConfig{})
+	if err != nil {
+		return "", fmt.Errorf("signing MDM message: %w", err)
+	}
 	signedData.Detach()
 	sig, err := signedData.Finish()
 	if err != nil {
@@ -98,7 +160,7 @@ type TokenUpdateRequest struct {
 	PushMagic             string
 	Token                 []byte
 	Topic                 string
-	UDID                  string
+	UDID                  string `plist:",omitempty"`
 	UnlockToken           []byte `plist:",omitempty"`
 	UserShortName         string `plist:",omitempty"`
 	UserID                string `plist:",omitempty"`
@@ -111,26 +173,46 @@ func (c *MDMClient) newClient() *http.Client {
 		PrivateKey:  c.IdentityPrivateKey,
 		Leaf:        c.IdentityCertificate,
 	}
-	tr := &http.Transport{
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-			Renegotiation:      tls.RenegotiateOnceAsClient,
-			Certificates:       []tls.Certificate{clientCert},
-		},
-	}
-	client := &http.Client{Transport: tr}
-	return client
+	return NewHTTPClient(&tls.Config{
+		// without configured CAs the MDM server isn't verified
+		InsecureSkipVerify: httpOpts.RootCAs == nil,
+		Renegotiation:      tls.RenegotiateOnceAsClient,
+		Certificates:       []tls.Certificate{clientCert},
+	})
 }
 
-func (c *MDMClient) checkinRequest(i interface{}) error {
-	plistBytes, err := plist.Marshal(i)
+// newMDMRequest builds a check-in or Connect request for body. The
+// device identity always authenticates the TLS connection (see newClient)
+// and additionally signs body in the Mdm-Signature header if the MDM
+// payload has SignMessage set.
+func (c *MDMClient) newMDMRequest(url, contentType string, body []byte) (*http.Request, error) {
+	mdmSig, err := c.mdmP7Sign(body)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if mdmSig != "" {
+		req.Header.Set("Mdm-Signature", mdmSig)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
 	}
+	return req, nil
+}
+
+func (c *MDMClient) checkinRequest(i interface{}) error {
+	_, err := c.checkinRequestBody(i)
+	return err
+}
 
-	mdmSig, err := c.mdmP7Sign(plistBytes)
+// checkinRequestBody sends a check-in message and returns the response body
+func (c *MDMClient) checkinRequestBody(i interface{}) ([]byte, error) {
+	plistBytes, err := plist.Marshal(i)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	ciURL := c.MDMPayload.CheckInURL
@@ -138,44 +220,125 @@ func (c *MDMClient) checkinRequest(i interface{}) error {
 		ciURL = c.MDMPayload.ServerURL
 	}
 
-	client := c.newClient()
-	req, err := http.NewRequest("PUT", ciURL, bytes.NewReader(plistBytes))
-	if err != nil {
-		return err
+	logger := c.Device.logger()
+	if commandQueueDir != "" {
+		level.Info(logger).Log("msg", "check-in", "message_type", messageType(i), "command_queue", commandQueueDir)
+		return nil, c.queueCheckin(messageType(i), plistBytes)
 	}
-	if mdmSig != "" {
-		req.Header.Set("Mdm-Signature", mdmSig)
-	}
-	req.Header.Set("Content-Type", "application/x-apple-aspen-mdm-checkin")
 
-	fmt.Printf("PUT %s -> %s", ciURL, plistBytes)
-	res, err := client.Do(req)
+	client := c.newClient()
+	req, err := c.newMDMRequest(ciURL, "application/x-apple-aspen-mdm-checkin", plistBytes)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	bodyArr, err := ioutil.ReadAll(res.Body)
+	level.Info(logger).Log("msg", "check-in", "message_type", messageType(i), "url", ciURL)
+	level.Debug(logger).Log("msg", "check-in request", "message_type", messageType(i), "body", string(plistBytes))
+	rec := c.recordRequest(messageType(i), plistBytes)
+	started := time.Now()
+	bodyArr, res, err := httpRequestBytes(client, req)
 	if err != nil {
-		return err
+		rec.error(err)
+		c.Device.recordMetric(messageType(i), started, err)
+		return nil, err
 	}
+	rec.response(res.StatusCode, bodyArr)
 
 	if res.StatusCode != 200 {
-		return fmt.Errorf("checkin request failed: %v: %s", res, bodyArr)
+		err := newMDMHTTPError(messageType(i), res, bodyArr)
+		c.Device.recordMetric(messageType(i), started, err)
+		return nil, err
 	}
+	c.Device.recordMetric(messageType(i), started, nil)
 
-	return nil
+	return bodyArr, nil
 }
 
 func (c *MDMClient) TokenUpdate(addl string) error {
+	topic, err := c.topic()
+	if err != nil {
+		return err
+	}
+	if len(c.Device.PushToken) == 0 || c.Device.PushMagic == "" {
+		// devices created before push credentials were generated
+		if err := c.Device.setPushCredentials(rand.Reader); err != nil {
+			return err
+		}
+		if err := c.Device.Save(); err != nil {
+			return err
+		}
+	}
+	if len(c.Device.UnlockToken) == 0 && !c.Device.isMac() && c.Device.EnrollmentID == "" {
+		// only iOS and iPadOS device enrollments report an unlock token
+		unlockToken := make([]byte, 32)
+		if _, err := rand.Read(unlockToken); err != nil {
+			return err
+		}
+		c.Device.UnlockToken = unlockToken
+		if err := c.Device.Save(); err != nil {
+			return err
+		}
+	}
+	token, magic := c.Device.PushToken, c.Device.PushMagic
+	if addl != "" {
+		// simulate changed push credentials
+		sum := sha256.Sum256(append(append([]byte{}, token...), addl...))
+		token = sum[:]
+		magic += addl
+	}
 	tu := &TokenUpdateRequest{
 		MessageType: "TokenUpdate",
-		PushMagic:   "fakePushMagic" + addl,
-		Token:       []byte("fakeToken" + addl),
-		Topic:       c.MDMPayload.Topic,
+		// ADE enrolling devices report this until DeviceConfigured
+		AwaitingConfiguration: c.Device.AwaitingConfiguration,
+		PushMagic:             magic,
+		Token:                 token,
+		Topic:                 topic,
+		UDID:                  c.Device.UDID,
+		UnlockToken:           c.Device.UnlockToken,
+	}
+	if c.Device.EnrollmentID != "" {
+		tu.UDID = ""
+		tu.UnlockToken = nil
+		tu.EnrollmentID = c.Device.EnrollmentID
+		tu.EnrollmentUserID = c.Device.EnrollmentUserID
+	}
+	if err := c.checkinRequest(tu); err != nil {
+		return err
+	}
+	if addl == "" {
+		return nil
+	}
+	// the server may push to any token the device has reported
+	if c.Device.AdditionalPushTokens == nil {
+		c.Device.AdditionalPushTokens = make(map[string]string)
+	}
+	c.Device.AdditionalPushTokens[hex.EncodeToString(token)] = magic
+	return c.Device.Save()
+}
+
+type CheckOutRequest struct {
+	EnrollmentID string `plist:",omitempty"` // macOS 10.15 and iOS 13.0 and later
+	MessageType  string
+	Topic        string
+	UDID         string `plist:",omitempty"`
+}
+
+// CheckOut notifies the MDM server that the device is unenrolling
+func (c *MDMClient) CheckOut() error {
+	topic, err := c.topic()
+	if err != nil {
+		return err
+	}
+	co := &CheckOutRequest{
+		MessageType: "CheckOut",
+		Topic:       topic,
 		UDID:        c.Device.UDID,
 	}
-	return c.checkinRequest(tu)
+	if c.Device.EnrollmentID != "" {
+		co.UDID = ""
+		co.EnrollmentID = c.Device.EnrollmentID
+	}
+	return c.checkinRequest(co)
 }
 
 type ConnectResponseCommand struct {
@@ -187,15 +350,144 @@ type ConnectResponse struct {
 	CommandUUID string
 }
 
+// parseConnectResponse parses the command in a Connect response. If the
+// command is structurally invalid malformed describes why and resp has
+// whatever RequestType and CommandUUID could be parsed.
+func parseConnectResponse(b []byte) (resp *ConnectResponse, malformed string) {
+	resp = &ConnectResponse{}
+	if err := plist.Unmarshal(b, resp); err != nil {
+		// salvage the CommandUUID to echo back if only Command is invalid
+		var uuidOnly struct{ CommandUUID string }
+		if plist.Unmarshal(b, &uuidOnly) == nil {
+			resp.CommandUUID = uuidOnly.CommandUUID
+		}
+		return resp, err.Error()
+	}
+	switch {
+	case resp.CommandUUID == "":
+		return resp, "missing CommandUUID"
+	case resp.Command.RequestType == "":
+		return resp, "missing RequestType"
+	}
+	return resp, ""
+}
+
+// ServerBusyError is returned when the MDM server responds with 503
+// Service Unavailable. RetryAfter is from the Retry-After header, if any.
+type ServerBusyError struct {
+	RetryAfter time.Duration
+}
+
+func (e *ServerBusyError) Error() string {
+	if e.RetryAfter > 0 {
+		return fmt.Sprintf("MDM server busy: retry after %s", e.RetryAfter)
+	}
+	return "MDM server busy"
+}
+
+// maxErrorBodyLen limits how much of a response body an MDMHTTPError keeps
+const maxErrorBodyLen = 1024
+
+// MDMHTTPError is returned when the MDM server responds to a check-in or
+// Connect request with an unexpected HTTP status
+type MDMHTTPError struct {
+	// MessageType is the check-in MessageType or "Connect"
+	MessageType string
+	StatusCode  int
+	// Body is the (possibly truncated) response body
+	Body []byte
+}
+
+func newMDMHTTPError(messageType string, res *http.Response, body []byte) *MDMHTTPError {
+	if len(body) > maxErrorBodyLen {
+		body = body[:maxErrorBodyLen]
+	}
+	return &MDMHTTPError{MessageType: messageType, StatusCode: res.StatusCode, Body: body}
+}
+
+func (e *MDMHTTPError) Error() string {
+	msg := fmt.Sprintf("%s request failed with HTTP status: %d %s", e.MessageType, e.StatusCode, http.StatusText(e.StatusCode))
+	if body := strings.TrimSpace(string(e.Body)); body != "" {
+		msg += ": " + body
+	}
+	return msg
+}
+
+// messageType returns the MessageType field of a check-in message
+func messageType(i interface{}) string {
+	v := reflect.Indirect(reflect.ValueOf(i))
+	if v.Kind() == reflect.Struct {
+		if f := v.FieldByName("MessageType"); f.Kind() == reflect.String {
+			return f.String()
+		}
+	}
+	return "check-in"
+}
+
+// parseRetryAfter parses a Retry-After header value of either delay
+// seconds or an HTTP date
+func parseRetryAfter(s string) time.Duration {
+	if secs, err := strconv.Atoi(s); err == nil && secs > 0 {
+		return time.Duration(secs) * time.Second
+	}
+	if t, err := http.ParseTime(s); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+// pendingReport is a Connect report saved by an interrupted session to
+// send again as is
+type pendingReport []byte
+
+// Connect runs an MDM Connect session: it reports Idle (or the pending
+// result of a command from an interrupted session) then processes and
+// responds to commands until the server has no more to send.
 func (c *MDMClient) Connect() error {
+	if c.Device.Erased {
+		if c.enrolled() {
+			// EraseDevice was acknowledged but the erase didn't finish
+			if err := c.erase(); err != nil {
+				return err
+			}
+		}
+		return errors.New("device erased")
+	}
+	if !c.Device.SkipValidate {
+		if err := c.Device.Validate(); err != nil {
+			return fmt.Errorf("device validation: %w", err)
+		}
+	}
+	appsChanged := c.Device.advanceAppInstalls(c.FailApps)
+	if c.Device.advanceOSUpdates() || appsChanged {
+		if err := c.Device.Save(); err != nil {
+			return err
+		}
+	}
+	client := c.newClient()
+	if len(c.Device.PendingReport) > 0 {
+		level.Info(c.Device.logger()).Log("msg", "resending pending command result", "command_uuid", c.Device.LastCommandUUID)
+		return c.connect(client, pendingReport(c.Device.PendingReport))
+	}
 	req := &ConnectRequest{
 		UDID:   c.Device.UDID,
 		Status: "Idle",
 	}
-	client := c.newClient()
 	return c.connect(client, req)
 }
 
+// ConnectReport sends a single raw (plist) report to the MDM server
+// Connect endpoint and returns the raw command the server responds with.
+// A nil command means the server has no more commands.
+func (c *MDMClient) ConnectReport(report []byte) ([]byte, error) {
+	if !c.enrolled() {
+		return nil, errors.New("device not enrolled")
+	}
+	return c.connectReport(c.newClient(), "Connect-report", report)
+}
+
 func httpRequestBytes(client *http.Client, req *http.Request) (bytes []byte, res *http.Response, err error) {
 	res, err = client.Do(req)
 	if err != nil {
@@ -206,83 +498,158 @@ func httpRequestBytes(client *http.Client, req *http.Request) (bytes []byte, res
 	return
 }
 
-func (c *MDMClient) connect(client *http.Client, connReq interface{}) error {
-	if !c.enrolled() {
-		return errors.New("device not enrolled")
+// connectReport sends report to the Connect endpoint. label names the
+// report when recording.
+func (c *MDMClient) connectReport(client *http.Client, label string, report []byte) ([]byte, error) {
+	if commandQueueDir != "" {
+		return c.queueConnectReport(report)
 	}
-
-	plistBytes, err := plist.Marshal(connReq)
+	req, err := c.newMDMRequest(c.MDMPayload.ServerURL, "application/x-apple-aspen-mdm", report)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	mdmSig, err := c.mdmP7Sign(plistBytes)
+	rec := c.recordRequest(label, report)
+	respBytes, res, err := httpRequestBytes(client, req)
 	if err != nil {
-		return err
+		rec.error(err)
+		return nil, err
 	}
+	rec.response(res.StatusCode, respBytes)
 
-	req, err := http.NewRequest("PUT", c.MDMPayload.ServerURL, bytes.NewReader(plistBytes))
-	if err != nil {
-		return err
-	}
-	if mdmSig != "" {
-		req.Header.Set("Mdm-Signature", mdmSig)
-	}
-
-	respBytes, res, err := httpRequestBytes(client, req)
-	if err != nil {
-		return err
+	if res.StatusCode == http.StatusServiceUnavailable {
+		return nil, &ServerBusyError{RetryAfter: parseRetryAfter(res.Header.Get("Retry-After"))}
 	}
 
 	if res.StatusCode != 200 {
-		return fmt.Errorf("Connect Request failed with HTTP status: %d", res.StatusCode)
+		return nil, newMDMHTTPError("Connect", res, respBytes)
 	}
 
 	if len(respBytes) == 0 {
-		// HACK: return nil
-		return fmt.Errorf("connect Request failed with empty body: %v", res)
+		return nil, nil
 	}
 
-	resp := &ConnectResponse{}
-	err = plist.Unmarshal(respBytes, &resp)
-	if err != nil {
-		return err
+	return respBytes, nil
+}
+
+// connect runs a Connect session starting with connReq. As on real
+// devices each later report is the response to the command received for
+// the previous one, correlated by CommandUUID, so command results are
+// reported with the next poll rather than separately.
+func (c *MDMClient) connect(client *http.Client, connReq interface{}) error {
+	if !c.enrolled() {
+		return errors.New("device not enrolled")
 	}
 
-	nextConnReq, err := c.handleMDMCommand(resp.Command.RequestType, resp.CommandUUID, respBytes)
-	if err != nil {
-		log.Println(err)
-		nextConnReq = &ConnectRequest{
-			UDID:        c.Device.UDID,
-			CommandUUID: resp.CommandUUID,
-			RequestType: resp.Command.RequestType,
-			Status:      "Error",
-			ErrorChain: []ErrorChain{
-				{
-					ErrorCode:            99998,
-					ErrorDomain:          "mdmb-handle-mdm-command",
-					LocalizedDescription: "Error handling MDM command",
-				},
-			},
+	// commands we've responded NotNow to this session. the server
+	// sending one again means it's waiting on us so we stop.
+	notNowUUIDs := make(map[string]bool)
+	// malformed commands we've responded CommandFormatError to this
+	// session by their body, as they may have no CommandUUID
+	formatErrors := make(map[string]bool)
+	// the RequestType connReq responds to
+	var reqType string
+
+	for {
+		if c.Device.EnrollmentID != "" {
+			if r, ok := connReq.(interface{ setEnrollmentID(string) }); ok {
+				r.setEnrollmentID(c.Device.EnrollmentID)
+			}
+		}
+		var plistBytes []byte
+		var err error
+		if r, ok := connReq.(pendingReport); ok {
+			plistBytes = r
+		} else {
+			plistBytes, err = plist.Marshal(connReq)
+			if err != nil {
+				return err
+			}
+		}
+		if reqType != "" {
+			// keep the result until the server has it
+			c.Device.PendingReport = plistBytes
+			if err := c.Device.savePendingReport(); err != nil {
+				return err
+			}
 		}
-	}
 
-	if nextConnReq == nil {
-		fmt.Println("empty response from handling MDM command")
-		nextConnReq = &ConnectRequest{
-			UDID:        c.Device.UDID,
-			CommandUUID: resp.CommandUUID,
-			RequestType: resp.Command.RequestType,
-			Status:      "Error",
-			ErrorChain: []ErrorChain{
-				{
-					ErrorCode:            99999,
-					ErrorDomain:          "mdmb-handle-mdm-command",
-					LocalizedDescription: "Empty response from hanlding MDM command",
-				},
-			},
+		phase := "Connect"
+		if reqType != "" {
+			phase += "-" + reqType
+		}
+		started := time.Now()
+		respBytes, err := c.connectReport(client, connectLabel(reqType, connReq), plistBytes)
+		c.Device.recordMetric(phase, started, err)
+		if err != nil {
+			return err
+		}
+		if len(c.Device.PendingReport) > 0 {
+			c.Device.PendingReport = nil
+			if err := c.Device.savePendingReport(); err != nil {
+				return err
+			}
+		}
+
+		if c.Device.Erased {
+			// EraseDevice has been acknowledged
+			return c.erase()
+		}
+
+		if respBytes == nil {
+			// no more commands
+			return nil
+		}
+
+		resp, malformed := parseConnectResponse(respBytes)
+		if malformed != "" {
+			if formatErrors[string(respBytes)] {
+				// the server didn't take our CommandFormatError
+				level.Warn(c.Device.logger()).Log("msg", "malformed command resent, ending session", "command_uuid", resp.CommandUUID)
+				return nil
+			}
+			formatErrors[string(respBytes)] = true
+		} else if notNowUUIDs[resp.CommandUUID] {
+			return nil
+		}
+
+		var nextConnReq interface{}
+		if malformed != "" {
+			level.Warn(c.Device.logger()).Log("msg", "malformed command received", "request_type", resp.Command.RequestType, "command_uuid", resp.CommandUUID, "err", malformed)
+			nextConnReq = c.commandFormatError(resp.Command.RequestType, resp.CommandUUID)
+		} else {
+			level.Info(c.Device.logger()).Log("msg", "command received", "request_type", resp.Command.RequestType, "command_uuid", resp.CommandUUID)
+			c.Device.LastCommandUUID = resp.CommandUUID
+			nextConnReq, err = c.handleMDMCommand(resp.Command.RequestType, resp.CommandUUID, respBytes)
+		}
+		if err != nil {
+			level.Error(c.Device.logger()).Log("msg", "handling MDM command", "request_type", resp.Command.RequestType, "command_uuid", resp.CommandUUID, "err", err)
+			// the chain describes the error instead of a bare status
+			nextConnReq = c.errorChainResponse(resp.Command.RequestType, resp.CommandUUID, MDMErrorChain{}.AddError(err))
 		}
-	}
 
-	return c.connect(client, nextConnReq)
+		if nextConnReq == nil {
+			level.Error(c.Device.logger()).Log("msg", "empty response from handling MDM command", "request_type", resp.Command.RequestType, "command_uuid", resp.CommandUUID)
+			nextConnReq = c.errorResponse(resp.Command.RequestType, resp.CommandUUID, 99999, mdmbErrorDomain, "Empty response from hanlding MDM command")
+		}
+
+		if r, ok := nextConnReq.(interface{ respondTo(string, string) }); ok {
+			r.respondTo(resp.Command.RequestType, resp.CommandUUID)
+		}
+
+		c.reportCommandResult(resp.Command.RequestType, resp.CommandUUID, nextConnReq)
+
+		if c.Device.MDMProfileIdentifier == "" || c.MDMPayload == nil {
+			// the command unenrolled us (e.g. removed the MDM profile)
+			// so there's no one to send the response to
+			return nil
+		}
+
+		if cr, ok := nextConnReq.(interface{ connectStatus() string }); ok && cr.connectStatus() == "NotNow" {
+			notNowUUIDs[resp.CommandUUID] = true
+		}
+
+		connReq = nextConnReq
+		reqType = resp.Command.RequestType
+	}
 }
@@ -0,0 +1,452 @@
+package device
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+	"github.com/jessepeterson/mdmb/testutil"
+	"go.mozilla.org/pkcs7"
+)
+
+const testTopic = "com.apple.mgmt.External.mdmb-test"
+
+// enrollTestDevice enrolls a new device in a fake MDM server
+// newTestDevice creates a device named test in db
+func newTestDevice(t testing.TB, db Store) *Device {
+	t.Helper()
+	device, err := New("test", db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+func enrollTestDevice(t *testing.T) (*Device, *testutil.MDMServer) {
+	t.Helper()
+	device := newTestDevice(t, NewMemoryStore())
+	return device, enrollDevice(t, device)
+}
+
+// enrollDevice enrolls device in a fake MDM server
+func enrollDevice(t *testing.T, device *Device) *testutil.MDMServer {
+	t.Helper()
+	srv := testutil.NewMDMServer()
+	t.Cleanup(srv.Close)
+	srv.RequireSignature = true
+	pb, err := srv.EnrollmentProfile(testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.InstallProfile(pb); err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+// testConnect runs a Connect session for an enrolled device
+func testConnect(t *testing.T, device *Device) {
+	t.Helper()
+	c, err := device.MDMClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Connect(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestEnrollAndConnect(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+
+	var types []string
+	for _, msg := range srv.CheckinMessages() {
+		types = append(types, msg.MessageType)
+		if msg.UDID != device.UDID {
+			t.Errorf("%s: have UDID %q, want %q", msg.MessageType, msg.UDID, device.UDID)
+		}
+		if msg.Signer == nil {
+			t.Errorf("%s: no Mdm-Signature", msg.MessageType)
+		}
+	}
+	if len(types) < 2 || types[0] != "Authenticate" || types[1] != "TokenUpdate" {
+		t.Fatalf("check-in messages: have %v, want Authenticate, TokenUpdate first", types)
+	}
+
+	cert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmdUUID, err := srv.Enqueue(device.UDID, "DeviceInformation", map[string]interface{}{
+		"Queries": []string{"SerialNumber"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConnect(t, device)
+
+	report := srv.Report(cmdUUID)
+	if report == nil {
+		t.Fatal("no report for queued command")
+	}
+	if report.Status != "Acknowledged" {
+		t.Errorf("status: have %q, want Acknowledged", report.Status)
+	}
+	if report.Signer == nil || !report.Signer.Equal(cert) {
+		t.Error("report not signed by the device identity")
+	}
+	if n := srv.Queued(device.UDID); n != 0 {
+		t.Errorf("have %d commands still queued, want 0", n)
+	}
+}
+
+func TestConnectReportsPreviousResult(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	first, err := srv.Enqueue(device.UDID, "ProfileList", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := srv.Enqueue(device.UDID, "DeviceInformation", map[string]interface{}{
+		"Queries": []string{"UDID"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConnect(t, device)
+
+	reports := srv.Reports()
+	if len(reports) != 3 {
+		t.Fatalf("have %d reports, want 3 (Idle and one per command)", len(reports))
+	}
+	if reports[0].Status != "Idle" || reports[0].CommandUUID != "" {
+		t.Errorf("first POST: have status %q command %q, want an Idle report", reports[0].Status, reports[0].CommandUUID)
+	}
+	// the POST that fetched the second command carries the first's result
+	for i, want := range []string{first, second} {
+		r := reports[i+1]
+		if r.CommandUUID != want || r.Status != "Acknowledged" {
+			t.Errorf("POST %d: have status %q command %q, want Acknowledged %q", i+2, r.Status, r.CommandUUID, want)
+		}
+	}
+}
+
+func TestCheckinDeviceFields(t *testing.T) {
+	device := newTestDevice(t, NewMemoryStore())
+	device.Platform = PlatformIOS
+	device.ProductName = "iPhone14,2"
+	device.OSVersion = "16.3.1"
+	device.BuildVersion = "20D67"
+	srv := enrollDevice(t, device)
+
+	msgs := map[string]map[string]interface{}{}
+	for _, msg := range srv.CheckinMessages() {
+		var body map[string]interface{}
+		if err := plist.Unmarshal(msg.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		msgs[msg.MessageType] = body
+	}
+	for key, want := range map[string]string{
+		"Model":        "iPhone",
+		"ModelName":    "iPhone",
+		"ProductName":  "iPhone14,2",
+		"OSVersion":    "16.3.1",
+		"BuildVersion": "20D67",
+		"SerialNumber": device.Serial,
+	} {
+		if have := msgs["Authenticate"][key]; have != want {
+			t.Errorf("Authenticate %s: have %v, want %q", key, have, want)
+		}
+	}
+	unlockToken, _ := msgs["TokenUpdate"]["UnlockToken"].([]byte)
+	if len(unlockToken) == 0 || !bytes.Equal(unlockToken, device.UnlockToken) {
+		t.Fatalf("TokenUpdate UnlockToken: have %x, want the device's %x", unlockToken, device.UnlockToken)
+	}
+
+	device.Locked = true
+	for _, test := range []struct {
+		unlockToken []byte
+		status      string
+		locked      bool
+	}{
+		{[]byte("wrong"), "Error", true},
+		{unlockToken, "Acknowledged", false},
+	} {
+		cmdUUID, err := srv.Enqueue(device.UDID, "ClearPasscode", map[string]interface{}{
+			"UnlockToken": test.unlockToken,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		testConnect(t, device)
+		if report := srv.Report(cmdUUID); report == nil || report.Status != test.status {
+			t.Errorf("ClearPasscode %q: have report %+v, want status %s", test.unlockToken, report, test.status)
+		}
+		if device.Locked != test.locked {
+			t.Errorf("ClearPasscode %q: have locked %v, want %v", test.unlockToken, device.Locked, test.locked)
+		}
+	}
+}
+
+func TestTokenUpdateAdditionalPushTokens(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	c, err := device.MDMClient()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.TokenUpdate("1"); err != nil {
+		t.Fatal(err)
+	}
+	msgs := srv.CheckinMessages()
+	var body struct {
+		Token     []byte
+		PushMagic string
+	}
+	if err := plist.Unmarshal(msgs[len(msgs)-1].Body, &body); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(body.Token, device.PushToken) {
+		t.Fatal("want a different push token with additional text")
+	}
+	loaded, err := Load(device.UDID, device.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{hex.EncodeToString(body.Token): body.PushMagic}
+	if !reflect.DeepEqual(loaded.AdditionalPushTokens, want) {
+		t.Errorf("have additional push tokens %v, want %v", loaded.AdditionalPushTokens, want)
+	}
+}
+
+func TestUserEnrollment(t *testing.T) {
+	device, srv, _ := enrollSCEPTestDevice(t, NewMemoryStore(), &InstallOptions{UserEnrollment: true})
+	if device.EnrollmentID == "" || device.EnrollmentUserID == "" {
+		t.Fatalf("have EnrollmentID %q EnrollmentUserID %q, want both set", device.EnrollmentID, device.EnrollmentUserID)
+	}
+	for _, msg := range srv.CheckinMessages() {
+		var body struct {
+			UDID             string
+			SerialNumber     string
+			EnrollmentID     string
+			EnrollmentUserID string
+		}
+		if err := plist.Unmarshal(msg.Body, &body); err != nil {
+			t.Fatal(err)
+		}
+		if body.UDID != "" || body.SerialNumber != "" {
+			t.Errorf("%s: have UDID %q serial %q, want no hardware identifiers", msg.MessageType, body.UDID, body.SerialNumber)
+		}
+		if body.EnrollmentID != device.EnrollmentID || body.EnrollmentUserID != device.EnrollmentUserID {
+			t.Errorf("%s: have EnrollmentID %q EnrollmentUserID %q, want %q %q", msg.MessageType, body.EnrollmentID, body.EnrollmentUserID, device.EnrollmentID, device.EnrollmentUserID)
+		}
+	}
+	// the SCEP identity is requested for the enrollment
+	cert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Subject.CommonName != device.EnrollmentID {
+		t.Errorf("have MDM identity CN %q, want the EnrollmentID %q", cert.Subject.CommonName, device.EnrollmentID)
+	}
+}
+
+func TestCertificateListManagedOnly(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	certProfile := func(id string) ([]byte, *x509.Certificate) {
+		_, cert, err := selfSign(time.Now(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return testProfile(t, id, map[string]interface{}{
+			"PayloadType":       "com.apple.security.pkcs1",
+			"PayloadVersion":    1,
+			"PayloadIdentifier": id + ".cert",
+			"PayloadUUID":       id + "-CERT",
+			"PayloadContent":    cert.Raw,
+		}), cert
+	}
+	localPB, localCert := certProfile("com.example.local")
+	if err := device.InstallProfile(localPB); err != nil {
+		t.Fatal(err)
+	}
+	managedPB, managedCert := certProfile("com.example.managed")
+	if _, err := srv.Enqueue(device.UDID, "InstallProfile", map[string]interface{}{"Payload": managedPB}); err != nil {
+		t.Fatal(err)
+	}
+	cmdUUID, err := srv.Enqueue(device.UDID, "CertificateList", map[string]interface{}{"ManagedOnly": true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConnect(t, device)
+
+	report := srv.Report(cmdUUID)
+	if report == nil {
+		t.Fatal("no report for CertificateList")
+	}
+	resp := &CertificateListResponse{}
+	if err := plist.Unmarshal(report.Body, resp); err != nil {
+		t.Fatal(err)
+	}
+	listed := func(cert *x509.Certificate) bool {
+		for _, item := range resp.CertificateList {
+			if bytes.Equal(item.Data, cert.Raw) {
+				return true
+			}
+		}
+		return false
+	}
+	mdmCert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !listed(mdmCert) || !listed(managedCert) {
+		t.Errorf("have %d certificates, want the MDM identity and the managed certificate payload", len(resp.CertificateList))
+	}
+	if listed(localCert) {
+		t.Error("certificate payload of an unmanaged profile listed")
+	}
+
+	if err := device.RemoveProfile("com.example.managed"); err != nil {
+		t.Fatal(err)
+	}
+	count, _, err := device.KeychainGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := LoadKeychainItems(device.SystemKeychain(), ClassCertificate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the MDM identity's and the unmanaged profile's
+	if count != 0 || len(items) != 2 {
+		t.Errorf("have %d certificates (%d unreferenced) after removal, want 2 (0)", len(items), count)
+	}
+}
+
+func TestInstallApplicationManagedAppBundleID(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	cmdUUID, err := srv.Enqueue(device.UDID, "InstallApplication", map[string]interface{}{
+		"ManagedAppBundleID": "com.example.app",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConnect(t, device)
+	report := srv.Report(cmdUUID)
+	if report == nil || report.Status != "Acknowledged" {
+		t.Fatalf("have report %+v, want Acknowledged", report)
+	}
+	resp := &InstallApplicationResponse{}
+	if err := plist.Unmarshal(report.Body, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.ManagedAppBundleID != "com.example.app" || resp.Identifier != "com.example.app" || resp.State != AppStatusQueued {
+		t.Errorf("have response %+v, want com.example.app Queued", resp)
+	}
+}
+
+func TestMDMP7Sign(t *testing.T) {
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &MDMClient{
+		MDMPayload:          &cfgprofiles.MDMPayload{},
+		IdentityCertificate: cert,
+		IdentityPrivateKey:  key,
+	}
+	body := []byte("check-in body")
+	if sig, err := c.mdmP7Sign(body); err != nil || sig != "" {
+		t.Errorf("without SignMessage: have %q, %v, want no signature", sig, err)
+	}
+
+	c.MDMPayload.SignMessage = true
+	sig, err := c.mdmP7Sign(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := base64.StdEncoding.DecodeString(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p7.Content) != 0 {
+		t.Error("signature is not detached")
+	}
+	p7.Content = body
+	if err := p7.Verify(); err != nil {
+		t.Error(err)
+	}
+	if signer := p7.GetOnlySigner(); signer == nil || !signer.Equal(cert) {
+		t.Error("not signed by the identity certificate")
+	}
+}
+
+// BenchmarkEnrollConcurrent enrolls 100 devices concurrently in each
+// store and checks every device's enrollment was saved
+func BenchmarkEnrollConcurrent(b *testing.B) {
+	const devices = 100
+	srv := testutil.NewMDMServer()
+	defer srv.Close()
+	pb, err := srv.EnrollmentProfile(testTopic)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for name, db := range testStores(b) {
+		b.Run(name, func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				udids := make([]string, devices)
+				errs := make(chan error, devices)
+				var wg sync.WaitGroup
+				for j := range udids {
+					device, err := New(fmt.Sprintf("bench-%d", j), db)
+					if err != nil {
+						b.Fatal(err)
+					}
+					udids[j] = device.UDID
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						if err := device.Save(); err != nil {
+							errs <- err
+							return
+						}
+						errs <- device.InstallProfile(pb)
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.StopTimer()
+				for _, udid := range udids {
+					device, err := Load(udid, db)
+					if err != nil {
+						b.Fatal(err)
+					}
+					if _, _, err := device.MDMIdentity(); err != nil {
+						b.Fatalf("%s: lost enrollment: %v", udid, err)
+					}
+				}
+				b.StartTimer()
+			}
+		})
+	}
+}
@@ -1,10 +1,15 @@
 package device
 
 import (
+	"crypto"
 	"crypto/rsa"
 	"crypto/x509"
+	"encoding/asn1"
 	"errors"
+	"fmt"
+	"strings"
 
+	"github.com/go-kit/kit/log/level"
 	"github.com/jessepeterson/cfgprofiles"
 )
 
@@ -15,7 +20,21 @@ type MDMClient struct {
 	IdentityCertificate *x509.Certificate
 	IdentityPrivateKey  *rsa.PrivateKey
 
-	notNow bool
+	// CommandResultFunc is called, if set, for each command response
+	// the client reports back to the MDM server
+	CommandResultFunc func(requestType, commandUUID, status string)
+
+	// NotNow, if set, answers commands NotNow for some Connect sessions
+	NotNow *NotNowPolicy
+	// FailApps are the identifiers of apps whose installs fail
+	FailApps []string
+
+	// serverCapabilities are the ServerCapabilities of MDMPayload
+	serverCapabilities map[string]bool
+
+	// queueCommand is the file name of the queued command last delivered
+	// (see SetCommandQueueDir)
+	queueCommand string
 }
 
 func (c *MDMClient) loadIdentityFromKeychain(uuid string) error {
@@ -42,12 +61,6 @@ func (c *MDMClient) loadIdentityFromKeychain(uuid string) error {
 	return nil
 }
 
-func newMDMClientUsingPayload(device *Device, mdmPld *cfgprofiles.MDMPayload) (*MDMClient, error) {
-	c := &MDMClient{Device: device, MDMPayload: mdmPld}
-	err := c.loadIdentityFromKeychain(device.MDMIdentityKeychainUUID)
-	return c, err
-}
-
 func (c *MDMClient) loadMDMPayload(profileID string) error {
 	if profileID == "" {
 		return errors.New("no MDM profile installed on device")
@@ -60,12 +73,18 @@ func (c *MDMClient) loadMDMPayload(profileID string) error {
 	if len(mdmPlds) != 1 {
 		return errors.New("enrollment profile must contain one MDM payload")
 	}
-	c.MDMPayload = mdmPlds[0]
+	c.setMDMPayload(mdmPlds[0])
+	applyMDMEnvOverrides(c.MDMPayload)
 	return nil
 }
 
-func newMDMClient(device *Device) (*MDMClient, error) {
+// newMDMClient creates an MDM client with the device's MDM identity. When
+// enrolling mdmPld is the MDM payload being installed. Otherwise (nil) the
+// MDM payload is loaded from the installed MDM profile and the device must
+// be enrolled.
+func newMDMClient(device *Device, mdmPld *cfgprofiles.MDMPayload) (*MDMClient, error) {
 	c := &MDMClient{Device: device}
+	c.setMDMPayload(mdmPld)
 	if device.MDMIdentityKeychainUUID == "" {
 		return c, errors.New("device not enrolled (no identity uuid)")
 	}
@@ -73,6 +92,9 @@ func newMDMClient(device *Device) (*MDMClient, error) {
 	if err != nil {
 		return c, err
 	}
+	if mdmPld != nil {
+		return c, nil
+	}
 	err = c.loadMDMPayload(device.MDMProfileIdentifier)
 	if err != nil {
 		return c, err
@@ -83,12 +105,51 @@ func newMDMClient(device *Device) (*MDMClient, error) {
 	return c, nil
 }
 
+// oidUserID is the LDAP UID attribute which carries the APNs topic in
+// MDM push certificate subjects
+var oidUserID = asn1.ObjectIdentifier{0, 9, 2342, 19200300, 100, 1, 1}
+
+// mdmTopicPrefix is the namespace of MDM APNs topics
+const mdmTopicPrefix = "com.apple.mgmt."
+
+// topic resolves the APNs topic sent in check-in messages from the MDM
+// payload or, failing that, a UID attribute of the identity certificate
+// subject in the MDM topic namespace. Identity certificates often have
+// other UIDs (e.g. the device UDID) which aren't topics.
+func (c *MDMClient) topic() (string, error) {
+	if c.MDMPayload != nil && c.MDMPayload.Topic != "" {
+		return c.MDMPayload.Topic, nil
+	}
+	if c.IdentityCertificate != nil {
+		for _, atv := range c.IdentityCertificate.Subject.Names {
+			if !atv.Type.Equal(oidUserID) {
+				continue
+			}
+			if s, ok := atv.Value.(string); ok && strings.HasPrefix(s, mdmTopicPrefix) {
+				return s, nil
+			}
+		}
+	}
+	return "", errors.New("no APNs topic available: MDM payload has no Topic and identity certificate subject has no " + mdmTopicPrefix + " UID")
+}
+
 func (c *MDMClient) enroll(profileID string) error {
 	if c.MDMPayload == nil {
 		return errors.New("no MDM payload")
 	}
+	level.Info(c.Device.logger()).Log("msg", "enrolling", "profile", profileID, "server_url", c.MDMPayload.ServerURL)
 
-	err := c.authenticate()
+	topic, err := c.topic()
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(topic, mdmTopicPrefix) {
+		// servers validating the topic against their push certificate
+		// will likely reject the enrollment
+		level.Warn(c.Device.logger()).Log("msg", "APNs topic not in the MDM topic namespace", "topic", topic)
+	}
+
+	err = c.authenticate()
 	if err != nil {
 		return err
 	}
@@ -98,6 +159,17 @@ func (c *MDMClient) enroll(profileID string) error {
 		return err
 	}
 
+	err = c.userTokenUpdate()
+	if err != nil {
+		return err
+	}
+
+	// many servers don't support bootstrap tokens so only report failure
+	err = c.escrowBootstrapToken()
+	if err != nil {
+		level.Warn(c.Device.logger()).Log("msg", "SetBootstrapToken failed", "err", err)
+	}
+
 	c.Device.MDMProfileIdentifier = profileID
 	return nil
 }
@@ -106,9 +178,15 @@ func (c *MDMClient) unenroll() error {
 	// c.MDMPayload.CheckOutWhenRemoved
 	c.IdentityPrivateKey = nil
 	c.IdentityCertificate = nil
-	c.MDMPayload = nil
+	c.setMDMPayload(nil)
 	c.Device.MDMProfileIdentifier = ""
 	c.Device.MDMIdentityKeychainUUID = ""
+	c.Device.EnrollmentID = ""
+	c.Device.EnrollmentUserID = ""
+	c.Device.LastCommandUUID = ""
+	c.Device.PendingReport = nil
+	c.Device.NotNowCounts = nil
+	c.Device.AdditionalPushTokens = nil
 	return nil
 }
 
@@ -128,10 +206,81 @@ func (c *MDMClient) enrolled() bool {
 	return true
 }
 
+// MDMIdentity loads the device's MDM identity certificate and key from the keychain
+func (device *Device) MDMIdentity() (*x509.Certificate, *rsa.PrivateKey, error) {
+	if device.MDMIdentityKeychainUUID == "" {
+		return nil, nil, errors.New("device not enrolled (no identity uuid)")
+	}
+	c := &MDMClient{Device: device}
+	err := c.loadIdentityFromKeychain(device.MDMIdentityKeychainUUID)
+	return c.IdentityCertificate, c.IdentityPrivateKey, err
+}
+
+// SetEnrollmentState marks the device as enrolled via the installed
+// profile profileID using the given identity, without any network
+// enrollment. It is intended for building test fixtures; the profile
+// itself must already be in the device's profile store for Connects.
+func (device *Device) SetEnrollmentState(profileID string, key crypto.Signer, cert *x509.Certificate) error {
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return errors.New("only RSA identity keys supported")
+	}
+	if cert == nil {
+		return errors.New("no identity certificate")
+	}
+	if !identityKeyMatches(cert, rsaKey) {
+		return errors.New("identity key does not match certificate")
+	}
+	idUUID, err := device.SystemKeychain().saveIdentity(rsaKey, cert)
+	if err != nil {
+		return err
+	}
+	device.MDMIdentityKeychainUUID = idUUID
+	device.MDMProfileIdentifier = profileID
+	device.mdmClient = nil
+	return device.Save()
+}
+
+// identityKeyMatches reports whether key is the private key of cert
+func identityKeyMatches(cert *x509.Certificate, key *rsa.PrivateKey) bool {
+	pub, ok := cert.PublicKey.(*rsa.PublicKey)
+	return ok && pub.N.Cmp(key.N) == 0 && pub.E == key.E
+}
+
+// Validate checks the integrity of the device's enrollment state: that
+// the MDM identity exists and its key matches its certificate, that the
+// enrollment profile loads, that an APNs topic is available, and that the
+// push token and push magic are set.
+func (device *Device) Validate() error {
+	cert, key, err := device.MDMIdentity()
+	if err != nil {
+		return fmt.Errorf("MDM identity: %w", err)
+	}
+	if cert == nil || key == nil {
+		return errors.New("MDM identity missing key or certificate")
+	}
+	if !identityKeyMatches(cert, key) {
+		return errors.New("MDM identity key does not match certificate")
+	}
+	c := &MDMClient{Device: device, IdentityCertificate: cert, IdentityPrivateKey: key}
+	err = c.loadMDMPayload(device.MDMProfileIdentifier)
+	if err != nil {
+		return fmt.Errorf("MDM enrollment profile: %w", err)
+	}
+	_, err = c.topic()
+	if err != nil {
+		return err
+	}
+	if len(device.PushToken) == 0 || device.PushMagic == "" {
+		return errors.New("push token or push magic not set")
+	}
+	return nil
+}
+
 func (device *Device) MDMClient() (*MDMClient, error) {
 	var err error
 	if device.mdmClient == nil {
-		device.mdmClient, err = newMDMClient(device)
+		device.mdmClient, err = newMDMClient(device, nil)
 	}
 	return device.mdmClient, err
 }
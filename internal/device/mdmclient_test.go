@@ -0,0 +1,79 @@
+package device
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+func TestNewMDMClient(t *testing.T) {
+	unenrolled := newTestDevice(t, NewMemoryStore())
+	if _, err := newMDMClient(unenrolled, nil); err == nil {
+		t.Error("unenrolled: want an error")
+	}
+
+	device, srv := enrollTestDevice(t)
+	cert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pld := &cfgprofiles.MDMPayload{ServerURL: "https://other.example.com/mdm"}
+	for _, test := range []struct {
+		name      string
+		pld       *cfgprofiles.MDMPayload
+		serverURL string
+	}{
+		{"installing", pld, pld.ServerURL},
+		{"installed", nil, srv.URL()},
+	} {
+		c, err := newMDMClient(device, test.pld)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if c.MDMPayload == nil || c.MDMPayload.ServerURL != test.serverURL {
+			t.Errorf("%s: have MDM payload %+v, want ServerURL %s", test.name, c.MDMPayload, test.serverURL)
+		}
+		if !c.IdentityCertificate.Equal(cert) || c.IdentityPrivateKey == nil {
+			t.Errorf("%s: identity not loaded", test.name)
+		}
+	}
+}
+
+func TestSetEnrollmentStateMismatchedIdentity(t *testing.T) {
+	key, _, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := newTestDevice(t, NewMemoryStore())
+	if err := device.SetEnrollmentState("com.example.mdm", key, cert); err == nil {
+		t.Fatal("want an error for a key not matching the certificate")
+	}
+	if device.MDMIdentityKeychainUUID != "" || device.MDMProfileIdentifier != "" {
+		t.Errorf("have identity %q, profile %q, want the device left unenrolled", device.MDMIdentityKeychainUUID, device.MDMProfileIdentifier)
+	}
+	if _, err := Load("test", device.store); err == nil {
+		t.Error("device was saved")
+	}
+}
+
+func TestValidatePushCredentials(t *testing.T) {
+	device, _ := enrollTestDevice(t)
+	if err := device.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	magic := device.PushMagic
+	device.PushMagic = ""
+	if err := device.Validate(); err == nil {
+		t.Error("no push magic: want an error")
+	}
+	device.PushMagic = magic
+	device.PushToken = nil
+	if err := device.Validate(); err == nil {
+		t.Error("no push token: want an error")
+	}
+}
@@ -0,0 +1,69 @@
+package device
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// mdmPayloadURL is an MDM payload URL and the name of its key
+type mdmPayloadURL struct {
+	key string
+	url string
+}
+
+// mdmPayloadURLs returns the URLs of an MDM payload. The CheckInURL is
+// optional as check-ins otherwise go to the ServerURL.
+func mdmPayloadURLs(pl *cfgprofiles.MDMPayload) []mdmPayloadURL {
+	urls := []mdmPayloadURL{{"ServerURL", pl.ServerURL}}
+	if pl.CheckInURL != "" && pl.CheckInURL != pl.ServerURL {
+		urls = append(urls, mdmPayloadURL{"CheckInURL", pl.CheckInURL})
+	}
+	return urls
+}
+
+// validateMDMPayloadURLs checks that the MDM payload's URLs are absolute
+// http or https URLs, before any (SCEP) payloads are installed, so that a
+// misconfigured profile fails with a clear error instead of an obscure
+// one at the first check-in
+func validateMDMPayloadURLs(pl *cfgprofiles.MDMPayload) error {
+	if pl.ServerURL == "" {
+		return errors.New("MDM payload has no ServerURL")
+	}
+	for _, u := range mdmPayloadURLs(pl) {
+		parsed, err := url.Parse(u.url)
+		if err != nil {
+			return fmt.Errorf("MDM payload %s: %w", u.key, err)
+		}
+		if parsed.Scheme != "https" && parsed.Scheme != "http" {
+			return fmt.Errorf("MDM payload %s %q: scheme must be http or https", u.key, u.url)
+		}
+		if parsed.Host == "" {
+			return fmt.Errorf("MDM payload %s %q: no host", u.key, u.url)
+		}
+	}
+	return nil
+}
+
+// preflightMDMPayloadURLs checks that the servers of the MDM payload's
+// URLs can be reached with a HEAD request. Any HTTP response will do: the
+// device has no identity to authenticate with yet.
+func (device *Device) preflightMDMPayloadURLs(pl *cfgprofiles.MDMPayload) error {
+	client := NewHTTPClient(&tls.Config{
+		// as in MDMClient.newClient
+		InsecureSkipVerify: httpOpts.RootCAs == nil,
+	})
+	for _, u := range mdmPayloadURLs(pl) {
+		resp, err := client.Head(u.url)
+		if err != nil {
+			return fmt.Errorf("MDM payload %s unreachable: %w", u.key, err)
+		}
+		resp.Body.Close()
+		level.Debug(device.logger()).Log("msg", "MDM server reachable", "key", u.key, "url", u.url, "status", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package device
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// MemoryDBPath is the database path that selects an in-memory Store
+const MemoryDBPath = ":memory:"
+
+var errTxReadOnly = errors.New("transaction is read-only")
+
+// MemoryStore is a Store that keeps everything in memory. Its contents
+// are lost when it's discarded, which suits tests and short-lived runs.
+// It is safe for concurrent use. Like bolt, it allows many readers or a
+// single writer at a time.
+type MemoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+// NewMemoryStore creates an empty MemoryStore
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+// View calls fn with a read-only transaction
+func (s *MemoryStore) View(fn func(tx Tx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memTx{s: s})
+}
+
+// Update calls fn with a read-write transaction. Writes are kept aside
+// and only applied once fn returns nil.
+func (s *MemoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := &memTx{s: s, writes: make(map[string]map[string][]byte)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	for bucket, writes := range tx.writes {
+		b := s.buckets[bucket]
+		if b == nil {
+			b = make(map[string][]byte)
+			s.buckets[bucket] = b
+		}
+		for k, v := range writes {
+			if v == nil {
+				delete(b, k)
+			} else {
+				b[k] = v
+			}
+		}
+	}
+	return nil
+}
+
+// memTx is a MemoryStore transaction. writes is nil for read-only
+// transactions and otherwise holds the uncommitted values by bucket and
+// key, with nil marking a deleted key.
+type memTx struct {
+	s      *MemoryStore
+	writes map[string]map[string][]byte
+}
+
+func (t *memTx) Get(bucket, key string) []byte {
+	if v, ok := t.writes[bucket][key]; ok {
+		return v
+	}
+	return t.s.buckets[bucket][key]
+}
+
+func (t *memTx) write(bucket, key string, value []byte) error {
+	if t.writes == nil {
+		return errTxReadOnly
+	}
+	if t.writes[bucket] == nil {
+		t.writes[bucket] = make(map[string][]byte)
+	}
+	t.writes[bucket][key] = value
+	return nil
+}
+
+func (t *memTx) Put(bucket, key string, value []byte) error {
+	// copy as the caller may reuse value; never nil, which marks deletes
+	return t.write(bucket, key, append([]byte{}, value...))
+}
+
+func (t *memTx) Delete(bucket, key string) error {
+	return t.write(bucket, key, nil)
+}
+
+func (t *memTx) KeysWithPrefix(bucket, prefix string) []string {
+	var keys []string
+	for k := range t.s.buckets[bucket] {
+		if _, written := t.writes[bucket][k]; !written && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	for k, v := range t.writes[bucket] {
+		if v != nil && strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,42 @@
+package device
+
+import "time"
+
+// MetricSample is the timing of one request (phase) of a device: a SCEP
+// certificate request, a check-in message, or a Connect request
+type MetricSample struct {
+	UDID string
+	// Phase is "SCEP", the check-in MessageType (e.g. "Authenticate"),
+	// "Connect" for the first Connect request of a session, or
+	// "Connect-" and the RequestType of the command a Connect request
+	// responds to
+	Phase    string
+	Started  time.Time
+	Duration time.Duration
+	// Err is the error of a failed request
+	Err error
+}
+
+// metricsFunc, if set, receives every MetricSample
+var metricsFunc func(MetricSample)
+
+// SetMetricsFunc sets f to receive the timing of each request devices
+// make. f is called concurrently by devices. It should be called before
+// any devices are processed. A nil f disables metrics.
+func SetMetricsFunc(f func(MetricSample)) {
+	metricsFunc = f
+}
+
+// recordMetric sends a sample of phase started at started, if enabled
+func (device *Device) recordMetric(phase string, started time.Time, err error) {
+	if metricsFunc == nil {
+		return
+	}
+	metricsFunc(MetricSample{
+		UDID:     device.UDID,
+		Phase:    phase,
+		Started:  started,
+		Duration: time.Since(started),
+		Err:      err,
+	})
+}
@@ -0,0 +1,76 @@
+package device
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// NotNowPolicy configures how many Connect sessions a command is answered
+// NotNow in before it is processed, as a busy or locked device does. The
+// server must re-deliver the command in a later session.
+type NotNowPolicy struct {
+	// Cycles applies to commands with no entry in ByRequestType
+	Cycles        int
+	ByRequestType map[string]int
+}
+
+// ParseNotNowPolicy parses a comma-separated list of cycles for all
+// commands and RequestType=cycles for specific commands, e.g.
+// "1,InstallProfile=3"
+func ParseNotNowPolicy(s string) (*NotNowPolicy, error) {
+	p := &NotNowPolicy{ByRequestType: make(map[string]int)}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		reqType, cyclesStr := "", v
+		if i := strings.Index(v, "="); i >= 0 {
+			reqType, cyclesStr = v[:i], v[i+1:]
+		}
+		cycles, err := strconv.Atoi(cyclesStr)
+		if err != nil || cycles < 0 {
+			return nil, fmt.Errorf("invalid NotNow cycles %q: must be a number of cycles or RequestType=cycles", v)
+		}
+		if reqType == "" {
+			p.Cycles = cycles
+		} else {
+			p.ByRequestType[reqType] = cycles
+		}
+	}
+	return p, nil
+}
+
+// cycles returns the number of sessions to answer reqType NotNow in
+func (p *NotNowPolicy) cycles(reqType string) int {
+	if p == nil {
+		return 0
+	}
+	if cycles, ok := p.ByRequestType[reqType]; ok {
+		return cycles
+	}
+	return p.Cycles
+}
+
+// deferCommand reports whether to answer a command NotNow under the
+// client's NotNow policy. Each call for a deferred command counts as one
+// cycle until the command is processed. The counts are saved with the
+// device so that cycles carry over between mdmb runs.
+func (c *MDMClient) deferCommand(reqType, commandUUID string) (bool, error) {
+	cycles := c.NotNow.cycles(reqType)
+	if cycles == 0 {
+		return false, nil
+	}
+	device := c.Device
+	deferred := device.NotNowCounts[commandUUID] < cycles
+	if deferred {
+		if device.NotNowCounts == nil {
+			device.NotNowCounts = make(map[string]int)
+		}
+		device.NotNowCounts[commandUUID]++
+	} else {
+		delete(device.NotNowCounts, commandUUID)
+	}
+	return deferred, device.saveNotNowCounts()
+}
@@ -0,0 +1,36 @@
+package device
+
+import "testing"
+
+func TestNotNowCountsPersist(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	cmdUUID, err := srv.Enqueue(device.UDID, "ProfileList", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each session is a separate run of mdmb with the device loaded anew
+	for i, want := range []string{"NotNow", "NotNow", "Acknowledged"} {
+		loaded, err := Load(device.UDID, device.store)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := loaded.MDMClient()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.NotNow = &NotNowPolicy{Cycles: 2}
+		if err := c.Connect(); err != nil {
+			t.Fatal(err)
+		}
+		if report := srv.Report(cmdUUID); report == nil || report.Status != want {
+			t.Errorf("session %d: have report %+v, want status %s", i+1, report, want)
+		}
+	}
+	loaded, err := Load(device.UDID, device.store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.NotNowCounts) != 0 {
+		t.Errorf("have NotNow counts %v after the command was processed, want none", loaded.NotNowCounts)
+	}
+}
@@ -0,0 +1,205 @@
+package device
+
+import (
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// OS update states. Scheduled updates progress through these on
+// successive Connects: downloading takes two, installing one.
+const (
+	OSUpdateStatusIdle        = "Idle"
+	OSUpdateStatusDownloading = "Downloading"
+	OSUpdateStatusInstalling  = "Installing"
+)
+
+// osUpdateDownloadStep is how much of a download completes per Connect
+const osUpdateDownloadStep = 0.5
+
+// OSUpdate is an OS update available to the simulated device
+type OSUpdate struct {
+	ProductKey        string
+	HumanReadableName string
+	Version           string
+	Build             string
+	DownloadSize      int  `json:",omitempty" plist:",omitempty"`
+	InstallSize       int  `json:",omitempty" plist:",omitempty"`
+	IsCritical        bool `json:",omitempty"`
+	RestartRequired   bool `json:",omitempty"`
+
+	// Status is the state of a scheduled update, empty until one is
+	// scheduled. InstallAction is how it was scheduled.
+	Status                  string  `json:",omitempty" plist:"-"`
+	InstallAction           string  `json:",omitempty" plist:"-"`
+	DownloadPercentComplete float64 `json:",omitempty" plist:"-"`
+	IsDownloaded            bool    `json:",omitempty" plist:"-"`
+}
+
+type AvailableOSUpdatesResponse struct {
+	ConnectRequest
+	AvailableOSUpdates []OSUpdate
+}
+
+func (c *MDMClient) handleAvailableOSUpdates(reqType, commandUUID string) (interface{}, error) {
+	return &AvailableOSUpdatesResponse{
+		ConnectRequest:     *c.acknowledged(reqType, commandUUID),
+		AvailableOSUpdates: append([]OSUpdate{}, c.Device.OSUpdates...),
+	}, nil
+}
+
+type OSUpdateStatusEntry struct {
+	ProductKey              string
+	IsDownloaded            bool
+	DownloadPercentComplete float64
+	Status                  string
+}
+
+type OSUpdateStatusResponse struct {
+	ConnectRequest
+	OSUpdateStatus []OSUpdateStatusEntry
+}
+
+func (c *MDMClient) handleOSUpdateStatus(reqType, commandUUID string) (interface{}, error) {
+	resp := &OSUpdateStatusResponse{
+		ConnectRequest: *c.acknowledged(reqType, commandUUID),
+		OSUpdateStatus: []OSUpdateStatusEntry{},
+	}
+	for _, u := range c.Device.OSUpdates {
+		if u.Status == "" {
+			continue
+		}
+		resp.OSUpdateStatus = append(resp.OSUpdateStatus, OSUpdateStatusEntry{
+			ProductKey:              u.ProductKey,
+			IsDownloaded:            u.IsDownloaded,
+			DownloadPercentComplete: u.DownloadPercentComplete,
+			Status:                  u.Status,
+		})
+	}
+	return resp, nil
+}
+
+type OSUpdateRequest struct {
+	ProductKey     string `plist:",omitempty"`
+	ProductVersion string `plist:",omitempty"`
+	InstallAction  string `plist:",omitempty"`
+}
+
+type ScheduleOSUpdateCommand struct {
+	ConnectResponseCommand
+	Updates []OSUpdateRequest `plist:",omitempty"`
+}
+
+type ScheduleOSUpdate struct {
+	Command     ScheduleOSUpdateCommand
+	CommandUUID string
+}
+
+type OSUpdateResult struct {
+	ProductKey     string
+	ProductVersion string
+	InstallAction  string
+	Status         string
+}
+
+type ScheduleOSUpdateResponse struct {
+	ConnectRequest
+	UpdateResults []OSUpdateResult
+}
+
+// scheduleOSUpdate starts downloading update u (unless it is already)
+// for installAction: Default, InstallASAP, and InstallLater download and
+// install, DownloadOnly only downloads, and NotifyOnly changes nothing
+func scheduleOSUpdate(u *OSUpdate, installAction string) {
+	if installAction == "" {
+		installAction = "Default"
+	}
+	u.InstallAction = installAction
+	switch {
+	case installAction == "NotifyOnly":
+		if u.Status == "" {
+			u.Status = OSUpdateStatusIdle
+		}
+	case u.IsDownloaded && installAction != "DownloadOnly":
+		u.Status = OSUpdateStatusInstalling
+	case !u.IsDownloaded:
+		u.Status = OSUpdateStatusDownloading
+	}
+}
+
+func (c *MDMClient) handleScheduleOSUpdate(respBytes []byte) (interface{}, error) {
+	cmd := &ScheduleOSUpdate{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	resp := &ScheduleOSUpdateResponse{
+		ConnectRequest: *c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID),
+		UpdateResults:  []OSUpdateResult{},
+	}
+	updates := cmd.Command.Updates
+	if len(updates) == 0 {
+		// no updates given means all available updates
+		for _, u := range c.Device.OSUpdates {
+			updates = append(updates, OSUpdateRequest{ProductKey: u.ProductKey})
+		}
+	}
+	for _, req := range updates {
+		var u *OSUpdate
+		for i := range c.Device.OSUpdates {
+			// updates are given by ProductKey or ProductVersion
+			if (req.ProductKey != "" && c.Device.OSUpdates[i].ProductKey == req.ProductKey) ||
+				(req.ProductKey == "" && req.ProductVersion != "" && c.Device.OSUpdates[i].Version == req.ProductVersion) {
+				u = &c.Device.OSUpdates[i]
+				break
+			}
+		}
+		if u == nil {
+			level.Warn(c.Device.logger()).Log("msg", "scheduled OS update not available", "product_key", req.ProductKey, "product_version", req.ProductVersion, "command_uuid", cmd.CommandUUID)
+			continue
+		}
+		scheduleOSUpdate(u, req.InstallAction)
+		resp.UpdateResults = append(resp.UpdateResults, OSUpdateResult{
+			ProductKey:     u.ProductKey,
+			ProductVersion: u.Version,
+			InstallAction:  u.InstallAction,
+			Status:         u.Status,
+		})
+	}
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// advanceOSUpdates moves each scheduled OS update to its next state and
+// reports whether any update changed. An installed update becomes the
+// device's OS version and is no longer available.
+func (device *Device) advanceOSUpdates() bool {
+	changed := false
+	updates := device.OSUpdates[:0]
+	for _, u := range device.OSUpdates {
+		switch u.Status {
+		case OSUpdateStatusDownloading:
+			u.DownloadPercentComplete += osUpdateDownloadStep
+			if u.DownloadPercentComplete >= 1 {
+				u.DownloadPercentComplete = 1
+				u.IsDownloaded = true
+				u.Status = OSUpdateStatusInstalling
+				if u.InstallAction == "DownloadOnly" {
+					u.Status = OSUpdateStatusIdle
+				}
+			}
+			changed = true
+		case OSUpdateStatusInstalling:
+			level.Info(device.logger()).Log("msg", "OS update installed", "product_key", u.ProductKey, "version", u.Version, "build", u.Build)
+			device.OSVersion = u.Version
+			device.BuildVersion = u.Build
+			changed = true
+			continue
+		}
+		updates = append(updates, u)
+	}
+	device.OSUpdates = updates
+	return changed
+}
@@ -0,0 +1,86 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+const pkcs12PayloadType = "com.apple.security.pkcs12"
+
+// pkcs12PayloadContent is the PKCS#12 data and password of a PKCS#12
+// payload (not modeled by cfgprofiles)
+type pkcs12PayloadContent struct {
+	PayloadContent []byte
+	Password       string
+}
+
+// pkcs12PayloadContents decodes the content of each PKCS#12 payload in a
+// raw profile, keyed by PayloadUUID
+func pkcs12PayloadContents(pb []byte) (map[string]*pkcs12PayloadContent, error) {
+	raw := &struct {
+		PayloadContent []map[string]interface{}
+	}{}
+	err := plist.Unmarshal(pb, raw)
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string]*pkcs12PayloadContent)
+	for _, pld := range raw.PayloadContent {
+		if pld["PayloadType"] != pkcs12PayloadType {
+			continue
+		}
+		uuid, _ := pld["PayloadUUID"].(string)
+		content, _ := pld["PayloadContent"].([]byte)
+		password, _ := pld["Password"].(string)
+		contents[uuid] = &pkcs12PayloadContent{PayloadContent: content, Password: password}
+	}
+	return contents, nil
+}
+
+// decodePKCS12Identity returns the RSA private key and its certificate
+// from PKCS#12 data. Any other (e.g. CA) certificates are ignored.
+func decodePKCS12Identity(data []byte, password string) (*rsa.PrivateKey, *x509.Certificate, error) {
+	privKey, cert, caCerts, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, ok := privKey.(*rsa.PrivateKey)
+	if !ok {
+		return nil, nil, errors.New("PKCS#12 private key must be RSA")
+	}
+	// the leaf is usually first but not necessarily
+	for _, cert := range append([]*x509.Certificate{cert}, caCerts...) {
+		if pub, ok := cert.PublicKey.(*rsa.PublicKey); ok && pub.N.Cmp(key.N) == 0 && pub.E == key.E {
+			return key, cert, nil
+		}
+	}
+	return nil, nil, errors.New("PKCS#12 contains no certificate for its private key")
+}
+
+func (device *Device) installPKCS12Payload(profileID string, pld *cfgprofiles.Payload, content *pkcs12PayloadContent) (string, error) {
+	if content == nil || len(content.PayloadContent) == 0 {
+		return "", fmt.Errorf("PKCS#12 payload %s has no content", pld.PayloadUUID)
+	}
+	key, cert, err := decodePKCS12Identity(content.PayloadContent, content.Password)
+	if err != nil {
+		return "", fmt.Errorf("PKCS#12 payload %s: %w", pld.PayloadUUID, err)
+	}
+	return device.saveIdentity(profileID, pld, key, cert)
+}
+
+// MDMIdentityPKCS12 encodes the device's MDM identity certificate and key
+// as PKCS#12 data protected by password
+func (device *Device) MDMIdentityPKCS12(password string) ([]byte, error) {
+	cert, key, err := device.MDMIdentity()
+	if err != nil {
+		return nil, err
+	}
+	return pkcs12.Encode(rand.Reader, key, cert, nil, password)
+}
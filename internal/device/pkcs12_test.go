@@ -0,0 +1,39 @@
+package device
+
+import (
+	"crypto/rand"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+func TestDecodePKCS12Identity(t *testing.T) {
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, caCert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := pkcs12.Encode(rand.Reader, key, cert, []*x509.Certificate{caCert}, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := decodePKCS12Identity(data, "wrong"); err == nil {
+		t.Error("want an error for the wrong password")
+	}
+	decodedKey, decodedCert, err := decodePKCS12Identity(data, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decodedCert.Equal(cert) {
+		t.Errorf("have certificate %s, want the identity certificate", decodedCert.Subject)
+	}
+	if decodedKey.N.Cmp(key.N) != 0 {
+		t.Error("decoded key does not match")
+	}
+}
@@ -1,31 +1,42 @@
 package device
 
 import (
+	"bytes"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"sort"
+	"strings"
+	"time"
 
+	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
+	"github.com/google/uuid"
 	"github.com/groob/plist"
 	"github.com/jessepeterson/cfgprofiles"
-	bolt "go.etcd.io/bbolt"
+	"go.mozilla.org/pkcs7"
 )
 
 type ProfileStore struct {
 	ID string
 
-	DB *bolt.DB
+	DB Store
+
+	logger log.Logger
 }
 
-func NewProfileStore(id string, db *bolt.DB) *ProfileStore {
+func NewProfileStore(id string, db Store) *ProfileStore {
 	return &ProfileStore{ID: id, DB: db}
 }
 
-func (ps *ProfileStore) Load(id string) (p *cfgprofiles.Profile, err error) {
-	pb := []byte{}
+// LoadRaw returns the profile bytes exactly as they were installed
+func (ps *ProfileStore) LoadRaw(id string) (pb []byte, err error) {
 	key := fmt.Sprintf("%s_%s", ps.ID, id)
-	err = ps.DB.View(func(tx *bolt.Tx) error {
-		pb = BucketGet(tx, "profiles", key)
+	err = ps.DB.View(func(tx Tx) error {
+		// copy out as store values are only valid inside the transaction
+		pb = append([]byte(nil), BucketGet(tx, "profiles", key)...)
 		return nil
 	})
 	if err != nil {
@@ -34,41 +45,140 @@ func (ps *ProfileStore) Load(id string) (p *cfgprofiles.Profile, err error) {
 	if len(pb) == 0 {
 		return nil, fmt.Errorf("missing or zero-length profile: %s", id)
 	}
-	p = &cfgprofiles.Profile{}
-	err = plist.Unmarshal(pb, p)
 	return
 }
 
-func (ps *ProfileStore) persistProfile(pb []byte, profileID string) error {
+// profileContent returns the plist of stored profile bytes, without the
+// CMS signature if the profile was signed. The signature was verified when
+// the profile was installed.
+func profileContent(pb []byte) ([]byte, error) {
+	trimmed := bytes.TrimSpace(pb)
+	if bytes.HasPrefix(trimmed, []byte("<")) || bytes.HasPrefix(trimmed, []byte("bplist")) {
+		return pb, nil
+	}
+	p7, err := pkcs7.Parse(pb)
+	if err != nil {
+		return nil, fmt.Errorf("parsing signed profile: %w", err)
+	}
+	return p7.Content, nil
+}
+
+// decodeProfile decodes stored profile bytes, signed or not
+func decodeProfile(pb []byte) (*cfgprofiles.Profile, error) {
+	content, err := profileContent(pb)
+	if err != nil {
+		return nil, err
+	}
+	p := &cfgprofiles.Profile{}
+	err = plist.Unmarshal(content, p)
+	return p, err
+}
+
+// loadContent returns the profile plist of an installed profile, without
+// the CMS signature if it was signed
+func (ps *ProfileStore) loadContent(id string) ([]byte, error) {
+	pb, err := ps.LoadRaw(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := profileContent(pb)
+	if err != nil {
+		return nil, fmt.Errorf("profile %s: %w", id, err)
+	}
+	return content, nil
+}
+
+// LoadXML returns an installed profile as an XML plist, unwrapping it
+// first if it was signed
+func (ps *ProfileStore) LoadXML(id string) ([]byte, error) {
+	pb, err := ps.loadContent(id)
+	if err != nil {
+		return nil, err
+	}
+	var v interface{}
+	if err := plist.Unmarshal(pb, &v); err != nil {
+		return nil, err
+	}
+	return plist.MarshalIndent(v, "\t")
+}
+
+func (ps *ProfileStore) Load(id string) (p *cfgprofiles.Profile, err error) {
+	pb, err := ps.LoadRaw(id)
+	if err != nil {
+		return
+	}
+	return decodeProfile(pb)
+}
+
+// persistProfile stores the profile. managed profiles are those installed
+// by the MDM server (or the MDM profile itself).
+func (ps *ProfileStore) persistProfile(pb []byte, profileID string, managed bool) error {
 	if len(pb) == 0 {
 		return errors.New("empty profile")
 	}
 	key := fmt.Sprintf("%s_%s", ps.ID, profileID)
-	return ps.DB.Update(func(tx *bolt.Tx) error {
-		return BucketPutOrDelete(tx, "profiles", key, pb)
+	var managedValue string
+	if managed {
+		managedValue = "true"
+	}
+	return ps.DB.Update(func(tx Tx) error {
+		err := BucketPutOrDelete(tx, "profiles", key, pb)
+		if err != nil {
+			return err
+		}
+		return BucketPutOrDeleteString(tx, "profile_managed", key, managedValue)
 	})
 }
 
 func (ps *ProfileStore) removeProfile(profileID string) error {
 	key := fmt.Sprintf("%s_%s", ps.ID, profileID)
-	return ps.DB.Update(func(tx *bolt.Tx) error {
-		return BucketPutOrDelete(tx, "profiles", key, nil)
+	return ps.DB.Update(func(tx Tx) error {
+		err := BucketPutOrDelete(tx, "profiles", key, nil)
+		if err != nil {
+			return err
+		}
+		return BucketPutOrDelete(tx, "profile_managed", key, nil)
+	})
+}
+
+// ManagedIDs returns the identifiers of managed profiles: those installed
+// by the MDM server or the MDM enrollment profile itself, as opposed to
+// profiles installed by the user
+func (ps *ProfileStore) ManagedIDs() (ids map[string]bool, err error) {
+	ids = make(map[string]bool)
+	err = ps.DB.View(func(tx Tx) error {
+		for _, id := range BucketGetKeysWithPrefix(tx, "profile_managed", ps.ID+"_", true) {
+			ids[id] = true
+		}
+		return nil
 	})
+	return
+}
+
+// payloadRefKey is scoped to the store so devices installing the same
+// profile don't share payload refs
+func (ps *ProfileStore) payloadRefKey(profileID string, pld *cfgprofiles.Payload, ekey string) string {
+	return fmt.Sprintf("%s_%s_%s_%s_%s", ps.ID, profileID, pld.PayloadIdentifier, pld.PayloadUUID, ekey)
 }
 
 func (ps *ProfileStore) savePayloadRefString(profileID string, pld *cfgprofiles.Payload, ekey, value string) error {
 	if value == "" {
 		return errors.New("no payload ref value to save")
 	}
-	return ps.DB.Update(func(tx *bolt.Tx) error {
-		key := fmt.Sprintf("%s_%s_%s_%s", profileID, pld.PayloadIdentifier, pld.PayloadUUID, ekey)
-		return BucketPutOrDeleteString(tx, "profile_payload_refs", key, value)
+	return ps.DB.Update(func(tx Tx) error {
+		return ps.putPayloadRefString(tx, profileID, pld, ekey, value)
 	})
 }
 
+// putPayloadRefString is savePayloadRefString in tx
+func (ps *ProfileStore) putPayloadRefString(tx Tx, profileID string, pld *cfgprofiles.Payload, ekey, value string) error {
+	key := ps.payloadRefKey(profileID, pld, ekey)
+	return BucketPutOrDeleteString(tx, "profile_payload_refs", key, value)
+}
+
 func (ps *ProfileStore) loadPayloadRefString(profileID string, pld *cfgprofiles.Payload, ekey string) (s string, err error) {
-	err = ps.DB.View(func(tx *bolt.Tx) error {
-		key := fmt.Sprintf("%s_%s_%s_%s", profileID, pld.PayloadIdentifier, pld.PayloadUUID, ekey)
+	err = ps.DB.View(func(tx Tx) error {
+		key := ps.payloadRefKey(profileID, pld, ekey)
 		s = BucketGetString(tx, "profile_payload_refs", key)
 		return nil
 	})
@@ -76,23 +186,95 @@ func (ps *ProfileStore) loadPayloadRefString(profileID string, pld *cfgprofiles.
 }
 
 func (ps *ProfileStore) removePayloadRefString(profileID string, pld *cfgprofiles.Payload, ekey string) error {
-	return ps.DB.Update(func(tx *bolt.Tx) error {
-		key := fmt.Sprintf("%s_%s_%s_%s", profileID, pld.PayloadIdentifier, pld.PayloadUUID, ekey)
+	return ps.DB.Update(func(tx Tx) error {
+		key := ps.payloadRefKey(profileID, pld, ekey)
 		return BucketPutOrDeleteString(tx, "profile_payload_refs", key, "")
 	})
 }
 
+// purge removes all profiles and payload refs in the store
+func (ps *ProfileStore) purge() error {
+	return ps.DB.Update(func(tx Tx) error {
+		err := BucketDeleteWithPrefix(tx, "profiles", ps.ID+"_")
+		if err != nil {
+			return err
+		}
+		err = BucketDeleteWithPrefix(tx, "profile_managed", ps.ID+"_")
+		if err != nil {
+			return err
+		}
+		return BucketDeleteWithPrefix(tx, "profile_payload_refs", ps.ID+"_")
+	})
+}
+
+// allPayloadRefStrings returns the values of all payload refs named ekey
+// in db, of every profile store and in any key format
+func allPayloadRefStrings(db Store, ekey string) (values []string, err error) {
+	suffix := []byte("_" + ekey)
+	err = db.View(func(tx Tx) error {
+		return BucketForEachWithPrefix(tx, "profile_payload_refs", "", false, func(k, v []byte) error {
+			if bytes.HasSuffix(k, suffix) {
+				values = append(values, string(v))
+			}
+			return nil
+		})
+	})
+	return
+}
+
+// managedPayloadRefStrings returns the ekey payload ref values of the
+// payloads of managed profiles only
+func (ps *ProfileStore) managedPayloadRefStrings(ekey string) (values []string, err error) {
+	err = ps.DB.View(func(tx Tx) error {
+		for _, id := range BucketGetKeysWithPrefix(tx, "profile_managed", ps.ID+"_", true) {
+			p, err := decodeProfile(BucketGet(tx, "profiles", ps.ID+"_"+id))
+			if err != nil {
+				return fmt.Errorf("loading profile %s: %w", id, err)
+			}
+			for _, plc := range p.PayloadContent {
+				pld := cfgprofiles.CommonPayload(plc.Payload)
+				if pld == nil {
+					continue
+				}
+				if v := BucketGetString(tx, "profile_payload_refs", ps.payloadRefKey(id, pld, ekey)); v != "" {
+					values = append(values, v)
+				}
+			}
+		}
+		return nil
+	})
+	return
+}
+
 func (ps *ProfileStore) ListUUIDs() (uuids []string, err error) {
-	err = ps.DB.View(func(tx *bolt.Tx) error {
+	err = ps.DB.View(func(tx Tx) error {
 		uuids = BucketGetKeysWithPrefix(tx, "profiles", ps.ID+"_", true)
 		return nil
 	})
 	return
 }
 
+// ForEach decodes each installed profile in a single read transaction and
+// calls fn with it. Profiles which fail to decode are reported and skipped.
+func (ps *ProfileStore) ForEach(fn func(id string, p *cfgprofiles.Profile) error) error {
+	return ps.DB.View(func(tx Tx) error {
+		return BucketForEachWithPrefix(tx, "profiles", ps.ID+"_", true, func(k, v []byte) error {
+			p, err := decodeProfile(v)
+			if err != nil {
+				if ps.logger != nil {
+					level.Warn(ps.logger).Log("msg", "loading profile", "profile", string(k), "err", err)
+				}
+				return nil
+			}
+			return fn(string(k), p)
+		})
+	})
+}
+
 func (device *Device) SystemProfileStore() *ProfileStore {
 	if device.sysProfileStore == nil {
-		device.sysProfileStore = NewProfileStore(device.UDID, device.boltDB)
+		device.sysProfileStore = NewProfileStore(device.UDID, device.store)
+		device.sysProfileStore.logger = device.logger()
 	}
 	return device.sysProfileStore
 }
@@ -106,15 +288,19 @@ type payloadAndResult struct {
 	CommonPayload        *cfgprofiles.Payload
 	PayloadRequiresFlags int
 	Payload              interface{}
+	// ProvidesIdentity is set for payloads that install a keychain
+	// identity which other payloads may reference
+	ProvidesIdentity bool
 
 	// not pretty...
 	StringResult        string
 	payloadAndResultRef *payloadAndResult
 }
 
-func findpayloadAndResultByUUID(plds []*payloadAndResult, uuid string) *payloadAndResult {
+// findIdentityPayloadByUUID finds the identity providing payload with uuid
+func findIdentityPayloadByUUID(plds []*payloadAndResult, uuid string) *payloadAndResult {
 	for _, v := range plds {
-		if v.CommonPayload != nil && v.CommonPayload.PayloadUUID == uuid {
+		if v.ProvidesIdentity && v.CommonPayload != nil && v.CommonPayload.PayloadUUID == uuid {
 			return v
 		}
 	}
@@ -132,12 +318,16 @@ func (device *Device) ValidateProfileInstall(p *cfgprofiles.Profile, fromMDM boo
 			return errors.New("device already enrolled, please unenroll first")
 		}
 		if fromMDM {
+			// only the installed MDM profile may be updated via MDM
+			if p.PayloadIdentifier != device.MDMProfileIdentifier {
+				return errors.New("device already enrolled, MDM payload must update the installed MDM profile")
+			}
 			p, err := device.SystemProfileStore().Load(device.MDMProfileIdentifier)
 			if err != nil {
 				return err
 			}
 			mdmPldsOld := p.MDMPayloads()
-			if len(mdmPlds) != 1 {
+			if len(mdmPldsOld) != 1 {
 				return errors.New("invalid existing MDM profile")
 			}
 			mdmPldOld := mdmPldsOld[0]
@@ -158,6 +348,7 @@ func classifyAndSortProfilePayloads(p *cfgprofiles.Profile, ascending bool) []*p
 				CommonPayload:        &pl.Payload,
 				Payload:              pl,
 				PayloadRequiresFlags: PayloadRequiresNetwork,
+				ProvidesIdentity:     true,
 			}
 		case *cfgprofiles.MDMPayload:
 			orderedPayloads[i] = &payloadAndResult{
@@ -166,42 +357,221 @@ func classifyAndSortProfilePayloads(p *cfgprofiles.Profile, ascending bool) []*p
 				PayloadRequiresFlags: PayloadRequiresNetwork | PayloadRequiresIdentities,
 			}
 		default:
+			cp := cfgprofiles.CommonPayload(pl)
 			orderedPayloads[i] = &payloadAndResult{
-				CommonPayload: cfgprofiles.CommonPayload(pl),
-				Payload:       pl,
+				CommonPayload:    cp,
+				Payload:          pl,
+				ProvidesIdentity: cp != nil && cp.PayloadType == pkcs12PayloadType,
 			}
 		}
 	}
 
 	// sort the profiles into installation order
 	sort.SliceStable(orderedPayloads, func(i, j int) bool {
-		if ascending {
-			return orderedPayloads[i].PayloadRequiresFlags > orderedPayloads[j].PayloadRequiresFlags
-		} else {
-			return orderedPayloads[i].PayloadRequiresFlags < orderedPayloads[j].PayloadRequiresFlags
-		}
+		return orderedPayloads[i].PayloadRequiresFlags < orderedPayloads[j].PayloadRequiresFlags
 	})
+	orderedPayloads = sortPayloadsByDependency(orderedPayloads)
+
+	if ascending {
+		// remove in the reverse order
+		for i, j := 0, len(orderedPayloads)-1; i < j; i, j = i+1, j-1 {
+			orderedPayloads[i], orderedPayloads[j] = orderedPayloads[j], orderedPayloads[i]
+		}
+	}
 
 	return orderedPayloads
 }
 
+// dependencies returns the UUIDs of the payloads pr references
+func (pr *payloadAndResult) dependencies() []string {
+	if pl, ok := pr.Payload.(*cfgprofiles.MDMPayload); ok && pl.IdentityCertificateUUID != "" {
+		return []string{pl.IdentityCertificateUUID}
+	}
+	return nil
+}
+
+// sortPayloadsByDependency topologically sorts plds so each payload comes
+// after the payloads it references, otherwise keeping their order.
+// References to missing payloads are ignored and payloads in a reference
+// cycle keep their order.
+func sortPayloadsByDependency(plds []*payloadAndResult) []*payloadAndResult {
+	index := make(map[string]int)
+	for i, pr := range plds {
+		if pr.CommonPayload != nil && pr.CommonPayload.PayloadUUID != "" {
+			index[pr.CommonPayload.PayloadUUID] = i
+		}
+	}
+	deps := make([][]int, len(plds))
+	for i, pr := range plds {
+		for _, uuid := range pr.dependencies() {
+			if j, ok := index[uuid]; ok && j != i {
+				deps[i] = append(deps[i], j)
+			}
+		}
+	}
+
+	placed := make([]bool, len(plds))
+	sorted := make([]*payloadAndResult, 0, len(plds))
+	// place the first payload whose dependencies are placed until all are
+	for len(sorted) < len(plds) {
+		next := -1
+		for i := range plds {
+			if placed[i] {
+				continue
+			}
+			ready := true
+			for _, j := range deps[i] {
+				if !placed[j] {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				next = i
+				break
+			}
+		}
+		if next < 0 {
+			// a cycle: place the first remaining payload
+			for i := range plds {
+				if !placed[i] {
+					next = i
+					break
+				}
+			}
+		}
+		placed[next] = true
+		sorted = append(sorted, plds[next])
+	}
+	return sorted
+}
+
+// InstallOptions adjust how a profile is installed
+type InstallOptions struct {
+	// OnlyPayloads limits installation to payloads whose type or
+	// identifier is listed. Empty means all payloads.
+	OnlyPayloads []string
+	// SkipPayloads excludes payloads whose type or identifier is listed
+	SkipPayloads []string
+	// SCEPClockSkew offsets the clock used when building SCEP requests
+	SCEPClockSkew time.Duration
+	// SCEPPollTimeout limits how long to poll a CA that responds PENDING.
+	// Zero uses the payload's Retries and RetryDelay.
+	SCEPPollTimeout time.Duration
+	// SCEPSignerValidity is how long the temporary self-signed SCEP
+	// signer certificate is valid. Zero uses 24 hours.
+	SCEPSignerValidity time.Duration
+	// UserEnrollment enrolls with an EnrollmentID instead of the UDID
+	UserEnrollment bool
+	// Force replaces an installed profile with an older PayloadVersion
+	Force bool
+	// FreshSCEPIdentities requests new SCEP certificates instead of
+	// reusing identities (or resuming pending requests) from earlier
+	// installs of the SCEP payloads
+	FreshSCEPIdentities bool
+	// SCEPChallengeURL, if set, is where a challenge for each new SCEP
+	// request is fetched from instead of using the payload's challenge.
+	// SCEP variables in it are replaced.
+	SCEPChallengeURL string
+	// ProfileSignerRoots, if not nil, are the trust anchors the signer of
+	// a signed profile must chain to. Unsigned profiles are refused.
+	ProfileSignerRoots *x509.CertPool
+	// Preflight checks that the MDM servers can be reached before any
+	// payloads are installed
+	Preflight bool
+}
+
+func (opts *InstallOptions) preflight() bool {
+	return opts != nil && opts.Preflight
+}
+
+func (opts *InstallOptions) scepChallengeURL() string {
+	if opts == nil {
+		return ""
+	}
+	return opts.SCEPChallengeURL
+}
+
+func (opts *InstallOptions) profileSignerRoots() *x509.CertPool {
+	if opts == nil {
+		return nil
+	}
+	return opts.ProfileSignerRoots
+}
+
+func payloadMatches(pld *cfgprofiles.Payload, list []string) bool {
+	for _, v := range list {
+		if v == pld.PayloadType || v == pld.PayloadIdentifier {
+			return true
+		}
+	}
+	return false
+}
+
+// skipPayload reports whether pld is excluded from installation
+func (opts *InstallOptions) skipPayload(pld *cfgprofiles.Payload) bool {
+	if opts == nil || pld == nil {
+		return false
+	}
+	if len(opts.OnlyPayloads) > 0 && !payloadMatches(pld, opts.OnlyPayloads) {
+		return true
+	}
+	return payloadMatches(pld, opts.SkipPayloads)
+}
+
 func (device *Device) InstallProfile(pb []byte) error {
-	return device.installProfile(pb, false)
+	return device.installProfile(pb, false, nil)
+}
+
+// InstallProfileWithOptions installs a profile adjusted by opts
+func (device *Device) InstallProfileWithOptions(pb []byte, opts *InstallOptions) error {
+	return device.installProfile(pb, false, opts)
 }
 
 func (device *Device) installProfileFromMDM(pb []byte) error {
-	return device.installProfile(pb, true)
+	return device.installProfile(pb, true, nil)
+}
+
+// unwrapSignedProfile returns the profile content of a CMS signed profile
+// after verifying its signature. Unsigned profiles are returned unchanged
+// unless roots is set. If roots is set the signer certificate must chain
+// to one of them; otherwise it is not checked against any trust anchors.
+func unwrapSignedProfile(pb []byte, roots *x509.CertPool) ([]byte, error) {
+	trimmed := bytes.TrimSpace(pb)
+	if bytes.HasPrefix(trimmed, []byte("<")) || bytes.HasPrefix(trimmed, []byte("bplist")) {
+		if roots != nil {
+			return nil, &MDMError{Code: 1004, Domain: "MCProfileErrorDomain", Description: "profile is not signed but a signer is required"}
+		}
+		return pb, nil
+	}
+	p7, err := pkcs7.Parse(pb)
+	if err != nil {
+		return nil, &MDMError{Code: 1000, Domain: "MCProfileErrorDomain", Description: "profile is neither a plist nor CMS signed", Err: err}
+	}
+	if roots != nil {
+		err = p7.VerifyWithChain(roots)
+	} else {
+		err = p7.Verify()
+	}
+	if err != nil {
+		return nil, &MDMError{Code: 1004, Domain: "MCProfileErrorDomain", Description: "verifying signed profile", Err: err}
+	}
+	return p7.Content, nil
 }
 
-func (device *Device) installProfile(pb []byte, fromMDM bool) error {
+func (device *Device) installProfile(pb []byte, fromMDM bool, opts *InstallOptions) error {
 	if len(pb) == 0 {
-		return errors.New("empty profile")
+		return &MDMError{Code: 1005, Domain: "MCProfileErrorDomain", Description: "empty profile"}
 	}
-	p := &cfgprofiles.Profile{}
-	err := plist.Unmarshal(pb, p)
+	content, err := unwrapSignedProfile(pb, opts.profileSignerRoots())
 	if err != nil {
 		return err
 	}
+	p := &cfgprofiles.Profile{}
+	err = plist.Unmarshal(content, p)
+	if err != nil {
+		return &MDMError{Code: 1000, Domain: "MCProfileErrorDomain", Description: "parsing profile", Err: err}
+	}
 	err = device.ValidateProfileInstall(p, fromMDM)
 	if err != nil {
 		return err
@@ -217,50 +587,140 @@ func (device *Device) installProfile(pb []byte, fromMDM bool) error {
 		}
 	}
 	if matched != "" {
+		installed, err := device.SystemProfileStore().Load(matched)
+		if err != nil {
+			return err
+		}
+		switch {
+		case p.PayloadVersion == installed.PayloadVersion && p.PayloadUUID == installed.PayloadUUID:
+			// already installed
+			level.Info(device.logger()).Log("msg", "profile already installed", "profile", p.PayloadIdentifier, "version", p.PayloadVersion)
+			return nil
+		case p.PayloadVersion < installed.PayloadVersion && (opts == nil || !opts.Force):
+			return fmt.Errorf("profile %s version %d is older than installed version %d", p.PayloadIdentifier, p.PayloadVersion, installed.PayloadVersion)
+		}
 		// remove the existing installed profile
-		device.RemoveProfile(matched)
+		if err := device.RemoveProfile(matched); err != nil {
+			return fmt.Errorf("removing installed profile %s: %w", matched, err)
+		}
 	}
 
 	orderedPayloads := classifyAndSortProfilePayloads(p, false)
 
-	// process and install payloads
-	// TODO: to process profile roll-backs/uninstalls
+	scepSANs, err := scepSubjectAltNames(content)
+	if err != nil {
+		return err
+	}
+	pkcs12s, err := pkcs12PayloadContents(content)
+	if err != nil {
+		return err
+	}
+
+	// check the MDM payload before SCEP requests and the like
 	for _, pr := range orderedPayloads {
+		pl, ok := pr.Payload.(*cfgprofiles.MDMPayload)
+		if !ok || opts.skipPayload(pr.CommonPayload) {
+			continue
+		}
+		applyMDMEnvOverrides(pl)
+		err = validateMDMPayloadURLs(pl)
+		if err == nil && opts.preflight() {
+			err = device.preflightMDMPayloadURLs(pl)
+		}
+		if err != nil {
+			return err
+		}
+		// before the SCEP payloads so that the identity is requested for
+		// the enrollment and not the hardware
+		if opts != nil && opts.UserEnrollment && device.EnrollmentID == "" {
+			device.EnrollmentID = strings.ToUpper(uuid.NewString())
+			device.EnrollmentUserID = strings.ToUpper(uuid.NewString())
+		}
+	}
+
+	// process and install payloads. on failure roll back (in reverse) the
+	// payloads installed so far.
+	var installed []*payloadAndResult
+	for _, pr := range orderedPayloads {
+		if opts.skipPayload(pr.CommonPayload) {
+			level.Info(device.logger()).Log("msg", "skipping payload", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID)
+			// record the skip so that removal doesn't try to undo it
+			err = device.SystemProfileStore().savePayloadRefString(p.PayloadIdentifier, pr.CommonPayload, "install_skipped", "true")
+			if err != nil {
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
+			}
+			installed = append(installed, pr)
+			continue
+		}
+		if pr.CommonPayload != nil {
+			// a resumed install may have skipped the payload before
+			err = device.SystemProfileStore().removePayloadRefString(p.PayloadIdentifier, pr.CommonPayload, "install_skipped")
+			if err != nil {
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
+			}
+		}
 		switch pl := pr.Payload.(type) {
 		case *cfgprofiles.SCEPPayload:
-			pr.StringResult, err = device.installSCEPPayload(p.PayloadIdentifier, pl)
+			applySCEPEnvOverrides(pl)
+			pr.StringResult, err = device.installSCEPPayload(p.PayloadIdentifier, pl, scepSANs[pl.PayloadUUID], opts)
 			if err != nil {
-				return err
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
 			}
 			if pr.StringResult == "" {
-				return errors.New("no result from scep payload install")
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, errors.New("no result from scep payload install"))
 			}
 		case *cfgprofiles.MDMPayload:
-			pr.payloadAndResultRef = findpayloadAndResultByUUID(orderedPayloads, pl.IdentityCertificateUUID)
+			pr.payloadAndResultRef = findIdentityPayloadByUUID(orderedPayloads, pl.IdentityCertificateUUID)
 			if pr.payloadAndResultRef == nil {
-				return fmt.Errorf("could not find payload UUID %s", pl.IdentityCertificateUUID)
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, fmt.Errorf("could not find identity payload UUID %s", pl.IdentityCertificateUUID))
 			}
 
 			if pr.payloadAndResultRef.StringResult == "" {
-				return errors.New("referenced identity payload has no result keychain ID")
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, errors.New("referenced identity payload has no result keychain ID"))
 			}
 			device.MDMIdentityKeychainUUID = pr.payloadAndResultRef.StringResult
 			device.Save()
 
 			err = device.installMDMPayload(pl, p.PayloadIdentifier)
 			if err != nil {
-				return err
+				// not enrolled: forget the identity we were going to use
+				device.MDMIdentityKeychainUUID = ""
+				device.EnrollmentID = ""
+				device.EnrollmentUserID = ""
+				device.mdmClient = nil
+				device.Save()
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
+			}
+		case *cfgprofiles.CertificatePKCS1Payload:
+			pr.StringResult, err = device.installCertificatePayload(p.PayloadIdentifier, pl)
+			if err != nil {
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
+			}
+		case *cfgprofiles.Payload:
+			if pl.PayloadType != pkcs12PayloadType {
+				level.Warn(device.logger()).Log("msg", "unknown payload type not processed", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID)
+				continue
+			}
+			pr.StringResult, err = device.installPKCS12Payload(p.PayloadIdentifier, pl, pkcs12s[pl.PayloadUUID])
+			if err != nil {
+				return device.rollbackPayloads(p.PayloadIdentifier, installed, err)
 			}
 		default:
-			fmt.Printf("unknown payload type %s uuid %s not processed\n", pr.CommonPayload.PayloadType, pr.CommonPayload.PayloadUUID)
+			level.Warn(device.logger()).Log("msg", "unknown payload type not processed", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID)
+			continue
 		}
+		installed = append(installed, pr)
 	}
 
-	return device.SystemProfileStore().persistProfile(pb, p.PayloadIdentifier)
+	// persist the bytes as received (not re-serialized, and still signed
+	// if they were) so that exports and hashes match exactly what was
+	// installed
+	managed := fromMDM || len(p.MDMPayloads()) > 0
+	return device.SystemProfileStore().persistProfile(pb, p.PayloadIdentifier, managed)
 }
 
 func (device *Device) installMDMPayload(mdmPayload *cfgprofiles.MDMPayload, profileID string) error {
-	c, err := newMDMClientUsingPayload(device, mdmPayload)
+	c, err := newMDMClient(device, mdmPayload)
 	if err != nil {
 		return err
 	}
@@ -273,63 +733,170 @@ func (device *Device) installMDMPayload(mdmPayload *cfgprofiles.MDMPayload, prof
 	return nil
 }
 
+// scepRequestFromPayload builds the SCEP request parameters for a payload
+func scepRequestFromPayload(scepPayload *cfgprofiles.SCEPPayload, opts *InstallOptions) *scepRequest {
+	plc := scepPayload.PayloadContent
+	req := &scepRequest{
+		URL:         plc.URL,
+		Challenge:   plc.Challenge,
+		CAMessage:   plc.Name,
+		Fingerprint: plc.CAFingerprint,
+	}
+	req.PollInterval = time.Duration(plc.RetryDelay) * time.Second
+	if req.PollInterval <= 0 {
+		req.PollInterval = 10 * time.Second
+	}
+	retries := plc.Retries
+	if retries <= 0 {
+		retries = 3
+	}
+	req.PollTimeout = time.Duration(retries) * req.PollInterval
+	if opts != nil {
+		req.ClockSkew = opts.SCEPClockSkew
+		req.SignerValidity = opts.SCEPSignerValidity
+		if opts.SCEPPollTimeout > 0 {
+			req.PollTimeout = opts.SCEPPollTimeout
+		}
+	}
+	return req
+}
+
 // installSCEPPayload ... and returns the keychain identity UUID
-func (device *Device) installSCEPPayload(profileID string, scepPayload *cfgprofiles.SCEPPayload) (string, error) {
+func (device *Device) installSCEPPayload(profileID string, scepPayload *cfgprofiles.SCEPPayload, san *scepSubjectAltName, opts *InstallOptions) (string, error) {
+	ps := device.SystemProfileStore()
+	fresh := opts != nil && opts.FreshSCEPIdentities
+	existingUuid, err := ps.loadPayloadRefString(profileID, &scepPayload.Payload, "keychain_identity")
+	if err == nil && existingUuid != "" && !fresh {
+		cert, err := device.SystemKeychain().identityCertificate(existingUuid)
+		switch {
+		case err != nil:
+			level.Warn(device.logger()).Log("msg", "existing SCEP identity unusable, requesting anew", "keychain_uuid", existingUuid, "err", err)
+		case !time.Now().Before(cert.NotAfter):
+			level.Info(device.logger()).Log("msg", "existing SCEP identity expired, requesting anew", "keychain_uuid", existingUuid, "not_after", cert.NotAfter)
+		default:
+			level.Info(device.logger()).Log("msg", "reusing existing SCEP identity", "keychain_uuid", existingUuid)
+			return existingUuid, nil
+		}
+	}
+
+	req := scepRequestFromPayload(scepPayload, opts)
+	req.Logger = device.logger()
+
+	// resume polling a request the CA previously left PENDING
+	pendingKeyUUID, _ := ps.loadPayloadRefString(profileID, &scepPayload.Payload, "scep_pending_key")
+	pendingTxID, _ := ps.loadPayloadRefString(profileID, &scepPayload.Payload, "scep_pending_transaction_id")
+	if pendingKeyUUID != "" && pendingTxID != "" {
+		if !fresh {
+			return device.resumeSCEPPayload(profileID, scepPayload, san, req, pendingKeyUUID, pendingTxID)
+		}
+		level.Info(device.logger()).Log("msg", "abandoning pending SCEP request", "transaction_id", pendingTxID)
+		if err := ps.removePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_key"); err != nil {
+			return "", err
+		}
+		if err := ps.removePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_transaction_id"); err != nil {
+			return "", err
+		}
+	}
+
+	if err := device.resolveSCEPChallenge(scepPayload, opts.scepChallengeURL()); err != nil {
+		return "", err
+	}
+
 	key, err := keyFromSCEPProfilePayload(scepPayload, rand.Reader)
 	if err != nil {
 		return "", err
 	}
 
-	csrBytes, err := csrFromSCEPProfilePayload(scepPayload, device, rand.Reader, key)
+	csrBytes, err := csrFromSCEPProfilePayload(scepPayload, san, device, rand.Reader, key)
 	if err != nil {
 		return "", err
 	}
 
-	existingUuid, err := device.SystemProfileStore().loadPayloadRefString(profileID, &scepPayload.Payload, "keychain_identity")
-	if err == nil {
-		fmt.Printf("reusing existing (pending?) uuid %v\n", existingUuid)
-		return existingUuid, nil
+	started := time.Now()
+	cert, err := scepNewPKCSReq(csrBytes, req)
+	device.recordMetric("SCEP", started, err)
+	var pendingErr *scepPendingError
+	if errors.As(err, &pendingErr) {
+		// keep the key so a later install can pick up the issued cert
+		kciKey := NewKeychainItem(device.SystemKeychain(), ClassKey)
+		kciKey.Key = key
+		if err := kciKey.Save(); err != nil {
+			return "", err
+		}
+		if err := ps.savePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_key", kciKey.UUID); err != nil {
+			return "", err
+		}
+		if err := ps.savePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_transaction_id", pendingErr.TransactionID); err != nil {
+			return "", err
+		}
+		return "", fmt.Errorf("%w: install profile again to resume polling", pendingErr)
+	} else if err != nil {
+		return "", err
 	}
 
-	cert, err := scepNewPKCSReq(
-		csrBytes,
-		scepPayload.PayloadContent.URL,
-		scepPayload.PayloadContent.Challenge,
-		scepPayload.PayloadContent.Name,
-		scepPayload.PayloadContent.CAFingerprint,
-	)
+	return device.saveIdentity(profileID, &scepPayload.Payload, key, cert)
+}
+
+// resumeSCEPPayload polls for the certificate of a pending SCEP request
+func (device *Device) resumeSCEPPayload(profileID string, scepPayload *cfgprofiles.SCEPPayload, san *scepSubjectAltName, req *scepRequest, keyUUID, txID string) (string, error) {
+	ps := device.SystemProfileStore()
+	kciKey, err := LoadKeychainItem(device.SystemKeychain(), keyUUID)
 	if err != nil {
 		return "", err
 	}
+	level.Info(device.logger()).Log("msg", "resuming pending SCEP request", "transaction_id", txID)
 
-	kciKey := NewKeychainItem(device.SystemKeychain(), ClassKey)
-	kciKey.Key = key
-	err = kciKey.Save()
+	if err := device.resolveSCEPChallenge(scepPayload, ""); err != nil {
+		return "", err
+	}
+
+	csrBytes, err := csrFromSCEPProfilePayload(scepPayload, san, device, rand.Reader, kciKey.Key)
 	if err != nil {
 		return "", err
 	}
 
-	kciCert := NewKeychainItem(device.SystemKeychain(), ClassCertificate)
-	kciCert.Certificate = cert
-	err = kciCert.Save()
+	started := time.Now()
+	cert, err := scepResumeCertPoll(csrBytes, req, txID)
+	device.recordMetric("SCEP", started, err)
+	var pendingErr *scepPendingError
+	if errors.As(err, &pendingErr) {
+		return "", fmt.Errorf("%w: install profile again to resume polling", pendingErr)
+	} else if err != nil && !errors.Is(err, errSCEPFailure) {
+		return "", err
+	}
+
+	// issued or rejected: either way the pending request is finished
+	if err := ps.removePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_key"); err != nil {
+		return "", err
+	}
+	if err := ps.removePayloadRefString(profileID, &scepPayload.Payload, "scep_pending_transaction_id"); err != nil {
+		return "", err
+	}
+	if delErr := kciKey.Delete(); delErr != nil {
+		level.Warn(device.logger()).Log("msg", "deleting pending SCEP key", "keychain_uuid", kciKey.UUID, "err", delErr)
+	}
 	if err != nil {
 		return "", err
 	}
 
-	kciID := NewKeychainItem(device.SystemKeychain(), ClassIdentity)
-	kciID.IdentityKeyUUID = kciKey.UUID
-	kciID.IdentityCertificateUUID = kciCert.UUID
-	err = kciID.Save()
+	return device.saveIdentity(profileID, &scepPayload.Payload, kciKey.Key, cert)
+}
+
+// saveIdentity stores the key and certificate as a keychain identity
+// referenced by the identity payload pld
+func (device *Device) saveIdentity(profileID string, pld *cfgprofiles.Payload, key *rsa.PrivateKey, cert *x509.Certificate) (string, error) {
+	idUUID, err := device.SystemKeychain().saveIdentity(key, cert)
 	if err != nil {
 		return "", err
 	}
+	device.warnPlaintextKey(cert)
 
-	err = device.SystemProfileStore().savePayloadRefString(profileID, &scepPayload.Payload, "keychain_identity", kciID.UUID)
+	err = device.SystemProfileStore().savePayloadRefString(profileID, pld, "keychain_identity", idUUID)
 	if err != nil {
 		return "", err
 	}
 
-	return kciID.UUID, nil
+	return idUUID, nil
 }
 
 func (device *Device) RemoveProfile(profileID string) error {
@@ -340,62 +907,80 @@ func (device *Device) RemoveProfile(profileID string) error {
 	orderedPayloads := classifyAndSortProfilePayloads(p, true)
 
 	for _, pr := range orderedPayloads {
-		switch pl := pr.Payload.(type) {
-		case *cfgprofiles.SCEPPayload:
-			err = device.removeSCEPPayload(p.PayloadIdentifier, pl)
-			if err != nil {
-				fmt.Println(err)
-			}
-		case *cfgprofiles.MDMPayload:
-			err = device.removeMDMPayload()
-			if err != nil {
-				fmt.Println(err)
-			}
-		default:
-			fmt.Printf("unknown payload type %s uuid %s not processed\n", pr.CommonPayload.PayloadType, pr.CommonPayload.PayloadUUID)
-		}
+		device.removePayload(p.PayloadIdentifier, pr)
 	}
 
 	return device.SystemProfileStore().removeProfile(p.PayloadIdentifier)
 }
 
-func (device *Device) removeSCEPPayload(profileID string, scepPayload *cfgprofiles.SCEPPayload) error {
-	refStr, err := device.SystemProfileStore().loadPayloadRefString(profileID, &scepPayload.Payload, "keychain_identity")
-	if err != nil {
+// rollbackPayloads removes the installed payloads in reverse order after
+// a failed profile install and returns err. A pending SCEP request is left
+// in place so that installing the profile again can resume it.
+func (device *Device) rollbackPayloads(profileID string, installed []*payloadAndResult, err error) error {
+	var pendingErr *scepPendingError
+	if errors.As(err, &pendingErr) {
 		return err
 	}
-
-	kciID, err := LoadKeychainItem(device.SystemKeychain(), refStr)
-	if err != nil {
-		return err
+	for i := len(installed) - 1; i >= 0; i-- {
+		device.removePayload(profileID, installed[i])
 	}
-
-	kciKey, err := LoadKeychainItem(device.SystemKeychain(), kciID.IdentityKeyUUID)
-	if err != nil {
-		return err
+	if device.MDMProfileIdentifier == "" {
+		// the user enrollment didn't complete
+		device.EnrollmentID = ""
+		device.EnrollmentUserID = ""
 	}
+	return err
+}
 
-	kciCert, err := LoadKeychainItem(device.SystemKeychain(), kciID.IdentityCertificateUUID)
-	if err != nil {
-		return err
+// removePayload undoes the installation of a single profile payload.
+// Errors are only reported as a removal can't be stopped part way.
+func (device *Device) removePayload(profileID string, pr *payloadAndResult) {
+	if pr.CommonPayload != nil {
+		skipped, _ := device.SystemProfileStore().loadPayloadRefString(profileID, pr.CommonPayload, "install_skipped")
+		if skipped != "" {
+			err := device.SystemProfileStore().removePayloadRefString(profileID, pr.CommonPayload, "install_skipped")
+			if err != nil {
+				level.Warn(device.logger()).Log("msg", "removing skipped payload record", "payload_uuid", pr.CommonPayload.PayloadUUID, "err", err)
+			}
+			return
+		}
+	}
+	var err error
+	switch pl := pr.Payload.(type) {
+	case *cfgprofiles.SCEPPayload:
+		err = device.removeIdentityPayload(profileID, &pl.Payload)
+	case *cfgprofiles.MDMPayload:
+		err = device.removeMDMPayload()
+	case *cfgprofiles.CertificatePKCS1Payload:
+		err = device.removeCertificatePayload(profileID, &pl.Payload)
+	case *cfgprofiles.Payload:
+		if pl.PayloadType != pkcs12PayloadType {
+			level.Warn(device.logger()).Log("msg", "unknown payload type not processed", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID)
+			return
+		}
+		err = device.removeIdentityPayload(profileID, pl)
+	default:
+		level.Warn(device.logger()).Log("msg", "unknown payload type not processed", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID)
 	}
-
-	err = kciCert.Delete()
 	if err != nil {
-		return err
+		level.Warn(device.logger()).Log("msg", "removing payload", "payload_type", pr.CommonPayload.PayloadType, "payload_uuid", pr.CommonPayload.PayloadUUID, "err", err)
 	}
+}
 
-	err = kciKey.Delete()
+// removeIdentityPayload deletes the keychain identity installed by the
+// identity (SCEP or PKCS#12) payload pld
+func (device *Device) removeIdentityPayload(profileID string, pld *cfgprofiles.Payload) error {
+	refStr, err := device.SystemProfileStore().loadPayloadRefString(profileID, pld, "keychain_identity")
 	if err != nil {
 		return err
 	}
 
-	err = kciID.Delete()
+	err = device.SystemKeychain().deleteIdentity(refStr)
 	if err != nil {
 		return err
 	}
 
-	err = device.SystemProfileStore().removePayloadRefString(profileID, &scepPayload.Payload, "keychain_identity")
+	err = device.SystemProfileStore().removePayloadRefString(profileID, pld, "keychain_identity")
 	if err != nil {
 		return err
 	}
@@ -406,12 +991,54 @@ func (device *Device) removeSCEPPayload(profileID string, scepPayload *cfgprofil
 func (device *Device) removeMDMPayload() error {
 	c, err := device.MDMClient()
 	if err != nil {
-		return err
+		// still unenroll locally even if we can't talk to the server
+		level.Warn(device.logger()).Log("msg", "unenrolling without CheckOut", "err", err)
+		c = &MDMClient{Device: device}
+	} else {
+		// many servers don't require CheckOut so only report failure
+		err = c.CheckOut()
+		if err != nil {
+			level.Warn(device.logger()).Log("msg", "CheckOut failed", "err", err)
+		}
 	}
 	err = c.unenroll()
 	if err != nil {
 		return err
 	}
-	device.Save()
-	return nil
+	device.mdmClient = nil
+	return device.Save()
+}
+
+// CloneProfiles returns the raw profiles to install on a clone of the
+// device: those not installed by MDM followed by the MDM enrollment
+// profile. Profiles the MDM server installed are left for it to install
+// again.
+func (device *Device) CloneProfiles() (pbs [][]byte, err error) {
+	ps := device.SystemProfileStore()
+	ids, err := ps.ListUUIDs()
+	if err != nil {
+		return nil, err
+	}
+	managed, err := ps.ManagedIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		if managed[id] {
+			continue
+		}
+		pb, err := ps.LoadRaw(id)
+		if err != nil {
+			return nil, err
+		}
+		pbs = append(pbs, pb)
+	}
+	if device.MDMProfileIdentifier != "" {
+		pb, err := ps.LoadRaw(device.MDMProfileIdentifier)
+		if err != nil {
+			return nil, err
+		}
+		pbs = append(pbs, pb)
+	}
+	return pbs, nil
 }
@@ -0,0 +1,381 @@
+package device
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+	"github.com/jessepeterson/mdmb/testutil"
+	"go.mozilla.org/pkcs7"
+)
+
+func testSCEPPayload(uuid string) *payloadAndResult {
+	pl := &cfgprofiles.SCEPPayload{}
+	pl.PayloadType = "com.apple.security.scep"
+	pl.PayloadUUID = uuid
+	return &payloadAndResult{CommonPayload: &pl.Payload, Payload: pl, ProvidesIdentity: true}
+}
+
+func testMDMPayload(uuid, identityUUID string) *payloadAndResult {
+	pl := &cfgprofiles.MDMPayload{IdentityCertificateUUID: identityUUID}
+	pl.PayloadType = "com.apple.mdm"
+	pl.PayloadUUID = uuid
+	return &payloadAndResult{CommonPayload: &pl.Payload, Payload: pl}
+}
+
+func TestSortPayloadsByDependency(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		plds []*payloadAndResult
+		want []string
+	}{
+		{
+			name: "MDM references the second SCEP",
+			plds: []*payloadAndResult{testSCEPPayload("SCEP-1"), testMDMPayload("MDM", "SCEP-2"), testSCEPPayload("SCEP-2")},
+			want: []string{"SCEP-1", "SCEP-2", "MDM"},
+		},
+		{
+			name: "MDM first",
+			plds: []*payloadAndResult{testMDMPayload("MDM", "SCEP-2"), testSCEPPayload("SCEP-2"), testSCEPPayload("SCEP-1")},
+			want: []string{"SCEP-2", "MDM", "SCEP-1"},
+		},
+		{
+			name: "no references",
+			plds: []*payloadAndResult{testSCEPPayload("SCEP-2"), testSCEPPayload("SCEP-1")},
+			want: []string{"SCEP-2", "SCEP-1"},
+		},
+		{
+			name: "missing reference",
+			plds: []*payloadAndResult{testMDMPayload("MDM", "MISSING"), testSCEPPayload("SCEP-1")},
+			want: []string{"MDM", "SCEP-1"},
+		},
+	} {
+		var have []string
+		for _, pr := range sortPayloadsByDependency(test.plds) {
+			have = append(have, pr.CommonPayload.PayloadUUID)
+		}
+		if !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%s: have order %v, want %v", test.name, have, test.want)
+		}
+	}
+}
+
+func TestLoadRawVerbatim(t *testing.T) {
+	device := newTestDevice(t, NewMemoryStore())
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// trailing whitespace and a comment are lost if the profile is
+	// re-serialized
+	pb := append(testProfile(t, "com.example.raw"), []byte("<!-- verbatim -->\n\n")...)
+	if err := device.InstallProfile(pb); err != nil {
+		t.Fatal(err)
+	}
+	have, err := device.SystemProfileStore().LoadRaw("com.example.raw")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, pb) {
+		t.Errorf("have profile %q, want %q", have, pb)
+	}
+}
+
+// signTestProfile CMS signs pb with a self-signed certificate
+func signTestProfile(t *testing.T, pb []byte) []byte {
+	t.Helper()
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sd, err := pkcs7.NewSignedData(pb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+		t.Fatal(err)
+	}
+	signed, err := sd.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+func TestSignedProfileStore(t *testing.T) {
+	_, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := signTestProfile(t, testProfile(t, "com.example.signed", map[string]interface{}{
+		"PayloadType":       "com.apple.security.pkcs1",
+		"PayloadVersion":    1,
+		"PayloadIdentifier": "com.example.signed.cert",
+		"PayloadUUID":       "SIGNED-CERT",
+		"PayloadContent":    cert.Raw,
+	}))
+
+	device := newTestDevice(t, NewMemoryStore())
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.installProfileFromMDM(signed); err != nil {
+		t.Fatal(err)
+	}
+	ps := device.SystemProfileStore()
+
+	pb, err := ps.LoadXML("com.example.signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(pb, []byte("<?xml")) {
+		t.Errorf("have profile %q, want an XML plist", pb)
+	}
+	p := &cfgprofiles.Profile{}
+	if err := plist.Unmarshal(pb, p); err != nil {
+		t.Fatal(err)
+	}
+	if p.PayloadIdentifier != "com.example.signed" {
+		t.Errorf("have identifier %q, want com.example.signed", p.PayloadIdentifier)
+	}
+
+	var ids []string
+	err = ps.ForEach(func(id string, p *cfgprofiles.Profile) error {
+		ids = append(ids, p.PayloadIdentifier)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"com.example.signed"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("have ForEach profiles %v, want %v", ids, want)
+	}
+
+	refs, err := ps.managedPayloadRefStrings("keychain_certificate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(refs) != 1 {
+		t.Errorf("have managed certificate refs %v, want one", refs)
+	}
+}
+
+func TestRemoveProfileSkippedRefs(t *testing.T) {
+	_, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPayload := map[string]interface{}{
+		"PayloadType":       "com.apple.security.pkcs1",
+		"PayloadVersion":    1,
+		"PayloadIdentifier": "com.example.skipped.cert",
+		"PayloadUUID":       "SKIPPED-CERT",
+		"PayloadContent":    cert.Raw,
+	}
+	pb := testProfile(t, "com.example.skipped", certPayload)
+	db := NewMemoryStore()
+	device := newTestDevice(t, db)
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	// an earlier (e.g. SCEP pending) install skipped the payload
+	pld := &cfgprofiles.Payload{PayloadIdentifier: "com.example.skipped.cert", PayloadUUID: "SKIPPED-CERT"}
+	if err := device.SystemProfileStore().savePayloadRefString("com.example.skipped", pld, "install_skipped", "true"); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.InstallProfile(pb); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.RemoveProfile("com.example.skipped"); err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Tx) error {
+		if keys := BucketGetKeysWithPrefix(tx, "profile_payload_refs", "", false); len(keys) != 0 {
+			t.Errorf("have payload refs %v, want none", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("have %d keychain items, want the certificate removed", len(items))
+	}
+}
+
+func TestLoadRawVerbatimSigned(t *testing.T) {
+	device, srv := enrollTestDevice(t)
+	signed := signTestProfile(t, testProfile(t, "com.example.signed"))
+	cmdUUID, err := srv.Enqueue(device.UDID, "InstallProfile", map[string]interface{}{"Payload": signed})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testConnect(t, device)
+	if report := srv.Report(cmdUUID); report == nil || report.Status != "Acknowledged" {
+		t.Fatalf("have report %+v, want Acknowledged", report)
+	}
+	// devices-profiles-export writes these bytes
+	have, err := device.SystemProfileStore().LoadRaw("com.example.signed")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, signed) {
+		t.Errorf("have profile %q, want the signed profile as received", have)
+	}
+}
+
+func TestInstallProfileVersions(t *testing.T) {
+	device := newTestDevice(t, NewMemoryStore())
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	profile := func(uuid string, version int, comment string) []byte {
+		pb, err := plist.Marshal(map[string]interface{}{
+			"PayloadType":       "Configuration",
+			"PayloadVersion":    version,
+			"PayloadIdentifier": "com.example.versioned",
+			"PayloadUUID":       uuid,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the comment tells which install is stored
+		return append(pb, []byte("<!-- "+comment+" -->")...)
+	}
+	for _, test := range []struct {
+		name   string
+		pb     []byte
+		force  bool
+		valid  bool
+		stored string
+	}{
+		{"install", profile("UUID-1", 2, "first"), false, true, "first"},
+		{"identical", profile("UUID-1", 2, "identical"), false, true, "first"},
+		{"new UUID", profile("UUID-2", 2, "new UUID"), false, true, "new UUID"},
+		{"older", profile("UUID-2", 1, "older"), false, false, "new UUID"},
+		{"older forced", profile("UUID-2", 1, "forced"), true, true, "forced"},
+		{"newer", profile("UUID-2", 3, "newer"), false, true, "newer"},
+	} {
+		err := device.InstallProfileWithOptions(test.pb, &InstallOptions{Force: test.force})
+		if test.valid != (err == nil) {
+			t.Errorf("%s: have error %v, want valid %v", test.name, err, test.valid)
+		}
+		stored, err := device.SystemProfileStore().LoadRaw("com.example.versioned")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(stored, []byte("<!-- "+test.stored+" -->")) {
+			t.Errorf("%s: have installed profile %q, want the %s install", test.name, stored, test.stored)
+		}
+	}
+}
+
+// failProfileDeleteTx fails to delete installed profiles
+type failProfileDeleteTx struct{ Tx }
+
+func (tx failProfileDeleteTx) Delete(bucket, key string) error {
+	if bucket == "profiles" {
+		return errors.New("delete failed")
+	}
+	return tx.Tx.Delete(bucket, key)
+}
+
+// failProfileDeleteStore is a Store whose Update transactions fail to
+// delete installed profiles while fail is set
+type failProfileDeleteStore struct {
+	Store
+	fail bool
+}
+
+func (s *failProfileDeleteStore) Update(fn func(tx Tx) error) error {
+	return s.Store.Update(func(tx Tx) error {
+		if s.fail {
+			tx = failProfileDeleteTx{tx}
+		}
+		return fn(tx)
+	})
+}
+
+func TestInstallProfileReplaceRemoveFails(t *testing.T) {
+	db := &failProfileDeleteStore{Store: NewMemoryStore()}
+	device := newTestDevice(t, db)
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	profile := func(uuid string) []byte {
+		pb, err := plist.Marshal(map[string]interface{}{
+			"PayloadType":       "Configuration",
+			"PayloadVersion":    1,
+			"PayloadIdentifier": "com.example.replaced",
+			"PayloadUUID":       uuid,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pb
+	}
+	first := profile("UUID-1")
+	if err := device.InstallProfile(first); err != nil {
+		t.Fatal(err)
+	}
+	db.fail = true
+	if err := device.InstallProfile(profile("UUID-2")); err == nil {
+		t.Error("want an error when the installed profile can't be removed")
+	}
+	stored, err := device.SystemProfileStore().LoadRaw("com.example.replaced")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, first) {
+		t.Errorf("have installed profile %q, want the first install", stored)
+	}
+}
+
+func TestInstallProfileRollback(t *testing.T) {
+	// enrolling fails once the server is gone
+	srv := testutil.NewMDMServer()
+	pb, err := srv.EnrollmentProfile(testTopic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.Close()
+
+	db := NewMemoryStore()
+	device := newTestDevice(t, db)
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.InstallProfile(pb); err == nil {
+		t.Fatal("want an error enrolling with an unreachable server")
+	}
+	if device.MDMIdentityKeychainUUID != "" || device.MDMProfileIdentifier != "" {
+		t.Errorf("have identity %q profile %q, want the device not enrolled", device.MDMIdentityKeychainUUID, device.MDMProfileIdentifier)
+	}
+	ids, err := device.SystemProfileStore().ListUUIDs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 0 {
+		t.Errorf("have installed profiles %v, want none", ids)
+	}
+	items, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 0 {
+		t.Errorf("have %d keychain items, want the PKCS#12 identity removed", len(items))
+	}
+	db.View(func(tx Tx) error {
+		if refs := tx.KeysWithPrefix("profile_payload_refs", ""); len(refs) != 0 {
+			t.Errorf("have payload refs %v, want none", refs)
+		}
+		return nil
+	})
+}
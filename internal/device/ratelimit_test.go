@@ -0,0 +1,50 @@
+package device
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketConcurrent(t *testing.T) {
+	const (
+		n    = 10
+		rate = 100.0
+	)
+	b := newTokenBucket(rate, 1)
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := b.wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	// the burst token is immediate and the rest come at rate
+	want := time.Duration(float64(n-1) / rate * float64(time.Second))
+	if have := time.Since(start); have < want {
+		t.Errorf("%d waits took %s, want at least %s", n, have, want)
+	}
+}
+
+func TestTokenBucketCancel(t *testing.T) {
+	b := newTokenBucket(1, 1)
+	if err := b.wait(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := b.wait(ctx); err != context.Canceled {
+		t.Errorf("have error %v, want %v", err, context.Canceled)
+	}
+	// the cancelled wait returned its token: the next one is still about
+	// a second away rather than two
+	if d := b.reserve(); d > 1100*time.Millisecond {
+		t.Errorf("have wait %s after a cancelled wait, want at most a second", d)
+	}
+}
@@ -0,0 +1,134 @@
+package device
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// recordDir, if set, is where check-in and Connect request and response
+// bodies are written
+var recordDir string
+
+// recordSeq orders the recorded exchanges of all devices
+var recordSeq uint64
+
+// SetRecordDir records every check-in and Connect request and response
+// body to files under dir, one subdirectory per device. It should be
+// called before any devices are processed. An empty dir disables
+// recording.
+func SetRecordDir(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	recordDir = dir
+	return nil
+}
+
+// recording is a single recorded request and its response
+type recording struct {
+	c     *MDMClient
+	seq   uint64
+	label string
+}
+
+// recordRequest records the request body of an exchange labeled by
+// message type or command and returns the recording for its response. It
+// returns nil if recording is disabled.
+func (c *MDMClient) recordRequest(label string, body []byte) *recording {
+	if recordDir == "" {
+		return nil
+	}
+	r := &recording{c: c, seq: atomic.AddUint64(&recordSeq, 1), label: label}
+	r.write(label, "request.plist", body)
+	return r
+}
+
+// response records the response body, labeled by the RequestType of the
+// command in it if there is one. A non-200 status is added to the file
+// name.
+func (r *recording) response(statusCode int, body []byte) {
+	if r == nil {
+		return
+	}
+	label := r.label
+	if reqType := commandRequestType(body); reqType != "" {
+		label = reqType
+	}
+	name := "response.plist"
+	if statusCode != 200 {
+		name = fmt.Sprintf("response-%d.plist", statusCode)
+	}
+	r.write(label, name, body)
+}
+
+// error records an error that prevented receiving a response
+func (r *recording) error(err error) {
+	if r == nil {
+		return
+	}
+	r.write(r.label, "error.txt", []byte(err.Error()+"\n"))
+}
+
+func (r *recording) write(label, suffix string, body []byte) {
+	dir := filepath.Join(recordDir, r.c.Device.UDID)
+	// timestamp first so the files of several runs sort in order
+	name := fmt.Sprintf("%s-%06d-%s.%s", time.Now().UTC().Format("20060102T150405.000Z"), r.seq, recordFileLabel(label), suffix)
+	err := os.MkdirAll(dir, 0755)
+	if err == nil {
+		err = ioutil.WriteFile(filepath.Join(dir, name), body, 0644)
+	}
+	if err != nil {
+		level.Warn(r.c.Device.logger()).Log("msg", "recording MDM exchange", "file", name, "err", err)
+	}
+}
+
+// recordFileLabel makes label safe to use in a file name
+func recordFileLabel(label string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '-', r == '_':
+			return r
+		}
+		return '_'
+	}, label)
+}
+
+// commandRequestType returns the RequestType of the MDM command in b or
+// "" if b isn't a command
+func commandRequestType(b []byte) string {
+	if len(b) == 0 {
+		return ""
+	}
+	var cmd struct {
+		Command struct {
+			RequestType string
+		}
+	}
+	if err := plist.Unmarshal(b, &cmd); err != nil {
+		return ""
+	}
+	return cmd.Command.RequestType
+}
+
+// connectLabel labels a Connect request by its status and the RequestType
+// of the command it responds to, if any
+func connectLabel(reqType string, connReq interface{}) string {
+	label := "Connect"
+	if reqType != "" {
+		label += "-" + reqType
+	}
+	if cr, ok := connReq.(interface{ connectStatus() string }); ok && cr.connectStatus() != "" {
+		label += "-" + cr.connectStatus()
+	}
+	return label
+}
@@ -0,0 +1,132 @@
+package device
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// MDMIdentityExpiresWithin reports whether the MDM identity certificate
+// expires within window from now
+func (device *Device) MDMIdentityExpiresWithin(window time.Duration) (bool, error) {
+	cert, _, err := device.MDMIdentity()
+	if err != nil {
+		return false, err
+	}
+	return time.Now().Add(window).After(cert.NotAfter), nil
+}
+
+// mdmIdentitySCEPPayload returns the SCEP payload of the installed MDM
+// profile that provides the MDM identity and the profile plist (unwrapped
+// if signed)
+func (device *Device) mdmIdentitySCEPPayload() (*cfgprofiles.SCEPPayload, []byte, error) {
+	if device.MDMProfileIdentifier == "" {
+		return nil, nil, errors.New("device not enrolled")
+	}
+	pb, err := device.SystemProfileStore().loadContent(device.MDMProfileIdentifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	p, err := device.SystemProfileStore().Load(device.MDMProfileIdentifier)
+	if err != nil {
+		return nil, nil, err
+	}
+	mdmPlds := p.MDMPayloads()
+	if len(mdmPlds) != 1 {
+		return nil, nil, errors.New("enrollment profile must contain one MDM payload")
+	}
+	for _, pl := range p.SCEPPayloads() {
+		if pl.PayloadUUID == mdmPlds[0].IdentityCertificateUUID {
+			return pl, pb, nil
+		}
+	}
+	return nil, nil, fmt.Errorf("MDM identity payload %s is not a SCEP payload", mdmPlds[0].IdentityCertificateUUID)
+}
+
+// RenewMDMIdentity requests a new MDM identity certificate, for a new
+// key, from the SCEP payload that issued the current one. The request is
+// signed with the current identity as a real device renewing would. Once
+// issued the new identity replaces the current one and the old keychain
+// items are deleted.
+func (device *Device) RenewMDMIdentity() error {
+	oldCert, oldKey, err := device.MDMIdentity()
+	if err != nil {
+		return err
+	}
+	scepPayload, pb, err := device.mdmIdentitySCEPPayload()
+	if err != nil {
+		return err
+	}
+	scepSANs, err := scepSubjectAltNames(pb)
+	if err != nil {
+		return err
+	}
+
+	applySCEPEnvOverrides(scepPayload)
+	if err := device.resolveSCEPChallenge(scepPayload, ""); err != nil {
+		return err
+	}
+	req := scepRequestFromPayload(scepPayload, nil)
+	req.Logger = device.logger()
+	req.SignerKey = oldKey
+	req.SignerCert = oldCert
+
+	key, err := keyFromSCEPProfilePayload(scepPayload, rand.Reader)
+	if err != nil {
+		return err
+	}
+	csrBytes, err := csrFromSCEPProfilePayload(scepPayload, scepSANs[scepPayload.PayloadUUID], device, rand.Reader, key)
+	if err != nil {
+		return err
+	}
+	level.Info(device.logger()).Log("msg", "renewing MDM identity", "not_after", oldCert.NotAfter)
+	started := time.Now()
+	cert, err := scepNewPKCSReq(csrBytes, req)
+	device.recordMetric("SCEP", started, err)
+	if err != nil {
+		return fmt.Errorf("renewing MDM identity: %w", err)
+	}
+
+	// swap the identity in one transaction so the device always has
+	// exactly one, even if saving fails part way
+	oldUUID := device.MDMIdentityKeychainUUID
+	oldItems, err := device.SystemKeychain().identityItems(oldUUID)
+	if err != nil {
+		level.Warn(device.logger()).Log("msg", "loading old MDM identity, not deleting it", "keychain_uuid", oldUUID, "err", err)
+	}
+	err = device.store.Update(func(tx Tx) error {
+		newUUID, err := device.SystemKeychain().putIdentity(tx, key, cert)
+		if err != nil {
+			return err
+		}
+		err = device.SystemProfileStore().putPayloadRefString(tx, device.MDMProfileIdentifier, &scepPayload.Payload, "keychain_identity", newUUID)
+		if err != nil {
+			return err
+		}
+		device.MDMIdentityKeychainUUID = newUUID
+		if err := device.put(tx); err != nil {
+			return err
+		}
+		for _, kci := range oldItems {
+			if err := kci.delete(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		device.MDMIdentityKeychainUUID = oldUUID
+		return err
+	}
+	device.warnPlaintextKey(cert)
+	if device.mdmClient != nil {
+		device.mdmClient.IdentityCertificate = cert
+		device.mdmClient.IdentityPrivateKey = key
+	}
+	level.Info(device.logger()).Log("msg", "renewed MDM identity", "not_after", cert.NotAfter)
+	return nil
+}
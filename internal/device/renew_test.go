@@ -0,0 +1,152 @@
+package device
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jessepeterson/mdmb/testutil"
+)
+
+// failDeleteStore is a Store whose Update transactions fail to Delete
+// while fail is set
+type failDeleteStore struct {
+	Store
+	fail bool
+}
+
+type failDeleteTx struct{ Tx }
+
+func (failDeleteTx) Delete(bucket, key string) error {
+	return errors.New("delete failed")
+}
+
+func (s *failDeleteStore) Update(fn func(tx Tx) error) error {
+	return s.Store.Update(func(tx Tx) error {
+		if s.fail {
+			tx = failDeleteTx{tx}
+		}
+		return fn(tx)
+	})
+}
+
+// enrollSCEPTestDevice enrolls a new device in a fake MDM server with an
+// MDM identity from a fake SCEP CA
+func enrollSCEPTestDevice(t *testing.T, db Store, opts *InstallOptions) (*Device, *testutil.MDMServer, *testutil.SCEPServer) {
+	t.Helper()
+	srv := testutil.NewMDMServer()
+	t.Cleanup(srv.Close)
+	scepSrv := testSCEPServer(t)
+	pb := testProfile(t, "com.example.enroll",
+		map[string]interface{}{
+			"PayloadType":       "com.apple.security.scep",
+			"PayloadVersion":    1,
+			"PayloadIdentifier": "com.example.enroll.scep",
+			"PayloadUUID":       "SCEP-UUID",
+			"PayloadContent": map[string]interface{}{
+				"URL":     scepSrv.URL(),
+				"Subject": [][][]string{{{"CN", "%HardwareUUID%"}}},
+				"Keysize": 1024,
+			},
+		},
+		map[string]interface{}{
+			"PayloadType":             "com.apple.mdm",
+			"PayloadVersion":          1,
+			"PayloadIdentifier":       "com.example.enroll.mdm",
+			"PayloadUUID":             "MDM-UUID",
+			"IdentityCertificateUUID": "SCEP-UUID",
+			"ServerURL":               srv.URL(),
+			"CheckInURL":              srv.URL(),
+			"Topic":                   testTopic,
+			"SignMessage":             true,
+			"AccessRights":            8191,
+		},
+	)
+	device := newTestDevice(t, db)
+	if err := device.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if err := device.InstallProfileWithOptions(pb, opts); err != nil {
+		t.Fatal(err)
+	}
+	return device, srv, scepSrv
+}
+
+func TestRenewMDMIdentity(t *testing.T) {
+	db := &failDeleteStore{Store: NewMemoryStore()}
+	device, _, _ := enrollSCEPTestDevice(t, db, nil)
+	oldUUID := device.MDMIdentityKeychainUUID
+	oldCert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a failed save leaves the old identity and no new items
+	db.fail = true
+	if err := device.RenewMDMIdentity(); err == nil {
+		t.Fatal("want an error renewing with a failing store")
+	}
+	db.fail = false
+	if device.MDMIdentityKeychainUUID != oldUUID {
+		t.Errorf("have identity %s after a failed renewal, want %s", device.MDMIdentityKeychainUUID, oldUUID)
+	}
+	after, err := LoadKeychainItems(device.SystemKeychain(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(items) {
+		t.Errorf("have %d keychain items after a failed renewal, want %d", len(after), len(items))
+	}
+
+	if err := device.RenewMDMIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := Load(device.UDID, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.MDMIdentityKeychainUUID == oldUUID || loaded.MDMIdentityKeychainUUID != device.MDMIdentityKeychainUUID {
+		t.Errorf("have saved identity %s, want the new identity %s", loaded.MDMIdentityKeychainUUID, device.MDMIdentityKeychainUUID)
+	}
+	cert, _, err := loaded.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cert.Equal(oldCert) {
+		t.Error("MDM identity certificate not renewed")
+	}
+	if _, err := device.SystemKeychain().identityItems(oldUUID); err == nil {
+		t.Error("old identity not deleted")
+	}
+	count, _, err := loaded.KeychainGC(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 0 {
+		t.Errorf("have %d unreferenced keychain items, want 0", count)
+	}
+}
+
+func TestRenewMDMIdentitySigner(t *testing.T) {
+	device, _, scepSrv := enrollSCEPTestDevice(t, NewMemoryStore(), nil)
+	oldCert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := device.RenewMDMIdentity(); err != nil {
+		t.Fatal(err)
+	}
+	reqs := scepSrv.Requests()
+	if len(reqs) != 2 {
+		t.Fatalf("have %d PKIOperations, want 2", len(reqs))
+	}
+	if signer := reqs[0].Signer; signer.Subject.CommonName != "SCEP SIGNER" {
+		t.Errorf("enrollment: have signer %s, want the temporary signer", signer.Subject)
+	}
+	if !reqs[1].Signer.Equal(oldCert) {
+		t.Errorf("renewal: have signer %s, want the current MDM identity", reqs[1].Signer.Subject)
+	}
+}
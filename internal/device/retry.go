@@ -0,0 +1,126 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	mathrand "math/rand"
+	"net/http"
+	"time"
+)
+
+const (
+	// defaultRetryBaseDelay is the delay before the first retry unless
+	// HTTPClientOptions sets one
+	defaultRetryBaseDelay = time.Second
+	// maxRetryDelay caps the backoff and Retry-After delays
+	maxRetryDelay = 5 * time.Minute
+)
+
+// retryTransport retries requests that fail with a network error or a
+// 5xx status with exponential backoff. 4xx statuses aren't retried. Each
+// attempt waits for limiter, if set, and is then limited by timeout so
+// that time spent rate limited doesn't count.
+type retryTransport struct {
+	retries   int
+	baseDelay time.Duration
+	timeout   time.Duration
+	limiter   *tokenBucket
+	next      http.RoundTripper
+}
+
+// cancelBody cancels an attempt's context once its response body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil && req.GetBody == nil {
+		// buffer the body so it can be sent again
+		body, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req = req.Clone(req.Context())
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+		req.GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(body)), nil
+		}
+	}
+	for attempt := 0; ; attempt++ {
+		res, err := t.try(req, attempt)
+		if attempt >= t.retries || !retryable(res, err) || req.Context().Err() != nil {
+			return res, err
+		}
+		delay := t.backoff(attempt)
+		if res != nil {
+			if ra := parseRetryAfter(res.Header.Get("Retry-After")); ra > 0 {
+				delay = ra
+			}
+			res.Body.Close()
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// try makes one attempt at req
+func (t *retryTransport) try(req *http.Request, attempt int) (*http.Response, error) {
+	if t.limiter != nil {
+		if err := t.limiter.wait(req.Context()); err != nil {
+			return nil, err
+		}
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	attemptReq := req.Clone(ctx)
+	if attempt > 0 && req.GetBody != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		attemptReq.Body = body
+	}
+	res, err := t.next.RoundTrip(attemptReq)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	res.Body = &cancelBody{ReadCloser: res.Body, cancel: cancel}
+	return res, nil
+}
+
+// backoff returns the delay before retry attempt+1: the base delay
+// doubled for each earlier retry, with jitter so many devices retrying
+// at once spread out
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	delay := t.baseDelay << uint(attempt)
+	if delay <= 0 || delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay/2 + time.Duration(mathrand.Int63n(int64(delay/2)+1))
+}
+
+// retryable reports whether a request should be tried again: after a
+// network error or a 5xx status
+func retryable(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode >= 500
+}
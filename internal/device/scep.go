@@ -8,25 +8,33 @@ import (
 	"crypto/rsa"
 	_ "crypto/sha1"
 	_ "crypto/sha256"
+	_ "crypto/sha512"
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/asn1"
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"io"
 	"math/big"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/go-kit/kit/log"
+	"github.com/go-kit/kit/log/level"
 	"github.com/jessepeterson/cfgprofiles"
 	scepclient "github.com/micromdm/scep/v2/client"
+	"github.com/micromdm/scep/v2/cryptoutil"
 	"github.com/micromdm/scep/v2/cryptoutil/x509util"
 	"github.com/micromdm/scep/v2/scep"
+	"go.mozilla.org/pkcs7"
 )
 
-const defaultRSAKeySize = 1024
+const (
+	defaultRSAKeySize = 2048
+	minRSAKeySize     = 1024
+)
 
 // borrowed from x509.go
 func reverseBitsInAByte(in byte) byte {
@@ -82,18 +90,29 @@ func keyFromSCEPProfilePayload(pl *cfgprofiles.SCEPPayload, rand io.Reader) (*rs
 	if plc.KeySize > 0 {
 		keySize = plc.KeySize
 	}
+	if keySize < minRSAKeySize {
+		return nil, fmt.Errorf("SCEP payload KeySize %d is below the minimum of %d bits", keySize, minRSAKeySize)
+	}
 	return rsa.GenerateKey(rand, keySize)
 }
 
+// replaceSCEPVars replaces SCEP variables in istrs. A user enrollment
+// doesn't reveal hardware identifiers so its identity is scoped to the
+// enrollment: %HardwareUUID% is the EnrollmentID and %SerialNumber% and
+// %MACAddress% are empty.
 func replaceSCEPVars(device *Device, istrs []string) (ostrs []string) {
+	hardwareUUID, serial, macAddress := device.UDID, device.Serial, device.MACAddress
+	if device.EnrollmentID != "" {
+		hardwareUUID, serial, macAddress = device.EnrollmentID, "", ""
+	}
 	// % /usr/libexec/mdmclient dumpSCEPVars
 	r := strings.NewReplacer([]string{
 		"%ComputerName%", device.ComputerName,
-		"%HardwareUUID%", device.UDID,
-		"%SerialNumber%", device.Serial,
-		// "%HostName%", "TODO_HostName",
-		// "%LocalHostName%", "TODO_LocalHostName",
-		// "%MACAddress%", "TODO_MACAddress",
+		"%HardwareUUID%", hardwareUUID,
+		"%SerialNumber%", serial,
+		"%HostName%", device.HostName,
+		"%LocalHostName%", device.LocalHostName,
+		"%MACAddress%", macAddress,
 	}...)
 	for _, istr := range istrs {
 		ostrs = append(ostrs, r.Replace(istr))
@@ -101,7 +120,78 @@ func replaceSCEPVars(device *Device, istrs []string) (ostrs []string) {
 	return
 }
 
-func csrFromSCEPProfilePayload(pl *cfgprofiles.SCEPPayload, device *Device, rand io.Reader, privKey *rsa.PrivateKey) ([]byte, error) {
+var oidCommonName = asn1.ObjectIdentifier{2, 5, 4, 3}
+
+var subjectOIDs = map[string]asn1.ObjectIdentifier{
+	"CN": oidCommonName,
+	"C":  {2, 5, 4, 6},
+	"L":  {2, 5, 4, 7},
+	// TODO: Are these interchangeable?
+	"ST": {2, 5, 4, 8},
+	"O":  {2, 5, 4, 10},
+	"OU": {2, 5, 4, 11},
+}
+
+// parseOID parses a dotted-decimal OID string like "1.2.840.113549.1.9.1"
+func parseOID(s string) (asn1.ObjectIdentifier, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) < 2 {
+		return nil, errors.New("not a dotted OID")
+	}
+	oid := make(asn1.ObjectIdentifier, len(parts))
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid OID component %q", p)
+		}
+		oid[i] = n
+	}
+	if oid[0] > 2 || (oid[0] < 2 && oid[1] > 39) {
+		return nil, errors.New("invalid OID arc")
+	}
+	return oid, nil
+}
+
+// subjectFromSCEPProfilePayload builds the CSR subject preserving the
+// order of RDNs in the payload as well as multi-valued RDNs
+func subjectFromSCEPProfilePayload(pl *cfgprofiles.SCEPPayload, device *Device) (pkix.RDNSequence, error) {
+	var subject pkix.RDNSequence
+	hasCN := false
+	for _, onvg := range pl.PayloadContent.Subject {
+		var rdn pkix.RelativeDistinguishedNameSET
+		for _, onv := range onvg {
+			if len(onv) < 2 {
+				return nil, fmt.Errorf("invalid OID in SCEP payload: %v", onv)
+			}
+			oid, ok := subjectOIDs[onv[0]]
+			if !ok {
+				var err error
+				oid, err = parseOID(onv[0])
+				if err != nil {
+					return nil, fmt.Errorf("invalid OID in SCEP payload: %v: %w", onv, err)
+				}
+			}
+			if oid.Equal(oidCommonName) {
+				hasCN = true
+			}
+			for _, value := range replaceSCEPVars(device, onv[1:]) {
+				rdn = append(rdn, pkix.AttributeTypeAndValue{Type: oid, Value: value})
+			}
+		}
+		if len(rdn) > 0 {
+			subject = append(subject, rdn)
+		}
+	}
+	// macOS seems to fill a default CN of the PayloadIdentifier if not present
+	if !hasCN {
+		subject = append(subject, pkix.RelativeDistinguishedNameSET{
+			{Type: oidCommonName, Value: pl.PayloadIdentifier},
+		})
+	}
+	return subject, nil
+}
+
+func csrFromSCEPProfilePayload(pl *cfgprofiles.SCEPPayload, san *scepSubjectAltName, device *Device, rand io.Reader, privKey *rsa.PrivateKey) ([]byte, error) {
 	plc := pl.PayloadContent
 
 	tmpl := &x509util.CertificateRequest{
@@ -118,41 +208,35 @@ func csrFromSCEPProfilePayload(pl *cfgprofiles.SCEPPayload, device *Device, rand
 		return nil, err
 	}
 	tmpl.ExtraExtensions = append(tmpl.ExtraExtensions, keyUsageExtn)
-	for _, onvg := range plc.Subject {
-		for _, onv := range onvg {
-			if len(onv) < 2 {
-				return nil, fmt.Errorf("invalid OID in SCEP payload: %v", onv)
-			}
-			values := replaceSCEPVars(device, onv[1:])
-			switch onv[0] {
-			case "C":
-				tmpl.Subject.Country = values
-			case "L":
-				tmpl.Subject.Locality = values
-			case "ST":
-				// TODO: Are these interchangeable?
-				tmpl.Subject.Province = values
-			case "O":
-				tmpl.Subject.Organization = values
-			case "OU":
-				tmpl.Subject.OrganizationalUnit = values
-			case "CN":
-				tmpl.Subject.CommonName = values[0]
-			default:
-				// TODO: arbitrary OIDs not yet supported
-				return nil, fmt.Errorf("unhandled OID in SCEP payload: %v", onv)
-			}
-		}
+	subject, err := subjectFromSCEPProfilePayload(pl, device)
+	if err != nil {
+		return nil, err
 	}
-	// macOS seems to fill a default CN of the PayloadIdentifier if not present
-	if tmpl.Subject.CommonName == "" {
-		tmpl.Subject.CommonName = pl.PayloadIdentifier
+	tmpl.RawSubject, err = asn1.Marshal(subject)
+	if err != nil {
+		return nil, err
+	}
+	err = san.apply(&tmpl.CertificateRequest, device)
+	if err != nil {
+		return nil, err
 	}
-	// TODO: SANs
 	return x509util.CreateCertificateRequest(rand, tmpl, privKey)
 }
 
-func selfSign() (*rsa.PrivateKey, *x509.Certificate, error) {
+// defaultSignerValidity is the validity of the temporary SCEP signer
+// unless a request sets SignerValidity
+const defaultSignerValidity = 24 * time.Hour
+
+// signerBackdate starts the temporary SCEP signer's validity before now to
+// tolerate SCEP servers whose clock is behind
+const signerBackdate = 5 * time.Minute
+
+// selfSign creates the temporary SCEP signer. Its validity starts
+// signerBackdate before now and lasts validity (or defaultSignerValidity).
+func selfSign(now time.Time, validity time.Duration) (*rsa.PrivateKey, *x509.Certificate, error) {
+	if validity <= 0 {
+		validity = defaultSignerValidity
+	}
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return nil, nil, err
@@ -163,14 +247,13 @@ func selfSign() (*rsa.PrivateKey, *x509.Certificate, error) {
 		return nil, nil, fmt.Errorf("failed to generate serial number: %s", err)
 	}
 
-	timeNow := time.Now()
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
 		Subject: pkix.Name{
 			CommonName: "SCEP SIGNER",
 		},
-		NotBefore: timeNow,
-		NotAfter:  timeNow.Add(time.Hour),
+		NotBefore: now.Add(-signerBackdate),
+		NotAfter:  now.Add(validity),
 
 		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
@@ -185,19 +268,128 @@ func selfSign() (*rsa.PrivateKey, *x509.Certificate, error) {
 	return priv, cert, err
 }
 
-func scepNewPKCSReq(csrBytes []byte, url, challenge, caMessage string, fingerprint []byte) (*x509.Certificate, error) {
-	logger := log.NewLogfmtLogger(os.Stderr)
-	logger = log.With(logger, "ts", log.DefaultTimestampUTC)
-	cl, err := scepclient.New(url, logger)
+// failInfoString avoids FailInfo.String() which panics on unknown values
+func failInfoString(fi scep.FailInfo) string {
+	switch fi {
+	case scep.BadAlg, scep.BadMessageCheck, scep.BadRequest, scep.BadTime, scep.BadCertID:
+		return fi.String()
+	}
+	return string(fi)
+}
+
+// scepSem bounds concurrent SCEP operations across all devices. A nil
+// scepSem means unbounded.
+var scepSem chan struct{}
+
+// SetSCEPConcurrency limits the number of concurrent SCEP operations,
+// independent of any other concurrency. Zero or less means unlimited.
+// It should be called before any devices are processed.
+func SetSCEPConcurrency(n int) {
+	if n > 0 {
+		scepSem = make(chan struct{}, n)
+	} else {
+		scepSem = nil
+	}
+}
+
+func acquireSCEP() (release func()) {
+	if scepSem == nil {
+		return func() {}
+	}
+	scepSem <- struct{}{}
+	return func() { <-scepSem }
+}
+
+// scepRequest holds the parameters of a SCEP certificate request
+type scepRequest struct {
+	URL         string
+	Challenge   string
+	CAMessage   string
+	Fingerprint []byte
+	// ClockSkew offsets the time used for the temporary signer
+	// certificate validity and the PKCS#7 signing time attribute to
+	// exercise CA time checks
+	ClockSkew time.Duration
+	// PollInterval and PollTimeout control CertPoll (GetCertInitial)
+	// polling when the CA responds PENDING. Zero PollTimeout won't poll.
+	PollInterval time.Duration
+	PollTimeout  time.Duration
+	// Logger is the device logger (nil discards)
+	Logger log.Logger
+	// SignerValidity is how long the temporary signer certificate is
+	// valid. Zero uses defaultSignerValidity.
+	SignerValidity time.Duration
+	// SignerKey and SignerCert sign the request (e.g. the current
+	// identity when renewing) instead of a temporary self-signed cert
+	SignerKey  *rsa.PrivateKey
+	SignerCert *x509.Certificate
+}
+
+var errSCEPFailure = errors.New("SCEP request failed")
+
+// scepPendingError is returned when the CA hasn't issued a certificate
+// by the time polling stops
+type scepPendingError struct {
+	TransactionID string
+}
+
+func (e *scepPendingError) Error() string {
+	return fmt.Sprintf("SCEP request pending (transaction ID %s)", e.TransactionID)
+}
+
+// fingerprintHash returns the hash of a CAFingerprint by its length or 0
+// for an empty fingerprint (no CA pinning). Other lengths are an error
+// rather than silently not pinning the CA.
+func fingerprintHash(fingerprint []byte) (crypto.Hash, error) {
+	switch len(fingerprint) {
+	case 0:
+		return 0, nil
+	case 16:
+		return crypto.MD5, nil
+	case 20:
+		return crypto.SHA1, nil
+	case 32:
+		return crypto.SHA256, nil
+	case 64:
+		return crypto.SHA512, nil
+	}
+	return 0, fmt.Errorf("CAFingerprint length %d is not an MD5, SHA-1, SHA-256, or SHA-512 hash", len(fingerprint))
+}
+
+// scepSession is a SCEP client with the CA certificates retrieved
+type scepSession struct {
+	cl         scepclient.Client
+	logger     log.Logger
+	caCerts    []*x509.Certificate
+	recipients []*x509.Certificate
+	signerKey  *rsa.PrivateKey
+	signerCert *x509.Certificate
+	algs       scepAlgorithms
+	clockSkew  time.Duration
+}
+
+func newSCEPSession(ctx context.Context, req *scepRequest) (*scepSession, error) {
+	logger := req.Logger
+	if logger == nil {
+		logger = log.NewNopLogger()
+	}
+	// fail before contacting the CA if it can't be pinned as asked
+	hashType, err := fingerprintHash(req.Fingerprint)
+	if err != nil {
+		return nil, err
+	}
+	cl, err := newSCEPClient(req.URL, level.Debug(logger))
 	if err != nil {
 		return nil, err
 	}
-	ctx := context.Background()
 
+	caMessage := req.CAMessage
 	// HACK: mvk
 	caMessage = ""
 
+	release := acquireSCEP()
 	resp, certNum, err := cl.GetCACert(ctx, caMessage)
+	release()
 	if err != nil {
 		return nil, err
 	}
@@ -217,70 +409,307 @@ func scepNewPKCSReq(csrBytes []byte, url, challenge, caMessage string, fingerpri
 	}
 
 	selector := scep.NopCertsSelector()
-	hashType := crypto.Hash(0)
-	switch len(fingerprint) {
-	case 16:
-		hashType = crypto.MD5
-	case 20:
-		hashType = crypto.SHA1
-	case 32:
-		hashType = crypto.SHA256
-		// case 64:
-		//	hashType = crypto.SHA512
-	}
 	if hashType != 0 {
-		selector = scep.FingerprintCertsSelector(hashType, fingerprint)
-	} else {
-		fmt.Printf("CAFingerprint length %d not supported\n", len(fingerprint))
+		selector = scep.FingerprintCertsSelector(hashType, req.Fingerprint)
+	}
+	recipients := selector.SelectCerts(certs)
+	if len(recipients) < 1 {
+		return nil, errors.New("no selected CA/RA recipients")
 	}
 
-	scepTmpKey, scepTmpCert, err := selfSign()
+	// CAs that don't support GetCACaps get the lowest common denominator
+	release = acquireSCEP()
+	capsBytes, err := cl.GetCACaps(ctx)
+	release()
 	if err != nil {
-		return nil, err
+		level.Debug(logger).Log("msg", "GetCACaps failed", "err", err)
+	}
+	caps := parseSCEPCaps(capsBytes)
+	algs := negotiateSCEPAlgorithms(caps)
+	level.Info(logger).Log("msg", "SCEP CA capabilities", "caps", strings.Join(caps, ","), "digest", algs.DigestName, "cipher", algs.CipherName)
+
+	scepTmpKey, scepTmpCert := req.SignerKey, req.SignerCert
+	switch {
+	case scepTmpKey == nil && scepTmpCert == nil:
+		scepTmpKey, scepTmpCert, err = selfSign(time.Now().Add(req.ClockSkew), req.SignerValidity)
+		if err != nil {
+			return nil, err
+		}
+	case scepTmpKey == nil || scepTmpCert == nil:
+		return nil, errors.New("SCEP signer requires both a key and a certificate")
+	default:
+		pub, ok := scepTmpCert.PublicKey.(*rsa.PublicKey)
+		if !ok || pub.N.Cmp(scepTmpKey.N) != 0 || pub.E != scepTmpKey.E {
+			return nil, errors.New("SCEP signer key does not match signer certificate")
+		}
+	}
+
+	return &scepSession{
+		cl:         cl,
+		logger:     logger,
+		caCerts:    certs,
+		recipients: recipients,
+		signerKey:  scepTmpKey,
+		signerCert: scepTmpCert,
+		algs:       algs,
+		clockSkew:  req.ClockSkew,
+	}, nil
+}
+
+// certRep sends a PKIOperation and processes the CertRep response. A
+// PENDING response returns no certificate and no error.
+func (s *scepSession) certRep(ctx context.Context, op string, raw []byte) (*x509.Certificate, error) {
+	release := acquireSCEP()
+	respBytes, err := s.cl.PKIOperation(ctx, raw)
+	release()
+	if err != nil {
+		return nil, fmt.Errorf("PKIOperation for %s: %w", op, err)
+	}
+
+	respMsg, err := scep.ParsePKIMessage(respBytes, scep.WithLogger(level.Debug(s.logger)), scep.WithCACerts(s.recipients))
+	if err != nil {
+		return nil, fmt.Errorf("%s parsing pkiMessage response: %w", op, err)
+	}
+
+	switch respMsg.PKIStatus {
+	case scep.SUCCESS:
+	case scep.PENDING:
+		level.Info(s.logger).Log("msg", "server has not yet issued a certificate", "op", op, "pki_status", "PENDING")
+		return nil, nil
+	case scep.FAILURE:
+		return nil, fmt.Errorf("%s %w: failInfo %s", op, errSCEPFailure, failInfoString(respMsg.FailInfo))
+	default:
+		return nil, fmt.Errorf("%s %w: %+v", op, errSCEPFailure, respMsg)
 	}
 
-	tmpl := &scep.PKIMessage{
-		MessageType: scep.PKCSReq,
-		Recipients:  certs,
-		SignerKey:   scepTmpKey,
-		SignerCert:  scepTmpCert,
+	level.Info(s.logger).Log("msg", "server returned a certificate", "op", op, "pki_status", "SUCCESS")
+
+	if err := respMsg.DecryptPKIEnvelope(s.signerCert, s.signerKey); err != nil {
+		return nil, fmt.Errorf("%s decrypt pkiEnvelope: %s: %w", op, respMsg.PKIStatus, err)
 	}
 
-	if challenge != "" {
-		tmpl.CSRReqMessage = &scep.CSRReqMessage{
-			ChallengePassword: challenge,
+	return respMsg.CertRepMessage.Certificate, nil
+}
+
+// SCEP OIDs, from the scep package
+var (
+	oidSCEPmessageType   = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPsenderNonce   = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPtransactionID = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+type issuerAndSubject struct {
+	Issuer  asn1.RawValue
+	Subject asn1.RawValue
+}
+
+// newCertPoll creates a CertPoll (GetCertInitial) PKIMessage which the
+// scep package doesn't support
+func (s *scepSession) newCertPoll(csr *x509.CertificateRequest, transactionID scep.TransactionID) ([]byte, error) {
+	issuer := s.caCerts[0]
+	for _, c := range s.caCerts {
+		if c.IsCA {
+			issuer = c
+			break
 		}
 	}
+	der, err := asn1.Marshal(issuerAndSubject{
+		Issuer:  asn1.RawValue{FullBytes: issuer.RawSubject},
+		Subject: asn1.RawValue{FullBytes: csr.RawSubject},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return s.signedPKIMessage(der, scep.CertPoll, transactionID)
+}
 
-	csr, err := x509.ParseCertificateRequest(csrBytes)
+// newPKCSReq creates a PKCSReq PKIMessage for csr and returns it with its
+// transaction ID. Unlike scep.NewCSRRequest it uses the negotiated
+// algorithms.
+func (s *scepSession) newPKCSReq(csr *x509.CertificateRequest) ([]byte, scep.TransactionID, error) {
+	// the transaction ID is derived from the public key as the scep
+	// package (and Apple devices) do
+	id, err := cryptoutil.GenerateSubjectKeyID(csr.PublicKey)
+	if err != nil {
+		return nil, "", err
+	}
+	transactionID := scep.TransactionID(base64.StdEncoding.EncodeToString(id))
+	raw, err := s.signedPKIMessage(csr.Raw, scep.PKCSReq, transactionID)
+	return raw, transactionID, err
+}
+
+// signedPKIMessage envelopes content for the CA recipients and signs it
+// with the SCEP attributes for msgType
+func (s *scepSession) signedPKIMessage(content []byte, msgType scep.MessageType, transactionID scep.TransactionID) ([]byte, error) {
+	e7, err := pkcs7Encrypt(content, s.recipients, s.algs.Cipher)
 	if err != nil {
 		return nil, err
 	}
+	signedData, err := pkcs7.NewSignedData(e7)
+	if err != nil {
+		return nil, err
+	}
+	signedData.SetDigestAlgorithm(s.algs.Digest)
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	err = signedData.AddSigner(s.signerCert, s.signerKey, pkcs7.SignerInfoConfig{
+		ExtraSignedAttributes: []pkcs7.Attribute{
+			{Type: oidSCEPtransactionID, Value: transactionID},
+			{Type: oidSCEPmessageType, Value: string(msgType)},
+			{Type: oidSCEPsenderNonce, Value: nonce},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if s.clockSkew != 0 {
+		err = skewSigningTime(signedData, s.signerKey, s.algs.Digest, time.Now().Add(s.clockSkew))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return signedData.Finish()
+}
 
-	msg, err := scep.NewCSRRequest(csr, tmpl, scep.WithLogger(logger), scep.WithCertsSelector(selector))
+// skewSigningTime replaces the signing time attribute, which the pkcs7
+// package always sets to the real time, of the signers of sd with t and
+// re-signs their signed attributes with key
+func skewSigningTime(sd *pkcs7.SignedData, key *rsa.PrivateKey, digest asn1.ObjectIdentifier, t time.Time) error {
+	hash := crypto.SHA1
+	switch {
+	case digest.Equal(pkcs7.OIDDigestAlgorithmSHA256):
+		hash = crypto.SHA256
+	case digest.Equal(pkcs7.OIDDigestAlgorithmSHA512):
+		hash = crypto.SHA512
+	}
+	signingTime, err := asn1.Marshal(t.UTC())
 	if err != nil {
-		return nil, fmt.Errorf("creating csr pkiMessage: %w", err)
+		return err
 	}
+	signerInfos := sd.GetSignedData().SignerInfos
+	for i := range signerInfos {
+		attrs := signerInfos[i].AuthenticatedAttributes
+		for j := range attrs {
+			if attrs[j].Type.Equal(pkcs7.OIDAttributeSigningTime) {
+				attrs[j].Value = asn1.RawValue{Tag: asn1.TagSet, IsCompound: true, Bytes: signingTime}
+			}
+		}
+		// the signature is over the DER SET OF the signed attributes
+		attrsDER, err := asn1.MarshalWithParams(attrs, "set")
+		if err != nil {
+			return err
+		}
+		h := hash.New()
+		h.Write(attrsDER)
+		signerInfos[i].EncryptedDigest, err = rsa.SignPKCS1v15(rand.Reader, key, hash, h.Sum(nil))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// poll sends CertPoll requests until the certificate is issued, the CA
+// rejects the request, or the poll timeout elapses
+func (s *scepSession) poll(ctx context.Context, req *scepRequest, csr *x509.CertificateRequest, transactionID scep.TransactionID) (*x509.Certificate, error) {
+	interval := req.PollInterval
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	polls := int(req.PollTimeout / interval)
+	for i := 0; i < polls; i++ {
+		time.Sleep(interval)
+		raw, err := s.newCertPoll(csr, transactionID)
+		if err != nil {
+			return nil, fmt.Errorf("creating CertPoll pkiMessage: %w", err)
+		}
+		cert, err := s.certRep(ctx, "CertPoll", raw)
+		if err != nil || cert != nil {
+			return cert, err
+		}
+	}
+	return nil, &scepPendingError{TransactionID: string(transactionID)}
+}
 
-	respBytes, err := cl.PKIOperation(ctx, msg.Raw)
+// scepNewPKCSReq performs a SCEP PKCSReq, polling if the CA responds PENDING
+func scepNewPKCSReq(csrBytes []byte, req *scepRequest) (*x509.Certificate, error) {
+	ctx := context.Background()
+	sess, err := newSCEPSession(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("PKIOperation for PKCSReq: %w", err)
+		return nil, err
 	}
 
-	respMsg, err := scep.ParsePKIMessage(respBytes, scep.WithLogger(logger), scep.WithCACerts(msg.Recipients))
+	csr, err := x509.ParseCertificateRequest(csrBytes)
 	if err != nil {
-		return nil, fmt.Errorf("PKCSReq parsing pkiMessage response: %w", err)
+		return nil, err
 	}
 
-	if respMsg.PKIStatus != scep.SUCCESS {
-		return nil, fmt.Errorf("PKCSReq request failed: %+v", respMsg)
+	// the challenge password is in the CSR
+	raw, transactionID, err := sess.newPKCSReq(csr)
+	if err != nil {
+		return nil, fmt.Errorf("creating csr pkiMessage: %w", err)
 	}
 
-	logger.Log("pkiStatus", "SUCCESS", "msg", "server returned a certificate.")
+	signer := "self-signed"
+	if req.SignerCert != nil {
+		signer = req.SignerCert.Subject.String()
+	}
+	level.Info(sess.logger).Log("msg", "SCEP request", "op", "PKCSReq", "url", req.URL, "transaction_id", transactionID, "signer", signer)
+	cert, err := sess.certRep(ctx, "PKCSReq", raw)
+	if err == nil && cert == nil {
+		cert, err = sess.poll(ctx, req, csr, transactionID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cert, validateIssuedCertificate(cert, csr, time.Now().Add(req.ClockSkew))
+}
 
-	if err := respMsg.DecryptPKIEnvelope(scepTmpCert, scepTmpKey); err != nil {
-		return nil, fmt.Errorf("PKCSReq decrypt pkiEnvelope: %s: %w", respMsg.PKIStatus, err)
+// scepResumeCertPoll resumes polling for a previously pending request
+func scepResumeCertPoll(csrBytes []byte, req *scepRequest, transactionID string) (*x509.Certificate, error) {
+	ctx := context.Background()
+	sess, err := newSCEPSession(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, err
+	}
+	txID := scep.TransactionID(transactionID)
+	raw, err := sess.newCertPoll(csr, txID)
+	if err != nil {
+		return nil, fmt.Errorf("creating CertPoll pkiMessage: %w", err)
 	}
+	level.Info(sess.logger).Log("msg", "SCEP request", "op", "CertPoll", "url", req.URL, "transaction_id", txID)
+	cert, err := sess.certRep(ctx, "CertPoll", raw)
+	if err == nil && cert == nil {
+		cert, err = sess.poll(ctx, req, csr, txID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return cert, validateIssuedCertificate(cert, csr, time.Now().Add(req.ClockSkew))
+}
 
-	return respMsg.CertRepMessage.Certificate, nil
+// validateIssuedCertificate checks that the CA issued a certificate for
+// csr: for its public key and subject CN, and not already expired
+func validateIssuedCertificate(cert *x509.Certificate, csr *x509.CertificateRequest, now time.Time) error {
+	if cert == nil {
+		return errors.New("CA returned no certificate")
+	}
+	certPub, ok := cert.PublicKey.(*rsa.PublicKey)
+	csrPub, csrOK := csr.PublicKey.(*rsa.PublicKey)
+	if !ok || !csrOK || certPub.N.Cmp(csrPub.N) != 0 || certPub.E != csrPub.E {
+		return fmt.Errorf("CA issued certificate (serial %s) for a different key than requested: check the CA/RA configuration", cert.SerialNumber)
+	}
+	if cert.Subject.CommonName != csr.Subject.CommonName {
+		return fmt.Errorf("CA issued certificate with CN %q but %q was requested", cert.Subject.CommonName, csr.Subject.CommonName)
+	}
+	if !now.Before(cert.NotAfter) {
+		return fmt.Errorf("CA issued certificate already expired (not after %s)", cert.NotAfter)
+	}
+	return nil
 }
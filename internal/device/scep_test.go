@@ -0,0 +1,343 @@
+package device
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jessepeterson/cfgprofiles"
+	"github.com/jessepeterson/mdmb/testutil"
+)
+
+// testSCEPServer starts a fake SCEP CA for the test
+func testSCEPServer(t *testing.T) *testutil.SCEPServer {
+	t.Helper()
+	srv, err := testutil.NewSCEPServer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// testCSR returns a DER CSR with a new key and common name cn
+func testCSR(t *testing.T, cn string) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeyCSR(t, key, cn)
+}
+
+// testKeyCSR returns a DER CSR for key with common name cn
+func testKeyCSR(t *testing.T, key *rsa.PrivateKey, cn string) []byte {
+	t.Helper()
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: cn},
+	}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return csr
+}
+
+func TestSCEPPoll(t *testing.T) {
+	srv := testSCEPServer(t)
+	for _, test := range []struct {
+		pending  int
+		requests int
+		issued   bool
+	}{
+		{0, 1, true},
+		{1, 2, true},
+		// the last poll is at the poll timeout
+		{2, 3, true},
+		{3, 3, false},
+	} {
+		srv.Pending = test.pending
+		before := len(srv.Requests())
+		_, err := scepNewPKCSReq(testCSR(t, "test"), &scepRequest{
+			URL:          srv.URL(),
+			PollInterval: 5 * time.Millisecond,
+			PollTimeout:  10 * time.Millisecond,
+		})
+		var pendingErr *scepPendingError
+		if test.issued && err != nil {
+			t.Errorf("pending %d: %v", test.pending, err)
+		} else if !test.issued && !errors.As(err, &pendingErr) {
+			t.Errorf("pending %d: have error %v, want a pending error", test.pending, err)
+		}
+		if have := len(srv.Requests()) - before; have != test.requests {
+			t.Errorf("pending %d: have %d PKIOperations, want %d", test.pending, have, test.requests)
+		}
+	}
+}
+
+func TestSCEPClockSkew(t *testing.T) {
+	srv := testSCEPServer(t)
+	for _, skew := range []time.Duration{-2 * time.Hour, 2 * time.Hour} {
+		_, err := scepNewPKCSReq(testCSR(t, "test"), &scepRequest{
+			URL:       srv.URL(),
+			ClockSkew: skew,
+		})
+		if err != nil {
+			// the CA rejects a signing time outside the signer validity
+			t.Fatalf("skew %s: %v", skew, err)
+		}
+		reqs := srv.Requests()
+		want := time.Now().Add(skew)
+		if have := reqs[len(reqs)-1].SigningTime; have.Before(want.Add(-time.Minute)) || have.After(want) {
+			t.Errorf("skew %s: have signing time %s, want about %s", skew, have, want)
+		}
+	}
+}
+
+func TestValidateIssuedCertificate(t *testing.T) {
+	srv := testSCEPServer(t)
+	srv.Validity = time.Hour
+	for _, test := range []struct {
+		skew  time.Duration
+		valid bool
+	}{
+		{0, true},
+		{-2 * time.Hour, true},
+		// already expired by the device clock
+		{2 * time.Hour, false},
+	} {
+		_, err := scepNewPKCSReq(testCSR(t, "test"), &scepRequest{
+			URL:       srv.URL(),
+			ClockSkew: test.skew,
+		})
+		if test.valid && err != nil {
+			t.Errorf("skew %s: %v", test.skew, err)
+		} else if !test.valid && err == nil {
+			t.Errorf("skew %s: want an expired certificate error", test.skew)
+		}
+	}
+
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		name  string
+		csr   []byte
+		valid bool
+	}{
+		{"other key", testCSR(t, cert.Subject.CommonName), false},
+		{"other CN", testKeyCSR(t, key, "other"), false},
+		{"matching", testKeyCSR(t, key, cert.Subject.CommonName), true},
+	} {
+		csr, err := x509.ParseCertificateRequest(test.csr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = validateIssuedCertificate(cert, csr, time.Now())
+		if test.valid != (err == nil) {
+			t.Errorf("%s: have error %v, want valid %v", test.name, err, test.valid)
+		}
+	}
+}
+
+func TestFingerprintHash(t *testing.T) {
+	for _, test := range []struct {
+		length int
+		hash   crypto.Hash
+		valid  bool
+	}{
+		{0, 0, true},
+		{16, crypto.MD5, true},
+		{20, crypto.SHA1, true},
+		{32, crypto.SHA256, true},
+		{64, crypto.SHA512, true},
+		{31, 0, false},
+		{48, 0, false},
+	} {
+		hash, err := fingerprintHash(make([]byte, test.length))
+		if test.valid != (err == nil) {
+			t.Errorf("length %d: have error %v, want valid %v", test.length, err, test.valid)
+		}
+		if hash != test.hash {
+			t.Errorf("length %d: have hash %v, want %v", test.length, hash, test.hash)
+		}
+	}
+}
+
+func TestSCEPFingerprintSHA512(t *testing.T) {
+	srv := testSCEPServer(t)
+	fingerprint := sha512.Sum512(srv.CACert.Raw)
+	other := sha512.Sum512([]byte("other"))
+	for _, test := range []struct {
+		name        string
+		fingerprint []byte
+		valid       bool
+	}{
+		{"CA", fingerprint[:], true},
+		{"other", other[:], false},
+	} {
+		sess, err := newSCEPSession(context.Background(), &scepRequest{
+			URL:         srv.URL(),
+			Fingerprint: test.fingerprint,
+		})
+		if !test.valid {
+			if err == nil {
+				t.Errorf("%s: want an error for an unpinned CA", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if len(sess.recipients) != 1 || !sess.recipients[0].Equal(srv.CACert) {
+			t.Errorf("%s: have recipients %v, want the CA", test.name, sess.recipients)
+		}
+	}
+}
+
+func TestKeyFromSCEPProfilePayload(t *testing.T) {
+	for _, test := range []struct {
+		keyType string
+		keySize int
+		want    int
+	}{
+		{"", 0, defaultRSAKeySize},
+		{"RSA", 1024, 1024},
+		{"RSA", 512, 0},
+		{"ECSECPrimeRandom", 256, 0},
+	} {
+		pl := cfgprofiles.NewSCEPPayload("com.example.scep")
+		pl.PayloadContent.KeyType = test.keyType
+		pl.PayloadContent.KeySize = test.keySize
+		key, err := keyFromSCEPProfilePayload(pl, rand.Reader)
+		if test.want == 0 {
+			if err == nil {
+				t.Errorf("%s %d: want an error", test.keyType, test.keySize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s %d: %v", test.keyType, test.keySize, err)
+		}
+		if have := key.N.BitLen(); have != test.want {
+			t.Errorf("%s %d: have %d bit key, want %d", test.keyType, test.keySize, have, test.want)
+		}
+	}
+}
+
+func TestSelfSignValidity(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	for _, test := range []struct {
+		validity time.Duration
+		want     time.Duration
+	}{
+		{0, defaultSignerValidity},
+		{time.Hour, time.Hour},
+	} {
+		_, cert, err := selfSign(now, test.validity)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := now.Add(-signerBackdate); !cert.NotBefore.Equal(want) {
+			t.Errorf("validity %s: have not before %s, want %s", test.validity, cert.NotBefore, want)
+		}
+		if want := now.Add(test.want); !cert.NotAfter.Equal(want) {
+			t.Errorf("validity %s: have not after %s, want %s", test.validity, cert.NotAfter, want)
+		}
+	}
+}
+
+func TestSubjectFromSCEPProfilePayload(t *testing.T) {
+	var (
+		oidO  = asn1.ObjectIdentifier{2, 5, 4, 10}
+		oidOU = asn1.ObjectIdentifier{2, 5, 4, 11}
+	)
+	device := &Device{Serial: "SERIAL"}
+	for _, test := range []struct {
+		name    string
+		subject [][][]string
+		want    pkix.RDNSequence
+	}{
+		{
+			name:    "ordered multi-valued RDN",
+			subject: [][][]string{{{"O", "Example"}}, {{"CN", "%SerialNumber%"}, {"OU", "IT"}}},
+			want: pkix.RDNSequence{
+				{{Type: oidO, Value: "Example"}},
+				{{Type: oidCommonName, Value: "SERIAL"}, {Type: oidOU, Value: "IT"}},
+			},
+		},
+		{
+			name:    "dotted OID",
+			subject: [][][]string{{{"2.5.4.11", "IT"}}, {{"CN", "device"}}},
+			want: pkix.RDNSequence{
+				{{Type: oidOU, Value: "IT"}},
+				{{Type: oidCommonName, Value: "device"}},
+			},
+		},
+		{
+			name:    "default CN",
+			subject: [][][]string{{{"O", "Example"}}},
+			want: pkix.RDNSequence{
+				{{Type: oidO, Value: "Example"}},
+				{{Type: oidCommonName, Value: "com.example.scep"}},
+			},
+		},
+	} {
+		pl := cfgprofiles.NewSCEPPayload("com.example.scep")
+		pl.PayloadContent.Subject = test.subject
+		key, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := csrFromSCEPProfilePayload(pl, nil, device, rand.Reader, key)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		want, err := asn1.Marshal(test.want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(csr.RawSubject, want) {
+			t.Errorf("%s: have subject %s, want %s", test.name, csr.Subject, test.want)
+		}
+	}
+}
+
+func TestSCEPEnroll(t *testing.T) {
+	pl := cfgprofiles.NewSCEPPayload("com.example.scep")
+	pl.PayloadContent = cfgprofiles.SCEPPayloadContent{
+		URL:           "https://scep.example.com/scep",
+		Name:          "CA-IDENT",
+		Challenge:     "secret",
+		CAFingerprint: make([]byte, 32),
+	}
+	req := scepRequestFromPayload(pl, nil)
+	if req.URL != pl.PayloadContent.URL || req.CAMessage != "CA-IDENT" || req.Challenge != "secret" || !bytes.Equal(req.Fingerprint, pl.PayloadContent.CAFingerprint) {
+		t.Errorf("have request %+v, want the payload URL, Name, Challenge, and CAFingerprint", req)
+	}
+
+	device, _, scepSrv := enrollSCEPTestDevice(t, NewMemoryStore(), nil)
+	cert, _, err := device.MDMIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.CheckSignatureFrom(scepSrv.CACert); err != nil {
+		t.Errorf("MDM identity not issued by the SCEP CA: %v", err)
+	}
+	if cert.Subject.CommonName != device.UDID {
+		t.Errorf("have MDM identity CN %q, want the UDID %q", cert.Subject.CommonName, device.UDID)
+	}
+}
@@ -0,0 +1,177 @@
+package device
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+
+	"go.mozilla.org/pkcs7"
+)
+
+// scepAlgorithms are the digest and envelope content encryption used for
+// the PKIMessages sent to a CA
+type scepAlgorithms struct {
+	Digest     asn1.ObjectIdentifier
+	DigestName string
+	Cipher     asn1.ObjectIdentifier
+	CipherName string
+}
+
+// parseSCEPCaps splits a GetCACaps response into its capabilities
+func parseSCEPCaps(b []byte) (caps []string) {
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		if c := strings.TrimSpace(scanner.Text()); c != "" {
+			caps = append(caps, c)
+		}
+	}
+	return
+}
+
+// negotiateSCEPAlgorithms selects the digest and cipher from the CA's
+// capabilities, falling back to SHA-1 and DES which any CA supports.
+// SCEPStandard (RFC 8894) implies SHA-256 and AES. AES is preferred over
+// 3DES (DES3).
+func negotiateSCEPAlgorithms(caps []string) scepAlgorithms {
+	has := make(map[string]bool)
+	for _, c := range caps {
+		has[strings.ToUpper(c)] = true
+	}
+	algs := scepAlgorithms{
+		Digest:     pkcs7.OIDDigestAlgorithmSHA1,
+		DigestName: "SHA-1",
+		Cipher:     pkcs7.OIDEncryptionAlgorithmDESCBC,
+		CipherName: "DES",
+	}
+	switch {
+	case has["SHA-256"] || has["SCEPSTANDARD"]:
+		algs.Digest, algs.DigestName = pkcs7.OIDDigestAlgorithmSHA256, "SHA-256"
+	case has["SHA-512"]:
+		algs.Digest, algs.DigestName = pkcs7.OIDDigestAlgorithmSHA512, "SHA-512"
+	}
+	switch {
+	case has["AES"] || has["SCEPSTANDARD"]:
+		algs.Cipher, algs.CipherName = pkcs7.OIDEncryptionAlgorithmAES128CBC, "AES-128-CBC"
+	case has["DES3"]:
+		algs.Cipher, algs.CipherName = pkcs7.OIDEncryptionAlgorithmDESEDE3CBC, "DES-EDE3-CBC"
+	}
+	return algs
+}
+
+// PKCS#7 enveloped data structures, as in the pkcs7 package
+type p7ContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,optional,tag:0"`
+}
+
+type p7EnvelopedData struct {
+	Version              int
+	RecipientInfos       []p7RecipientInfo `asn1:"set"`
+	EncryptedContentInfo p7EncryptedContentInfo
+}
+
+type p7RecipientInfo struct {
+	Version                int
+	IssuerAndSerialNumber  p7IssuerAndSerial
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type p7IssuerAndSerial struct {
+	IssuerName   asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type p7EncryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           asn1.RawValue `asn1:"tag:0,optional"`
+}
+
+// pkcs7Encrypt creates PKCS#7 enveloped data of content for recipients
+// with the CBC content encryption algorithm cipherOID (DES, 3DES, or
+// AES-128). pkcs7.Encrypt can't be used as it takes the algorithm from a
+// package global, shared with every other pkcs7 user in the process, and
+// doesn't support 3DES.
+func pkcs7Encrypt(content []byte, recipients []*x509.Certificate, cipherOID asn1.ObjectIdentifier) ([]byte, error) {
+	var key []byte
+	var newCipher func([]byte) (cipher.Block, error)
+	switch {
+	case cipherOID.Equal(pkcs7.OIDEncryptionAlgorithmDESCBC):
+		key, newCipher = make([]byte, 8), des.NewCipher
+	case cipherOID.Equal(pkcs7.OIDEncryptionAlgorithmDESEDE3CBC):
+		key, newCipher = make([]byte, 24), des.NewTripleDESCipher
+	case cipherOID.Equal(pkcs7.OIDEncryptionAlgorithmAES128CBC):
+		key, newCipher = make([]byte, 16), aes.NewCipher
+	default:
+		return nil, fmt.Errorf("unsupported content encryption algorithm %s", cipherOID)
+	}
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	block, err := newCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+	padLen := block.BlockSize() - len(content)%block.BlockSize()
+	ciphertext := append(append([]byte(nil), content...), bytes.Repeat([]byte{byte(padLen)}, padLen)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	encryptedContent, err := asn1.Marshal(ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	recipientInfos := make([]p7RecipientInfo, len(recipients))
+	for i, recipient := range recipients {
+		pub, ok := recipient.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return nil, errors.New("PKCS#7 recipient key must be RSA")
+		}
+		encryptedKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+		if err != nil {
+			return nil, err
+		}
+		recipientInfos[i] = p7RecipientInfo{
+			IssuerAndSerialNumber: p7IssuerAndSerial{
+				IssuerName:   asn1.RawValue{FullBytes: recipient.RawIssuer},
+				SerialNumber: recipient.SerialNumber,
+			},
+			KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: pkcs7.OIDEncryptionAlgorithmRSA},
+			EncryptedKey:           encryptedKey,
+		}
+	}
+
+	envelope, err := asn1.Marshal(p7EnvelopedData{
+		RecipientInfos: recipientInfos,
+		EncryptedContentInfo: p7EncryptedContentInfo{
+			ContentType: pkcs7.OIDData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{
+				Algorithm:  cipherOID,
+				Parameters: asn1.RawValue{Tag: asn1.TagOctetString, Bytes: iv},
+			},
+			EncryptedContent: asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encryptedContent},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(p7ContentInfo{
+		ContentType: pkcs7.OIDEnvelopedData,
+		Content:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: envelope},
+	})
+}
@@ -0,0 +1,54 @@
+package device
+
+import (
+	"bytes"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	"go.mozilla.org/pkcs7"
+)
+
+func TestNegotiateSCEPAlgorithms(t *testing.T) {
+	for _, test := range []struct {
+		caps       []string
+		digestName string
+		cipherName string
+	}{
+		{nil, "SHA-1", "DES"},
+		{[]string{"SHA-256", "DES3"}, "SHA-256", "DES-EDE3-CBC"},
+		{[]string{"SHA-512", "DES3", "AES"}, "SHA-512", "AES-128-CBC"},
+		{[]string{"SCEPStandard"}, "SHA-256", "AES-128-CBC"},
+	} {
+		algs := negotiateSCEPAlgorithms(test.caps)
+		if algs.DigestName != test.digestName || algs.CipherName != test.cipherName {
+			t.Errorf("%v: have %s/%s, want %s/%s", test.caps, algs.DigestName, algs.CipherName, test.digestName, test.cipherName)
+		}
+	}
+}
+
+func TestPKCS7Encrypt(t *testing.T) {
+	key, cert, err := selfSign(time.Now(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := []byte("certificate request")
+	for _, caps := range [][]string{nil, {"DES3"}, {"AES"}} {
+		algs := negotiateSCEPAlgorithms(caps)
+		e7, err := pkcs7Encrypt(content, []*x509.Certificate{cert}, algs.Cipher)
+		if err != nil {
+			t.Fatalf("%s: %v", algs.CipherName, err)
+		}
+		p7, err := pkcs7.Parse(e7)
+		if err != nil {
+			t.Fatalf("%s: %v", algs.CipherName, err)
+		}
+		decrypted, err := p7.Decrypt(cert, key)
+		if err != nil {
+			t.Fatalf("%s: %v", algs.CipherName, err)
+		}
+		if !bytes.Equal(decrypted, content) {
+			t.Errorf("%s: have decrypted %q, want %q", algs.CipherName, decrypted, content)
+		}
+	}
+}
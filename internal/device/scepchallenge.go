@@ -0,0 +1,57 @@
+package device
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// maxSCEPChallengeSize limits the size of a fetched challenge response
+const maxSCEPChallengeSize = 64 * 1024
+
+// resolveSCEPChallenge sets the challenge of a SCEP payload to use in its
+// CSR. If challengeURL is set the challenge is fetched from it, as from a
+// dynamic challenge endpoint. Otherwise it is the payload's challenge.
+// SCEP variables (like %SerialNumber%) are replaced in either the URL or
+// the payload's challenge so the challenge can be bound to the device.
+func (device *Device) resolveSCEPChallenge(pl *cfgprofiles.SCEPPayload, challengeURL string) error {
+	if challengeURL == "" {
+		pl.PayloadContent.Challenge = replaceSCEPVars(device, []string{pl.PayloadContent.Challenge})[0]
+		return nil
+	}
+	challenge, err := device.fetchSCEPChallenge(replaceSCEPVars(device, []string{challengeURL})[0])
+	if err != nil {
+		return fmt.Errorf("fetching SCEP challenge: %w", err)
+	}
+	pl.PayloadContent.Challenge = challenge
+	return nil
+}
+
+// fetchSCEPChallenge GETs a challenge from url. The (trimmed) response
+// body is the challenge.
+func (device *Device) fetchSCEPChallenge(url string) (string, error) {
+	level.Info(device.logger()).Log("msg", "fetching SCEP challenge", "url", url)
+	resp, err := NewHTTPClient(nil).Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxSCEPChallengeSize))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP status %s", resp.Status)
+	}
+	challenge := strings.TrimSpace(string(body))
+	if challenge == "" {
+		return "", errors.New("empty challenge")
+	}
+	return challenge, nil
+}
@@ -0,0 +1,96 @@
+package device
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// scepSubjectAltName is the SCEP payload SubjectAltName dictionary. It
+// isn't yet decoded by cfgprofiles so we decode it from the raw profile.
+type scepSubjectAltName struct {
+	DNSNames         []string
+	RFC822Names      []string
+	URIs             []string
+	IPAddresses      []string
+	NTPrincipalNames []string
+}
+
+// stringOrStrings normalizes a plist string or array of strings
+func stringOrStrings(v interface{}) (ret []string) {
+	switch s := v.(type) {
+	case string:
+		ret = append(ret, s)
+	case []interface{}:
+		for _, e := range s {
+			if es, ok := e.(string); ok {
+				ret = append(ret, es)
+			}
+		}
+	}
+	return
+}
+
+// scepSubjectAltNames decodes the SubjectAltName of each SCEP payload in
+// a raw profile, keyed by PayloadUUID
+func scepSubjectAltNames(pb []byte) (map[string]*scepSubjectAltName, error) {
+	raw := &struct {
+		PayloadContent []map[string]interface{}
+	}{}
+	err := plist.Unmarshal(pb, raw)
+	if err != nil {
+		return nil, err
+	}
+	sans := make(map[string]*scepSubjectAltName)
+	for _, pld := range raw.PayloadContent {
+		if pld["PayloadType"] != "com.apple.security.scep" {
+			continue
+		}
+		plc, _ := pld["PayloadContent"].(map[string]interface{})
+		sanDict, _ := plc["SubjectAltName"].(map[string]interface{})
+		if sanDict == nil {
+			continue
+		}
+		uuid, _ := pld["PayloadUUID"].(string)
+		sans[uuid] = &scepSubjectAltName{
+			DNSNames:         stringOrStrings(sanDict["dNSName"]),
+			RFC822Names:      stringOrStrings(sanDict["rfc822Name"]),
+			URIs:             stringOrStrings(sanDict["uniformResourceIdentifier"]),
+			IPAddresses:      stringOrStrings(sanDict["iPAddress"]),
+			NTPrincipalNames: stringOrStrings(sanDict["ntPrincipalName"]),
+		}
+	}
+	return sans, nil
+}
+
+// apply adds the SANs to the CSR template after substituting SCEP variables
+func (san *scepSubjectAltName) apply(tmpl *x509.CertificateRequest, device *Device) error {
+	if san == nil {
+		return nil
+	}
+	tmpl.DNSNames = append(tmpl.DNSNames, replaceSCEPVars(device, san.DNSNames)...)
+	tmpl.EmailAddresses = append(tmpl.EmailAddresses, replaceSCEPVars(device, san.RFC822Names)...)
+	for _, v := range replaceSCEPVars(device, san.URIs) {
+		u, err := url.Parse(v)
+		if err != nil {
+			return fmt.Errorf("invalid SubjectAltName URI: %w", err)
+		}
+		tmpl.URIs = append(tmpl.URIs, u)
+	}
+	for _, v := range replaceSCEPVars(device, san.IPAddresses) {
+		ip := net.ParseIP(v)
+		if ip == nil {
+			return fmt.Errorf("invalid SubjectAltName IP address: %s", v)
+		}
+		tmpl.IPAddresses = append(tmpl.IPAddresses, ip)
+	}
+	if len(san.NTPrincipalNames) > 0 {
+		// TODO: requires encoding an otherName SAN
+		level.Warn(device.logger()).Log("msg", "SubjectAltName ntPrincipalName not supported, ignoring")
+	}
+	return nil
+}
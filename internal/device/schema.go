@@ -0,0 +1,190 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// SchemaVersion is the version of the Store layout this package
+// expects. Bump it by adding a migration.
+var SchemaVersion = migrations[len(migrations)-1].version
+
+const (
+	metaBucket       = "meta"
+	schemaVersionKey = "schema_version"
+)
+
+// ErrNewerSchema is returned when opening a DB written by a newer mdmb
+var ErrNewerSchema = errors.New("database schema is newer than this mdmb supports")
+
+// migration upgrades a DB from the previous schema version to version
+type migration struct {
+	version     int
+	description string
+	migrate     func(tx Tx) error
+}
+
+// migrations are run in order on DBs with an older schema. A DB from
+// before schema versions were recorded is version 1.
+var migrations = []migration{
+	{1, "initial schema", func(Tx) error { return nil }},
+	{2, "store the platform of existing devices", migratePlatforms},
+	{3, "tag apps installed by MDM as managed", migrateManagedApps},
+	{4, "key payload refs by profile store", migratePayloadRefKeys},
+	{5, "tag profiles installed by MDM as managed", migrateManagedProfiles},
+}
+
+// DBSchemaVersion returns the schema version of db without migrating it:
+// the recorded version, 1 for a DB with devices but no recorded version,
+// or 0 for a new DB
+func DBSchemaVersion(db Store) (version int, err error) {
+	err = db.View(func(tx Tx) error {
+		version = BucketGetInt(tx, metaBucket, schemaVersionKey)
+		if version == 0 && len(tx.KeysWithPrefix("device_serial", "")) > 0 {
+			version = 1
+		}
+		return nil
+	})
+	return
+}
+
+// txSchemaVersion returns the schema version of the DB: the recorded
+// version, 1 for a DB without one, or SchemaVersion for a new DB (one
+// without devices, which has nothing to migrate)
+func txSchemaVersion(tx Tx) (int, error) {
+	version := BucketGetInt(tx, metaBucket, schemaVersionKey)
+	if version == 0 {
+		if len(tx.KeysWithPrefix("device_serial", "")) == 0 {
+			return SchemaVersion, nil
+		}
+		version = 1
+	}
+	if version > SchemaVersion {
+		return version, fmt.Errorf("%w: version %d, expected at most %d", ErrNewerSchema, version, SchemaVersion)
+	}
+	return version, nil
+}
+
+// migrateSchema runs the migrations after version and records the
+// resulting SchemaVersion
+func migrateSchema(tx Tx, version int) error {
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		if err := m.migrate(tx); err != nil {
+			return fmt.Errorf("migrating database schema to version %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	return BucketPutOrDeleteInt(tx, metaBucket, schemaVersionKey, SchemaVersion)
+}
+
+// migratePlatforms derives the platform of devices saved before platforms
+// were stored from their product name
+func migratePlatforms(tx Tx) error {
+	for _, udid := range tx.KeysWithPrefix("device_serial", "") {
+		if BucketGetString(tx, "device_platform", udid) != "" {
+			continue
+		}
+		productName := BucketGetString(tx, "device_product_name", udid)
+		err := BucketPutOrDeleteString(tx, "device_platform", udid, platformForProductName(productName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateManagedApps sets Managed for the apps of devices saved before
+// apps were tagged, which were managed if they had an install state
+func migrateManagedApps(tx Tx) error {
+	for _, udid := range tx.KeysWithPrefix("device_apps", "") {
+		var apps []App
+		if err := json.Unmarshal(BucketGet(tx, "device_apps", udid), &apps); err != nil {
+			return fmt.Errorf("apps of device %s: %w", udid, err)
+		}
+		for i := range apps {
+			if apps[i].Status != "" {
+				apps[i].Managed = true
+			}
+		}
+		appsJSON, err := json.Marshal(apps)
+		if err != nil {
+			return err
+		}
+		if err := BucketPutOrDelete(tx, "device_apps", udid, appsJSON); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateManagedProfiles tags the profiles of enrolled devices saved
+// before profiles were tagged as managed. Which of them the MDM server
+// installed wasn't recorded so all are assumed to be, as with MDM
+// enrolled devices they normally are. Devices with any tagged profile
+// (at least their MDM profile) were saved since and are left alone.
+func migrateManagedProfiles(tx Tx) error {
+	for _, udid := range tx.KeysWithPrefix("device_mdm_profile_id", "") {
+		prefix := udid + "_"
+		if len(tx.KeysWithPrefix("profile_managed", prefix)) > 0 {
+			continue
+		}
+		for _, key := range tx.KeysWithPrefix("profiles", prefix) {
+			if err := BucketPutOrDeleteString(tx, "profile_managed", key, "true"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// migratePayloadRefKeys prefixes payload refs saved before they were
+// keyed by profile store with the ID of each store (device) that has the
+// profile installed. Such refs were shared by all devices installing the
+// same profile so each of them gets a copy.
+func migratePayloadRefKeys(tx Tx) error {
+	legacy := make(map[string]bool)
+	for _, udid := range tx.KeysWithPrefix("device_serial", "") {
+		err := BucketForEachWithPrefix(tx, "profiles", udid+"_", true, func(k, v []byte) error {
+			profileID := string(k)
+			p := &cfgprofiles.Profile{}
+			if err := plist.Unmarshal(v, p); err != nil {
+				return fmt.Errorf("loading profile %s of device %s: %w", profileID, udid, err)
+			}
+			for _, plc := range p.PayloadContent {
+				pld := cfgprofiles.CommonPayload(plc.Payload)
+				if pld == nil {
+					continue
+				}
+				prefix := fmt.Sprintf("%s_%s_%s_", profileID, pld.PayloadIdentifier, pld.PayloadUUID)
+				for _, key := range tx.KeysWithPrefix("profile_payload_refs", prefix) {
+					legacy[key] = true
+					newKey := udid + "_" + key
+					if BucketGet(tx, "profile_payload_refs", newKey) != nil {
+						continue
+					}
+					err := BucketPutOrDelete(tx, "profile_payload_refs", newKey, BucketGet(tx, "profile_payload_refs", key))
+					if err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	// deleted last as other devices may share them
+	for key := range legacy {
+		if err := tx.Delete("profile_payload_refs", key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
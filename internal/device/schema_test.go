@@ -0,0 +1,131 @@
+package device
+
+import (
+	"testing"
+
+	"github.com/groob/plist"
+	"github.com/jessepeterson/cfgprofiles"
+)
+
+// testProfile returns a profile with identifier id containing payloads
+func testProfile(t *testing.T, id string, payloads ...map[string]interface{}) []byte {
+	t.Helper()
+	pb, err := plist.Marshal(map[string]interface{}{
+		"PayloadType":       "Configuration",
+		"PayloadVersion":    1,
+		"PayloadIdentifier": id,
+		"PayloadUUID":       id + ".uuid",
+		"PayloadContent":    payloads,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pb
+}
+
+// putLegacyDevice stores a device with the profile pb installed as a DB
+// from before schema versions were recorded would have
+func putLegacyDevice(t *testing.T, db Store, udid, profileID string, pb []byte) {
+	t.Helper()
+	err := db.Update(func(tx Tx) error {
+		if err := BucketPutOrDeleteString(tx, "device_serial", udid, udid+"-serial"); err != nil {
+			return err
+		}
+		return BucketPutOrDelete(tx, "profiles", udid+"_"+profileID, pb)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigratePayloadRefKeys(t *testing.T) {
+	db := NewMemoryStore()
+	pld := &cfgprofiles.Payload{PayloadIdentifier: "com.example.scep", PayloadUUID: "SCEP-UUID"}
+	pb := testProfile(t, "com.example.profile", map[string]interface{}{
+		"PayloadType":       "com.apple.security.scep",
+		"PayloadVersion":    1,
+		"PayloadIdentifier": pld.PayloadIdentifier,
+		"PayloadUUID":       pld.PayloadUUID,
+	})
+	putLegacyDevice(t, db, "UDID-A", "com.example.profile", pb)
+	putLegacyDevice(t, db, "UDID-B", "com.example.profile", pb)
+	legacyKey := "com.example.profile_com.example.scep_SCEP-UUID_keychain_identity"
+	err := db.Update(func(tx Tx) error {
+		return BucketPutOrDeleteString(tx, "profile_payload_refs", legacyKey, "KEYCHAIN-UUID")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateStore(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, udid := range []string{"UDID-A", "UDID-B"} {
+		ref, err := NewProfileStore(udid, db).loadPayloadRefString("com.example.profile", pld, "keychain_identity")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ref != "KEYCHAIN-UUID" {
+			t.Errorf("%s: payload ref: have %q, want %q", udid, ref, "KEYCHAIN-UUID")
+		}
+	}
+	db.View(func(tx Tx) error {
+		if v := tx.Get("profile_payload_refs", legacyKey); v != nil {
+			t.Errorf("legacy payload ref not deleted: %q", v)
+		}
+		return nil
+	})
+
+	// migrating again (e.g. from a DB without a recorded version) must
+	// leave migrated refs alone
+	if err := db.Update(func(tx Tx) error { return migratePayloadRefKeys(tx) }); err != nil {
+		t.Fatal(err)
+	}
+	db.View(func(tx Tx) error {
+		if have, want := len(tx.KeysWithPrefix("profile_payload_refs", "")), 2; have != want {
+			t.Errorf("payload refs after second migration: have %d, want %d", have, want)
+		}
+		return nil
+	})
+}
+
+func TestMigrateManagedProfiles(t *testing.T) {
+	db := NewMemoryStore()
+	pb := testProfile(t, "com.example.profile")
+	putLegacyDevice(t, db, "UDID-ENROLLED", "com.example.mdm", pb)
+	putLegacyDevice(t, db, "UDID-ENROLLED", "com.example.profile", pb)
+	putLegacyDevice(t, db, "UDID-UNENROLLED", "com.example.profile", pb)
+	putLegacyDevice(t, db, "UDID-TAGGED", "com.example.mdm", pb)
+	putLegacyDevice(t, db, "UDID-TAGGED", "com.example.user", pb)
+	err := db.Update(func(tx Tx) error {
+		for _, udid := range []string{"UDID-ENROLLED", "UDID-TAGGED"} {
+			if err := BucketPutOrDeleteString(tx, "device_mdm_profile_id", udid, "com.example.mdm"); err != nil {
+				return err
+			}
+		}
+		// saved since profiles were tagged so its user profile isn't
+		return BucketPutOrDeleteString(tx, "profile_managed", "UDID-TAGGED_com.example.mdm", "true")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := MigrateStore(db); err != nil {
+		t.Fatal(err)
+	}
+
+	for udid, want := range map[string]int{
+		"UDID-ENROLLED":   2,
+		"UDID-UNENROLLED": 0,
+		"UDID-TAGGED":     1,
+	} {
+		ids, err := NewProfileStore(udid, db).ManagedIDs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ids) != want {
+			t.Errorf("%s: have %d managed profiles, want %d", udid, len(ids), want)
+		}
+	}
+}
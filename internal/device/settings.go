@@ -0,0 +1,102 @@
+package device
+
+import (
+	"fmt"
+
+	"github.com/go-kit/kit/log/level"
+	"github.com/groob/plist"
+)
+
+// SettingsItem is an item of a Settings command. Only the keys of the
+// items mdmb recognizes are decoded.
+type SettingsItem struct {
+	Item string
+
+	// DeviceName and HostName items
+	DeviceName string `json:",omitempty" plist:",omitempty"`
+	HostName   string `json:",omitempty" plist:",omitempty"`
+	// Bluetooth, DataRoaming, VoiceRoaming, and PersonalHotspot items
+	Enabled bool `json:",omitempty" plist:",omitempty"`
+	// OrganizationInfo item
+	OrganizationInfo map[string]string `json:",omitempty" plist:",omitempty"`
+	// Wallpaper item. The image isn't kept.
+	Where int    `json:",omitempty" plist:",omitempty"`
+	Image []byte `json:"-" plist:",omitempty"`
+	// TimeZone item
+	TimeZone string `json:",omitempty" plist:",omitempty"`
+}
+
+type SettingsCommand struct {
+	ConnectResponseCommand
+	Settings []SettingsItem
+}
+
+type Settings struct {
+	Command     SettingsCommand
+	CommandUUID string
+}
+
+type SettingsItemResult struct {
+	Item       string
+	Status     string
+	ErrorChain []ErrorChain `plist:",omitempty"`
+}
+
+type SettingsResponse struct {
+	ConnectRequest
+	Settings []SettingsItemResult
+}
+
+// applySetting applies a Settings item to the device. DeviceName and
+// HostName change the device; the other recognized items only have an
+// effect on a real device and are just recorded in Device.Settings.
+func (device *Device) applySetting(item SettingsItem) error {
+	switch item.Item {
+	case "DeviceName":
+		if item.DeviceName == "" {
+			return &MDMError{Code: 12021, Domain: "MCMDMErrorDomain", Description: fmt.Sprintf("%s setting has no %s", item.Item, item.Item)}
+		}
+		device.ComputerName = item.DeviceName
+	case "HostName":
+		if item.HostName == "" {
+			return &MDMError{Code: 12021, Domain: "MCMDMErrorDomain", Description: fmt.Sprintf("%s setting has no %s", item.Item, item.Item)}
+		}
+		device.HostName = item.HostName
+	case "Bluetooth", "DataRoaming", "VoiceRoaming", "PersonalHotspot",
+		"OrganizationInfo", "Wallpaper", "TimeZone":
+	default:
+		return &MDMError{Code: 12021, Domain: "MCMDMErrorDomain", Description: "unsupported setting: " + item.Item}
+	}
+	if device.Settings == nil {
+		device.Settings = make(map[string]SettingsItem)
+	}
+	device.Settings[item.Item] = item
+	return nil
+}
+
+func (c *MDMClient) handleSettings(respBytes []byte) (interface{}, error) {
+	cmd := &Settings{}
+	err := plist.Unmarshal(respBytes, cmd)
+	if err != nil {
+		return nil, err
+	}
+	resp := &SettingsResponse{
+		ConnectRequest: *c.acknowledged(cmd.Command.RequestType, cmd.CommandUUID),
+		Settings:       []SettingsItemResult{},
+	}
+	// a failed item doesn't fail the command, only its own result
+	for _, item := range cmd.Command.Settings {
+		result := SettingsItemResult{Item: item.Item, Status: "Acknowledged"}
+		if err := c.Device.applySetting(item); err != nil {
+			level.Info(c.Device.logger()).Log("msg", "setting not applied", "item", item.Item, "command_uuid", cmd.CommandUUID, "err", err)
+			result.Status = "Error"
+			result.ErrorChain = MDMErrorChain{}.AddError(err)
+		}
+		resp.Settings = append(resp.Settings, result)
+	}
+	err = c.Device.Save()
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
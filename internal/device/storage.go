@@ -1,64 +1,379 @@
 package device
 
 import (
+	"encoding/json"
 	"errors"
 
-	bolt "go.etcd.io/bbolt"
+	"github.com/go-kit/kit/log/level"
 )
 
 func (device *Device) validDevice() bool {
 	return device.UDID != ""
 }
 
-// Save device to bolt DB storage
+// Save device to the Store
 func (device *Device) Save() error {
 	if !device.validDevice() {
 		return errors.New("invalid device")
 	}
-	return device.boltDB.Update(func(tx *bolt.Tx) error {
-		err := BucketPutOrDeleteString(tx, "device_serial", device.UDID, device.Serial)
+	return device.store.Update(device.put)
+}
+
+// put writes the device in tx
+func (device *Device) put(tx Tx) error {
+	err := BucketPutOrDeleteString(tx, "device_serial", device.UDID, device.Serial)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_computer_name", device.UDID, device.ComputerName)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_platform", device.UDID, device.Platform)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_product_name", device.UDID, device.ProductName)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_os_version", device.UDID, device.OSVersion)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_build_version", device.UDID, device.BuildVersion)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_host_name", device.UDID, device.HostName)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_local_host_name", device.UDID, device.LocalHostName)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_mac_address", device.UDID, device.MACAddress)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDelete(tx, "device_push_token", device.UDID, device.PushToken)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_push_magic", device.UDID, device.PushMagic)
+	if err != nil {
+		return err
+	}
+	var tokensJSON []byte
+	if len(device.AdditionalPushTokens) > 0 {
+		tokensJSON, err = json.Marshal(device.AdditionalPushTokens)
 		if err != nil {
 			return err
 		}
-		err = BucketPutOrDeleteString(tx, "device_computer_name", device.UDID, device.ComputerName)
+	}
+	err = BucketPutOrDelete(tx, "device_additional_push_tokens", device.UDID, tokensJSON)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDelete(tx, "device_unlock_token", device.UDID, device.UnlockToken)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDelete(tx, "device_bootstrap_token", device.UDID, device.BootstrapToken)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_mdm_identity_keychain_uuid", device.UDID, device.MDMIdentityKeychainUUID)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_mdm_profile_id", device.UDID, device.MDMProfileIdentifier)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_enrollment_id", device.UDID, device.EnrollmentID)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_enrollment_user_id", device.UDID, device.EnrollmentUserID)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_lom_mac_address", device.UDID, device.LOMMACAddress)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_lom_ipv6_address", device.UDID, device.LOMIPv6Address)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_lom_secret", device.UDID, device.LOMSecret)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_lom_last_request_type", device.UDID, device.LOMLastRequestType)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteInt(tx, "device_erased", device.UDID, boolInt(device.Erased))
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteInt(tx, "device_locked", device.UDID, boolInt(device.Locked))
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteString(tx, "device_lock_pin", device.UDID, device.LockPIN)
+	if err != nil {
+		return err
+	}
+	err = BucketPutOrDeleteInt(tx, "device_awaiting_configuration", device.UDID, boolInt(device.AwaitingConfiguration))
+	if err != nil {
+		return err
+	}
+	err = device.putPendingReport(tx)
+	if err != nil {
+		return err
+	}
+	err = device.putNotNowCounts(tx)
+	if err != nil {
+		return err
+	}
+	var appsJSON []byte
+	if len(device.Apps) > 0 {
+		appsJSON, err = json.Marshal(device.Apps)
 		if err != nil {
 			return err
 		}
-		err = BucketPutOrDeleteString(tx, "device_mdm_identity_keychain_uuid", device.UDID, device.MDMIdentityKeychainUUID)
+	}
+	err = BucketPutOrDelete(tx, "device_apps", device.UDID, appsJSON)
+	if err != nil {
+		return err
+	}
+	var updatesJSON []byte
+	if len(device.OSUpdates) > 0 {
+		updatesJSON, err = json.Marshal(device.OSUpdates)
 		if err != nil {
 			return err
 		}
-		return BucketPutOrDeleteString(tx, "device_mdm_profile_id", device.UDID, device.MDMProfileIdentifier)
-	})
+	}
+	err = BucketPutOrDelete(tx, "device_os_updates", device.UDID, updatesJSON)
+	if err != nil {
+		return err
+	}
+	var settingsJSON []byte
+	if len(device.Settings) > 0 {
+		settingsJSON, err = json.Marshal(device.Settings)
+		if err != nil {
+			return err
+		}
+	}
+	return BucketPutOrDelete(tx, "device_settings", device.UDID, settingsJSON)
 }
 
-// Load a device from bolt DB storage
-func Load(udid string, db *bolt.DB) (device *Device, err error) {
-	device = &Device{UDID: udid, boltDB: db}
-	err = db.View(func(tx *bolt.Tx) error {
+// Load a device from the Store
+func Load(udid string, db Store) (device *Device, err error) {
+	device = &Device{UDID: udid, store: db}
+	err = db.View(func(tx Tx) error {
 		device.Serial = BucketGetString(tx, "device_serial", udid)
 		if device.Serial == "" {
 			return errors.New("device not found (serial not found)")
 		}
 		device.ComputerName = BucketGetString(tx, "device_computer_name", udid)
+		device.ProductName = BucketGetString(tx, "device_product_name", udid)
+		device.Platform = BucketGetString(tx, "device_platform", udid)
+		device.OSVersion = BucketGetString(tx, "device_os_version", udid)
+		device.BuildVersion = BucketGetString(tx, "device_build_version", udid)
+		device.HostName = BucketGetString(tx, "device_host_name", udid)
+		device.LocalHostName = BucketGetString(tx, "device_local_host_name", udid)
+		device.MACAddress = BucketGetString(tx, "device_mac_address", udid)
+		device.PushToken = append([]byte(nil), BucketGet(tx, "device_push_token", udid)...)
+		device.PushMagic = BucketGetString(tx, "device_push_magic", udid)
+		if tokensJSON := BucketGet(tx, "device_additional_push_tokens", udid); len(tokensJSON) > 0 {
+			err := json.Unmarshal(tokensJSON, &device.AdditionalPushTokens)
+			if err != nil {
+				return err
+			}
+		}
+		device.UnlockToken = append([]byte(nil), BucketGet(tx, "device_unlock_token", udid)...)
+		device.BootstrapToken = append([]byte(nil), BucketGet(tx, "device_bootstrap_token", udid)...)
 		device.MDMIdentityKeychainUUID = BucketGetString(tx, "device_mdm_identity_keychain_uuid", udid)
 		device.MDMProfileIdentifier = BucketGetString(tx, "device_mdm_profile_id", udid)
+		device.EnrollmentID = BucketGetString(tx, "device_enrollment_id", udid)
+		device.EnrollmentUserID = BucketGetString(tx, "device_enrollment_user_id", udid)
+		device.LOMMACAddress = BucketGetString(tx, "device_lom_mac_address", udid)
+		device.LOMIPv6Address = BucketGetString(tx, "device_lom_ipv6_address", udid)
+		device.LOMSecret = BucketGetString(tx, "device_lom_secret", udid)
+		device.LOMLastRequestType = BucketGetString(tx, "device_lom_last_request_type", udid)
+		device.Erased = BucketGetInt(tx, "device_erased", udid) != 0
+		device.Locked = BucketGetInt(tx, "device_locked", udid) != 0
+		device.LockPIN = BucketGetString(tx, "device_lock_pin", udid)
+		device.AwaitingConfiguration = BucketGetInt(tx, "device_awaiting_configuration", udid) != 0
+		device.LastCommandUUID = BucketGetString(tx, "device_last_command_uuid", udid)
+		device.PendingReport = append([]byte(nil), BucketGet(tx, "device_pending_report", udid)...)
+		if countsJSON := BucketGet(tx, "device_not_now_counts", udid); len(countsJSON) > 0 {
+			err := json.Unmarshal(countsJSON, &device.NotNowCounts)
+			if err != nil {
+				return err
+			}
+		}
+		if appsJSON := BucketGet(tx, "device_apps", udid); len(appsJSON) > 0 {
+			err := json.Unmarshal(appsJSON, &device.Apps)
+			if err != nil {
+				return err
+			}
+		}
+		if updatesJSON := BucketGet(tx, "device_os_updates", udid); len(updatesJSON) > 0 {
+			err := json.Unmarshal(updatesJSON, &device.OSUpdates)
+			if err != nil {
+				return err
+			}
+		}
+		if settingsJSON := BucketGet(tx, "device_settings", udid); len(settingsJSON) > 0 {
+			err := json.Unmarshal(settingsJSON, &device.Settings)
+			if err != nil {
+				return err
+			}
+		}
 		return nil
 	})
 	return
 }
 
-// List devices in bolt DB storage
-func List(db *bolt.DB) (udids []string, err error) {
-	err = db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte("device_serial"))
-		if b == nil {
-			return nil
+// deviceBuckets are the buckets Save writes device attributes to
+var deviceBuckets = []string{
+	"device_serial",
+	"device_computer_name",
+	"device_platform",
+	"device_product_name",
+	"device_os_version",
+	"device_build_version",
+	"device_host_name",
+	"device_local_host_name",
+	"device_mac_address",
+	"device_push_token",
+	"device_push_magic",
+	"device_additional_push_tokens",
+	"device_unlock_token",
+	"device_bootstrap_token",
+	"device_mdm_identity_keychain_uuid",
+	"device_mdm_profile_id",
+	"device_enrollment_id",
+	"device_enrollment_user_id",
+	"device_lom_mac_address",
+	"device_lom_ipv6_address",
+	"device_lom_secret",
+	"device_lom_last_request_type",
+	"device_erased",
+	"device_locked",
+	"device_lock_pin",
+	"device_awaiting_configuration",
+	"device_last_command_uuid",
+	"device_pending_report",
+	"device_not_now_counts",
+	"device_apps",
+	"device_os_updates",
+	"device_settings",
+}
+
+func (device *Device) putPendingReport(tx Tx) error {
+	err := BucketPutOrDeleteString(tx, "device_last_command_uuid", device.UDID, device.LastCommandUUID)
+	if err != nil {
+		return err
+	}
+	return BucketPutOrDelete(tx, "device_pending_report", device.UDID, device.PendingReport)
+}
+
+// savePendingReport saves only LastCommandUUID and PendingReport, which
+// change with every command
+func (device *Device) savePendingReport() error {
+	if !device.validDevice() {
+		return errors.New("invalid device")
+	}
+	return device.store.Update(device.putPendingReport)
+}
+
+func (device *Device) putNotNowCounts(tx Tx) error {
+	var countsJSON []byte
+	if len(device.NotNowCounts) > 0 {
+		var err error
+		countsJSON, err = json.Marshal(device.NotNowCounts)
+		if err != nil {
+			return err
+		}
+	}
+	return BucketPutOrDelete(tx, "device_not_now_counts", device.UDID, countsJSON)
+}
+
+// saveNotNowCounts saves only NotNowCounts, which change with every
+// deferred command
+func (device *Device) saveNotNowCounts() error {
+	if !device.validDevice() {
+		return errors.New("invalid device")
+	}
+	return device.store.Update(device.putNotNowCounts)
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// MigrateStore migrates a Store with an older schema to SchemaVersion.
+// It refuses a Store with a newer schema.
+func MigrateStore(db Store) error {
+	return db.Update(func(tx Tx) error {
+		version, err := txSchemaVersion(tx)
+		if err != nil {
+			return err
+		}
+		return migrateSchema(tx, version)
+	})
+}
+
+// Delete removes the device record from the Store
+func (device *Device) Delete() error {
+	if !device.validDevice() {
+		return errors.New("invalid device")
+	}
+	return device.store.Update(func(tx Tx) error {
+		for _, bucket := range deviceBuckets {
+			if err := BucketPutOrDelete(tx, bucket, device.UDID, nil); err != nil {
+				return err
+			}
 		}
-		b.ForEach(func(k, _ []byte) error {
-			udids = append(udids, string(k))
-			return nil
-		})
+		return nil
+	})
+}
+
+// Purge unenrolls the device from MDM (sending a CheckOut) then deletes
+// its keychain items, profiles, payload refs, declarations, and the
+// device record
+func (device *Device) Purge() error {
+	if device.MDMProfileIdentifier != "" {
+		if err := device.RemoveProfile(device.MDMProfileIdentifier); err != nil {
+			level.Warn(device.logger()).Log("msg", "removing MDM profile", "profile", device.MDMProfileIdentifier, "err", err)
+		}
+	}
+	if err := device.SystemKeychain().purge(); err != nil {
+		return err
+	}
+	if err := device.SystemProfileStore().purge(); err != nil {
+		return err
+	}
+	if err := device.purgeDDM(); err != nil {
+		return err
+	}
+	return device.Delete()
+}
+
+// List devices in the Store
+func List(db Store) (udids []string, err error) {
+	err = db.View(func(tx Tx) error {
+		udids = tx.KeysWithPrefix("device_serial", "")
 		return nil
 	})
 	if len(udids) == 0 {
@@ -66,3 +381,24 @@ func List(db *bolt.DB) (udids []string, err error) {
 	}
 	return
 }
+
+// Enrolled returns the UDIDs of the devices in db with an MDM enrollment
+func Enrolled(db Store) (udids []string, err error) {
+	err = db.View(func(tx Tx) error {
+		udids = tx.KeysWithPrefix("device_mdm_profile_id", "")
+		return nil
+	})
+	return
+}
+
+// SerialUDIDs returns the UDIDs of the devices in db by serial number
+func SerialUDIDs(db Store) (map[string]string, error) {
+	udids := make(map[string]string)
+	err := db.View(func(tx Tx) error {
+		return BucketForEachWithPrefix(tx, "device_serial", "", false, func(k, v []byte) error {
+			udids[string(v)] = string(k)
+			return nil
+		})
+	})
+	return udids, err
+}
@@ -0,0 +1,99 @@
+package device
+
+import (
+	"bytes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store is the key/value storage of devices, keychains, and profile
+// stores. Keys live in named buckets. Reads and writes happen in
+// transactions so that related updates (e.g. a keychain item and its
+// class) are applied atomically.
+type Store interface {
+	// View calls fn with a read-only transaction
+	View(fn func(tx Tx) error) error
+	// Update calls fn with a read-write transaction which is committed
+	// if fn returns nil and otherwise rolled back
+	Update(fn func(tx Tx) error) error
+}
+
+// Tx is a Store transaction. Values are only valid for the life of the
+// transaction and must not be modified.
+type Tx interface {
+	// Get returns the value of key in bucket or nil
+	Get(bucket, key string) []byte
+	// Put sets the value of key in bucket, creating the bucket if needed
+	Put(bucket, key string, value []byte) error
+	// Delete removes key from bucket. Deleting a missing key is not an
+	// error.
+	Delete(bucket, key string) error
+	// KeysWithPrefix returns the keys in bucket with prefix in byte order
+	KeysWithPrefix(bucket, prefix string) []string
+}
+
+// BoltStore is a Store backed by a BoltDB file
+type BoltStore struct {
+	DB *bolt.DB
+}
+
+// NewBoltStore creates a Store backed by db
+func NewBoltStore(db *bolt.DB) *BoltStore {
+	return &BoltStore{DB: db}
+}
+
+// View calls fn with a read-only bolt transaction
+func (s *BoltStore) View(fn func(tx Tx) error) error {
+	return s.DB.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+// Update calls fn with a read-write bolt transaction
+func (s *BoltStore) Update(fn func(tx Tx) error) error {
+	return s.DB.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+func (t boltTx) Get(bucket, key string) []byte {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Get([]byte(key))
+}
+
+func (t boltTx) Put(bucket, key string, value []byte) error {
+	b, err := t.tx.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), value)
+}
+
+func (t boltTx) Delete(bucket, key string) error {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	return b.Delete([]byte(key))
+}
+
+func (t boltTx) KeysWithPrefix(bucket, prefix string) []string {
+	b := t.tx.Bucket([]byte(bucket))
+	if b == nil {
+		return nil
+	}
+	var keys []string
+	c := b.Cursor()
+	prefixBytes := []byte(prefix)
+	for k, _ := c.Seek(prefixBytes); k != nil && bytes.HasPrefix(k, prefixBytes); k, _ = c.Next() {
+		keys = append(keys, string(k))
+	}
+	return keys
+}
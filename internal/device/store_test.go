@@ -0,0 +1,110 @@
+package device
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// testStores returns an empty store of each implementation
+func testStores(t testing.TB) map[string]Store {
+	t.Helper()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "mdmb.db"), 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return map[string]Store{
+		"bolt":   NewBoltStore(db),
+		"memory": NewMemoryStore(),
+	}
+}
+
+func TestStore(t *testing.T) {
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := db.Update(func(tx Tx) error {
+				for _, k := range []string{"b_2", "a_1", "b_1", "c"} {
+					if err := tx.Put("bucket", k, []byte("v"+k)); err != nil {
+						return err
+					}
+				}
+				if err := tx.Delete("bucket", "c"); err != nil {
+					return err
+				}
+				// deleting missing keys and buckets isn't an error
+				if err := tx.Delete("bucket", "missing"); err != nil {
+					return err
+				}
+				return tx.Delete("missing", "missing")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = db.View(func(tx Tx) error {
+				if have, want := string(tx.Get("bucket", "a_1")), "va_1"; have != want {
+					t.Errorf("Get: have %q, want %q", have, want)
+				}
+				if v := tx.Get("bucket", "c"); v != nil {
+					t.Errorf("Get deleted key: have %q, want nil", v)
+				}
+				if v := tx.Get("missing", "a_1"); v != nil {
+					t.Errorf("Get from missing bucket: have %q, want nil", v)
+				}
+				if have, want := tx.KeysWithPrefix("bucket", "b_"), []string{"b_1", "b_2"}; !reflect.DeepEqual(have, want) {
+					t.Errorf("KeysWithPrefix: have %v, want %v", have, want)
+				}
+				if keys := tx.KeysWithPrefix("missing", ""); len(keys) != 0 {
+					t.Errorf("KeysWithPrefix of missing bucket: have %v, want none", keys)
+				}
+				if err := tx.Put("bucket", "d", []byte("vd")); err == nil {
+					t.Error("Put in read-only transaction: expected error")
+				}
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestStoreUpdateRollback(t *testing.T) {
+	errRollback := errors.New("rollback")
+	for name, db := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			err := db.Update(func(tx Tx) error {
+				return tx.Put("bucket", "kept", []byte("v"))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Update(func(tx Tx) error {
+				if err := tx.Put("bucket", "new", []byte("v")); err != nil {
+					return err
+				}
+				if err := tx.Delete("bucket", "kept"); err != nil {
+					return err
+				}
+				// writes are visible within the transaction
+				if have, want := tx.KeysWithPrefix("bucket", ""), []string{"new"}; !reflect.DeepEqual(have, want) {
+					t.Errorf("KeysWithPrefix in transaction: have %v, want %v", have, want)
+				}
+				return errRollback
+			})
+			if !errors.Is(err, errRollback) {
+				t.Fatalf("Update: have %v, want %v", err, errRollback)
+			}
+			db.View(func(tx Tx) error {
+				if have, want := tx.KeysWithPrefix("bucket", ""), []string{"kept"}; !reflect.DeepEqual(have, want) {
+					t.Errorf("KeysWithPrefix after rollback: have %v, want %v", have, want)
+				}
+				return nil
+			})
+		})
+	}
+}
@@ -0,0 +1,276 @@
+// Package testutil provides a fake MDM server for testing MDM clients
+// (such as mdmb devices) without a real MDM server
+package testutil
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// Message is a check-in message or Connect report received from a device
+type Message struct {
+	// MessageType is set for check-in messages
+	MessageType string
+	// Status, CommandUUID, and RequestType are set for Connect reports
+	Status      string
+	CommandUUID string
+	RequestType string
+
+	UDID         string
+	EnrollmentID string
+
+	// Body is the raw plist body
+	Body []byte
+	// Signer is the certificate that signed the Mdm-Signature header, if
+	// there was one
+	Signer *x509.Certificate
+}
+
+// ID returns the enrollment identifier: the EnrollmentID for user
+// enrollments or else the UDID
+func (m *Message) ID() string {
+	if m.EnrollmentID != "" {
+		return m.EnrollmentID
+	}
+	return m.UDID
+}
+
+type queuedCommand struct {
+	uuid string
+	body []byte
+}
+
+// enrollmentQueue is the command queue of one enrollment
+type enrollmentQueue struct {
+	commands []queuedCommand
+	// notNow are the commands answered NotNow this Connect session
+	notNow map[string]bool
+}
+
+// MDMServer is a fake MDM server with check-in and queue-based Connect
+// handling. Commands queued for a device are sent in order, one per
+// Connect report, until the device responds with a status other than
+// NotNow. A NotNow command is sent again in the next session (after the
+// next Idle report). It is safe for concurrent use.
+type MDMServer struct {
+	// RequireSignature rejects requests with no Mdm-Signature header.
+	// A signature present is always verified.
+	RequireSignature bool
+
+	srv *httptest.Server
+
+	mu       sync.Mutex
+	queues   map[string]*enrollmentQueue
+	checkins []*Message
+	reports  []*Message
+}
+
+// NewMDMServer creates and starts a fake MDM server listening on a local
+// HTTP address. Call Close when done.
+func NewMDMServer() *MDMServer {
+	s := NewMDMHandler()
+	s.srv = httptest.NewServer(s)
+	return s
+}
+
+// NewMDMHandler creates a fake MDM server without starting it, for
+// serving with ServeHTTP from another (e.g. TLS) server
+func NewMDMHandler() *MDMServer {
+	return &MDMServer{queues: make(map[string]*enrollmentQueue)}
+}
+
+// URL returns the check-in and Connect URL of a server from NewMDMServer
+func (s *MDMServer) URL() string {
+	if s.srv == nil {
+		return ""
+	}
+	return s.srv.URL + "/mdm"
+}
+
+// Close shuts down a server from NewMDMServer
+func (s *MDMServer) Close() {
+	if s.srv != nil {
+		s.srv.Close()
+	}
+}
+
+func (s *MDMServer) queue(id string) *enrollmentQueue {
+	q, ok := s.queues[id]
+	if !ok {
+		q = &enrollmentQueue{notNow: make(map[string]bool)}
+		s.queues[id] = q
+	}
+	return q
+}
+
+// Enqueue queues a command of requestType with the additional command
+// keys in fields for the device or user enrollment id and returns its
+// CommandUUID
+func (s *MDMServer) Enqueue(id, requestType string, fields map[string]interface{}) (string, error) {
+	cmd := map[string]interface{}{"RequestType": requestType}
+	for k, v := range fields {
+		cmd[k] = v
+	}
+	commandUUID := strings.ToUpper(uuid.NewString())
+	body, err := plist.Marshal(map[string]interface{}{
+		"Command":     cmd,
+		"CommandUUID": commandUUID,
+	})
+	if err != nil {
+		return "", err
+	}
+	s.EnqueueRaw(id, commandUUID, body)
+	return commandUUID, nil
+}
+
+// EnqueueRaw queues the raw command plist body with commandUUID for the
+// device or user enrollment id. The body needn't be valid, which is
+// useful for testing how clients handle malformed commands.
+func (s *MDMServer) EnqueueRaw(id, commandUUID string, body []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := s.queue(id)
+	q.commands = append(q.commands, queuedCommand{uuid: commandUUID, body: body})
+}
+
+// Queued returns the number of commands still queued for id
+func (s *MDMServer) Queued(id string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if q, ok := s.queues[id]; ok {
+		return len(q.commands)
+	}
+	return 0
+}
+
+// CheckinMessages returns the check-in messages received so far
+func (s *MDMServer) CheckinMessages() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.checkins...)
+}
+
+// Reports returns the Connect reports received so far
+func (s *MDMServer) Reports() []*Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*Message(nil), s.reports...)
+}
+
+// Report returns the last Connect report for commandUUID or nil if the
+// command hasn't been responded to
+func (s *MDMServer) Report(commandUUID string) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(s.reports) - 1; i >= 0; i-- {
+		if s.reports[i].CommandUUID == commandUUID {
+			return s.reports[i]
+		}
+	}
+	return nil
+}
+
+// verifyMdmSignature verifies a base64 encoded detached CMS signature of
+// body and returns the signer
+func verifyMdmSignature(header string, body []byte) (*x509.Certificate, error) {
+	der, err := base64.StdEncoding.DecodeString(header)
+	if err != nil {
+		return nil, fmt.Errorf("decoding Mdm-Signature: %w", err)
+	}
+	p7, err := pkcs7.Parse(der)
+	if err != nil {
+		return nil, fmt.Errorf("parsing Mdm-Signature: %w", err)
+	}
+	p7.Content = body
+	if err := p7.Verify(); err != nil {
+		return nil, fmt.Errorf("verifying Mdm-Signature: %w", err)
+	}
+	signer := p7.GetOnlySigner()
+	if signer == nil {
+		return nil, errors.New("Mdm-Signature must have exactly one signer")
+	}
+	return signer, nil
+}
+
+// ServeHTTP handles check-in and Connect requests
+func (s *MDMServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	msg := &Message{Body: body}
+	if sig := r.Header.Get("Mdm-Signature"); sig != "" {
+		msg.Signer, err = verifyMdmSignature(sig, body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+	} else if s.RequireSignature {
+		http.Error(w, "missing Mdm-Signature", http.StatusUnauthorized)
+		return
+	}
+	if err := plist.Unmarshal(body, msg); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	switch {
+	case msg.MessageType != "":
+		s.checkin(msg)
+	case msg.Status != "":
+		w.Write(s.connect(msg))
+	default:
+		http.Error(w, "neither a check-in message nor a Connect report", http.StatusBadRequest)
+	}
+}
+
+func (s *MDMServer) checkin(msg *Message) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.checkins = append(s.checkins, msg)
+	if msg.MessageType == "CheckOut" {
+		delete(s.queues, msg.ID())
+	}
+}
+
+// connect records a Connect report and returns the next command to send
+// or nil if there is none
+func (s *MDMServer) connect(msg *Message) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reports = append(s.reports, msg)
+	q := s.queue(msg.ID())
+	switch {
+	case msg.Status == "Idle":
+		// a new session: resend NotNow commands
+		q.notNow = make(map[string]bool)
+	case msg.Status == "NotNow":
+		q.notNow[msg.CommandUUID] = true
+	case msg.CommandUUID != "" || msg.Status == "CommandFormatError":
+		// a malformed command may have no CommandUUID to echo
+		for i, cmd := range q.commands {
+			if cmd.uuid == msg.CommandUUID {
+				q.commands = append(q.commands[:i], q.commands[i+1:]...)
+				break
+			}
+		}
+	}
+	for _, cmd := range q.commands {
+		if !q.notNow[cmd.uuid] {
+			return cmd.body
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package testutil
+
+import (
+	"bytes"
+	"encoding/base64"
+	"net/http"
+	"testing"
+
+	"github.com/groob/plist"
+	"go.mozilla.org/pkcs7"
+)
+
+// signedPost posts body to the server with an Mdm-Signature made by a new
+// identity over signedBody
+func signedPost(t *testing.T, s *MDMServer, body, signedBody []byte) int {
+	t.Helper()
+	req, err := http.NewRequest("PUT", s.URL(), bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if signedBody != nil {
+		key, cert, err := newIdentity()
+		if err != nil {
+			t.Fatal(err)
+		}
+		sd, err := pkcs7.NewSignedData(signedBody)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := sd.AddSigner(cert, key, pkcs7.SignerInfoConfig{}); err != nil {
+			t.Fatal(err)
+		}
+		sd.Detach()
+		sig, err := sd.Finish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Mdm-Signature", base64.StdEncoding.EncodeToString(sig))
+	}
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func TestMDMServerSignature(t *testing.T) {
+	s := NewMDMServer()
+	defer s.Close()
+	s.RequireSignature = true
+	body, err := plist.Marshal(map[string]string{"MessageType": "Authenticate", "UDID": "UDID-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name       string
+		signedBody []byte
+		want       int
+	}{
+		{"unsigned", nil, http.StatusUnauthorized},
+		{"other body signed", []byte("other"), http.StatusUnauthorized},
+		{"signed", body, http.StatusOK},
+	} {
+		if have := signedPost(t, s, body, test.signedBody); have != test.want {
+			t.Errorf("%s: have HTTP status %d, want %d", test.name, have, test.want)
+		}
+	}
+	if have := len(s.CheckinMessages()); have != 1 {
+		t.Errorf("have %d check-in messages, want 1", have)
+	}
+}
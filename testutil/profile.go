@@ -0,0 +1,90 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/groob/plist"
+	pkcs12 "software.sslmate.com/src/go-pkcs12"
+)
+
+const identityPassword = "testutil"
+
+// newIdentity creates a self-signed RSA identity for an enrollment
+func newIdentity() (*rsa.PrivateKey, *x509.Certificate, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "testutil MDM identity"},
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return key, cert, err
+}
+
+// EnrollmentProfile creates an enrollment profile for the server with
+// APNs topic and a PKCS#12 payload for the device identity, so devices
+// can enroll without a SCEP server. The MDM payload has SignMessage set
+// so every request carries an Mdm-Signature header.
+func (s *MDMServer) EnrollmentProfile(topic string) ([]byte, error) {
+	key, cert, err := newIdentity()
+	if err != nil {
+		return nil, err
+	}
+	p12, err := pkcs12.Encode(rand.Reader, key, cert, nil, identityPassword)
+	if err != nil {
+		return nil, err
+	}
+	newUUID := func() string { return strings.ToUpper(uuid.NewString()) }
+	identityUUID := newUUID()
+	profile := map[string]interface{}{
+		"PayloadType":        "Configuration",
+		"PayloadVersion":     1,
+		"PayloadIdentifier":  "com.github.jessepeterson.mdmb.testutil",
+		"PayloadUUID":        newUUID(),
+		"PayloadDisplayName": "testutil MDM enrollment",
+		"PayloadContent": []map[string]interface{}{
+			{
+				"PayloadType":       "com.apple.security.pkcs12",
+				"PayloadVersion":    1,
+				"PayloadIdentifier": "com.github.jessepeterson.mdmb.testutil.identity",
+				"PayloadUUID":       identityUUID,
+				"PayloadContent":    p12,
+				"Password":          identityPassword,
+			},
+			{
+				"PayloadType":             "com.apple.mdm",
+				"PayloadVersion":          1,
+				"PayloadIdentifier":       "com.github.jessepeterson.mdmb.testutil.mdm",
+				"PayloadUUID":             newUUID(),
+				"IdentityCertificateUUID": identityUUID,
+				"ServerURL":               s.URL(),
+				"CheckInURL":              s.URL(),
+				"Topic":                   topic,
+				"SignMessage":             true,
+				"AccessRights":            8191,
+			},
+		},
+	}
+	return plist.Marshal(profile)
+}
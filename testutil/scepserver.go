@@ -0,0 +1,283 @@
+package testutil
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/micromdm/scep/v2/scep"
+	"go.mozilla.org/pkcs7"
+)
+
+// SCEP attribute OIDs, from the scep package
+var (
+	oidSCEPmessageType    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 2}
+	oidSCEPpkiStatus      = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 3}
+	oidSCEPfailInfo       = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 4}
+	oidSCEPsenderNonce    = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 5}
+	oidSCEPrecipientNonce = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 6}
+	oidSCEPtransactionID  = asn1.ObjectIdentifier{2, 16, 840, 1, 113733, 1, 9, 7}
+)
+
+// SCEPRequest is a PKIOperation received by a SCEPServer
+type SCEPRequest struct {
+	MessageType   scep.MessageType
+	TransactionID string
+	// Signer is the certificate that signed the PKIMessage and
+	// SigningTime its signing time attribute
+	Signer      *x509.Certificate
+	SigningTime time.Time
+	// CSR is set for PKCSReq messages
+	CSR *x509.CertificateRequest
+}
+
+// SCEPServer is a fake SCEP CA which issues a certificate for every
+// PKCSReq, optionally after answering PENDING to a number of requests.
+// It is safe for concurrent use.
+type SCEPServer struct {
+	// Caps is the GetCACaps response
+	Caps []string
+	// Pending is the number of PKCSReq and CertPoll requests of each
+	// transaction answered PENDING before the certificate is issued
+	Pending int
+	// Validity is how long issued certificates are valid. Zero is a year.
+	Validity time.Duration
+
+	CACert *x509.Certificate
+	caKey  *rsa.PrivateKey
+	srv    *httptest.Server
+
+	mu       sync.Mutex
+	requests []*SCEPRequest
+	// csrs and polls are the CSR and number of requests per transaction
+	csrs  map[string]*x509.CertificateRequest
+	polls map[string]int
+}
+
+// NewSCEPServer creates and starts a fake SCEP CA listening on a local
+// HTTP address. Call Close when done.
+func NewSCEPServer() (*SCEPServer, error) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "testutil SCEP CA"},
+		NotBefore:             time.Now().Add(-24 * time.Hour),
+		NotAfter:              time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	s := &SCEPServer{
+		CACert: cert,
+		caKey:  key,
+		csrs:   make(map[string]*x509.CertificateRequest),
+		polls:  make(map[string]int),
+	}
+	s.srv = httptest.NewServer(s)
+	return s, nil
+}
+
+// URL returns the SCEP URL of the server
+func (s *SCEPServer) URL() string {
+	return s.srv.URL + "/scep"
+}
+
+// Close shuts down the server
+func (s *SCEPServer) Close() {
+	s.srv.Close()
+}
+
+// Requests returns the PKIOperations received so far
+func (s *SCEPServer) Requests() []*SCEPRequest {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*SCEPRequest(nil), s.requests...)
+}
+
+// ServeHTTP handles GetCACert, GetCACaps, and PKIOperation requests
+func (s *SCEPServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Query().Get("operation") {
+	case "GetCACert":
+		w.Header().Set("Content-Type", "application/x-x509-ca-cert")
+		w.Write(s.CACert.Raw)
+	case "GetCACaps":
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(strings.Join(s.Caps, "\n")))
+	case "PKIOperation":
+		msg, err := pkiMessage(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		resp, err := s.pkiOperation(msg)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/x-pki-message")
+		w.Write(resp)
+	default:
+		http.Error(w, "unknown operation", http.StatusBadRequest)
+	}
+}
+
+// pkiMessage returns the PKIMessage of a POST or GET PKIOperation
+func pkiMessage(r *http.Request) ([]byte, error) {
+	if r.Method == "POST" {
+		return ioutil.ReadAll(r.Body)
+	}
+	// the scep client uses URL-safe base64 though the RFC uses standard
+	msg := strings.NewReplacer("-", "+", "_", "/").Replace(r.URL.Query().Get("message"))
+	return base64.StdEncoding.DecodeString(msg)
+}
+
+// pkiOperation records a PKIMessage and returns the CertRep
+func (s *SCEPServer) pkiOperation(msg []byte) ([]byte, error) {
+	p7, err := pkcs7.Parse(msg)
+	if err != nil {
+		return nil, err
+	}
+	req := &SCEPRequest{Signer: p7.GetOnlySigner()}
+	var nonce []byte
+	for _, attr := range []struct {
+		oid asn1.ObjectIdentifier
+		out interface{}
+	}{
+		{oidSCEPmessageType, &req.MessageType},
+		{oidSCEPtransactionID, &req.TransactionID},
+		{oidSCEPsenderNonce, &nonce},
+		{pkcs7.OIDAttributeSigningTime, &req.SigningTime},
+	} {
+		if err := p7.UnmarshalSignedAttribute(attr.oid, attr.out); err != nil {
+			return nil, fmt.Errorf("PKIMessage attribute %s: %w", attr.oid, err)
+		}
+	}
+	if req.Signer == nil {
+		return nil, fmt.Errorf("PKIMessage must have exactly one signer")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests = append(s.requests, req)
+	if err := p7.Verify(); err != nil {
+		return s.certRep(req, nonce, scep.BadMessageCheck, nil)
+	}
+	switch req.MessageType {
+	case scep.PKCSReq:
+		envelope, err := pkcs7.Parse(p7.Content)
+		if err != nil {
+			return nil, err
+		}
+		csrDER, err := envelope.Decrypt(s.CACert, s.caKey)
+		if err != nil {
+			return s.certRep(req, nonce, scep.BadMessageCheck, nil)
+		}
+		req.CSR, err = x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			return s.certRep(req, nonce, scep.BadRequest, nil)
+		}
+		s.csrs[req.TransactionID] = req.CSR
+	case scep.CertPoll:
+	default:
+		return s.certRep(req, nonce, scep.BadRequest, nil)
+	}
+	csr, ok := s.csrs[req.TransactionID]
+	if !ok {
+		return s.certRep(req, nonce, scep.BadCertID, nil)
+	}
+	s.polls[req.TransactionID]++
+	if s.polls[req.TransactionID] <= s.Pending {
+		return s.certRep(req, nonce, "", nil)
+	}
+	cert, err := s.issue(csr)
+	if err != nil {
+		return nil, err
+	}
+	return s.certRep(req, nonce, "", cert)
+}
+
+// issue signs a certificate for csr
+func (s *SCEPServer) issue(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	validity := s.Validity
+	if validity == 0 {
+		validity = 365 * 24 * time.Hour
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      csr.Subject,
+		NotBefore:    time.Now().Add(-5 * time.Minute),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, s.CACert, csr.PublicKey, s.caKey)
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseCertificate(der)
+}
+
+// certRep creates a CertRep for req: FAILURE with failInfo if set, else
+// SUCCESS with cert encrypted to the requester, or PENDING without one
+func (s *SCEPServer) certRep(req *SCEPRequest, nonce []byte, failInfo scep.FailInfo, cert *x509.Certificate) ([]byte, error) {
+	attrs := []pkcs7.Attribute{
+		{Type: oidSCEPtransactionID, Value: req.TransactionID},
+		{Type: oidSCEPmessageType, Value: string(scep.CertRep)},
+		{Type: oidSCEPsenderNonce, Value: nonce},
+		{Type: oidSCEPrecipientNonce, Value: nonce},
+	}
+	var content []byte
+	switch {
+	case failInfo != "":
+		attrs = append(attrs,
+			pkcs7.Attribute{Type: oidSCEPpkiStatus, Value: string(scep.FAILURE)},
+			pkcs7.Attribute{Type: oidSCEPfailInfo, Value: string(failInfo)},
+		)
+	case cert == nil:
+		attrs = append(attrs, pkcs7.Attribute{Type: oidSCEPpkiStatus, Value: string(scep.PENDING)})
+	default:
+		attrs = append(attrs, pkcs7.Attribute{Type: oidSCEPpkiStatus, Value: string(scep.SUCCESS)})
+		deg, err := scep.DegenerateCertificates([]*x509.Certificate{cert})
+		if err != nil {
+			return nil, err
+		}
+		content, err = pkcs7.Encrypt(deg, []*x509.Certificate{req.Signer})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sd, err := pkcs7.NewSignedData(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := sd.AddSigner(s.CACert, s.caKey, pkcs7.SignerInfoConfig{ExtraSignedAttributes: attrs}); err != nil {
+		return nil, err
+	}
+	return sd.Finish()
+}